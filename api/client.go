@@ -1,5 +1,11 @@
 package api
 
+import (
+	"encoding/hex"
+	"github.com/blk-io/crux/utils"
+	"time"
+)
+
 // SendRequest sends a new transaction to the enclave for storage and propagation to the provided
 // recipients.
 type SendRequest struct {
@@ -9,14 +15,56 @@ type SendRequest struct {
 	From string `json:"from"`
 	// To is a list of the recipient nodes that should be privy to this transaction payload.
 	To []string `json:"to"`
+	// PrivacyFlag is the privacy mode of the transaction, used by Quorum's enhanced privacy.
+	PrivacyFlag PrivacyMode `json:"privacyFlag,omitempty"`
+	// AffectedContractTransactions are the base64 encoded keys of the contract transactions
+	// affected by the transaction.
+	AffectedContractTransactions []string `json:"affectedContractTransactions,omitempty"`
+	// ExecHash is the base64 encoded execution hash of the transaction, which is required for
+	// private state validation.
+	ExecHash string `json:"execHash,omitempty"`
+	// PrivacyGroupId is the privacy group whose members the transaction is sent to, in place of
+	// the To list.
+	PrivacyGroupId string `json:"privacyGroupId,omitempty"`
 }
 
+// PrivacyMode is the privacy mode of a transaction under Quorum's enhanced privacy.
+type PrivacyMode int
+
+const (
+	// StandardPrivate transactions are not validated against the contracts they affect.
+	StandardPrivate PrivacyMode = 0
+	// PartyProtection transactions may only affect contracts which every recipient is a party to.
+	PartyProtection PrivacyMode = 1
+	// PrivateStateValidation transactions additionally require the contracts they affect to
+	// have the same participants, and carry the hash of their execution.
+	PrivateStateValidation PrivacyMode = 3
+)
+
 // SendResponse is the response to the SendRequest
 type SendResponse struct {
 	// Key is the key that can be used to retrieve the submitted transaction.
 	Key string `json:"key"`
 }
 
+// StoreRawRequest stores a transaction payload encrypted for its sender only, the first step of
+// Quorum's raw private transaction flow.
+type StoreRawRequest struct {
+	Payload string `json:"payload"`
+	From    string `json:"from,omitempty"`
+}
+
+// SendSignedTxRequest sends a payload stored by a StoreRawRequest to its recipients, once its
+// transaction has been signed. Hash is the key returned by the StoreRawRequest.
+type SendSignedTxRequest struct {
+	Hash                         string      `json:"hash"`
+	To                           []string    `json:"to"`
+	PrivacyFlag                  PrivacyMode `json:"privacyFlag,omitempty"`
+	AffectedContractTransactions []string    `json:"affectedContractTransactions,omitempty"`
+	ExecHash                     string      `json:"execHash,omitempty"`
+	PrivacyGroupId               string      `json:"privacyGroupId,omitempty"`
+}
+
 // ReceiveRequest
 type ReceiveRequest struct {
 	Key string `json:"key"`
@@ -25,7 +73,22 @@ type ReceiveRequest struct {
 
 // ReceiveResponse returns the raw payload associated with the ReceiveRequest.
 type ReceiveResponse struct {
-	Payload string `json:"payload"`
+	Payload                      string      `json:"payload"`
+	PrivacyFlag                  PrivacyMode `json:"privacyFlag,omitempty"`
+	AffectedContractTransactions []string    `json:"affectedContractTransactions,omitempty"`
+	ExecHash                     string      `json:"execHash,omitempty"`
+	PrivacyGroupId               string      `json:"privacyGroupId,omitempty"`
+}
+
+// ReceiveDetailsResponse extends the ReceiveResponse of /v2/receive with the base64 encoded keys
+// involved in the payload.
+type ReceiveDetailsResponse struct {
+	ReceiveResponse
+	// DecryptedBy is the public key hosted by this node which decrypted the payload.
+	DecryptedBy string `json:"decryptedBy"`
+	Sender      string `json:"sender"`
+	// Recipients are the recipients of a payload sent by this node.
+	Recipients []string `json:"recipients,omitempty"`
 }
 
 // DeleteRequest deletes the entry matching the given key from the enclave.
@@ -33,6 +96,106 @@ type DeleteRequest struct {
 	Key string `json:"key"`
 }
 
+// EraseRequest deletes a payload sent by this node, along with the copies held by the nodes of
+// each of its recipients.
+type EraseRequest struct {
+	Key string `json:"key"`
+}
+
+// EraseResponse reports which recipients acknowledged the deletion of their copies of a payload.
+type EraseResponse struct {
+	Key        string            `json:"key"`
+	Recipients []RecipientStatus `json:"recipients"`
+}
+
+// ShareRequest gives additional recipients access to a payload sent by this node. From must be
+// the sender of the payload.
+type ShareRequest struct {
+	Key  string   `json:"key"`
+	From string   `json:"from"`
+	To   []string `json:"to"`
+}
+
+// ShareResponse reports whether the payload was delivered to each of the added recipients.
+type ShareResponse struct {
+	Key        string            `json:"key"`
+	Recipients []RecipientStatus `json:"recipients"`
+}
+
+// PushDeleteRequest asks the node hosting a recipient of a payload to delete its copy. The proof
+// is the DeleteProof of the payload, sealed with the shared key of its sender and recipient.
+type PushDeleteRequest struct {
+	Key       string `json:"key"`
+	Sender    string `json:"sender"`
+	Recipient string `json:"recipient"`
+	Nonce     string `json:"nonce"`
+	Proof     string `json:"proof"`
+}
+
+// DeleteProof returns the message sealed in the proof of a PushDeleteRequest for the payload with
+// the given digest.
+func DeleteProof(digest []byte) []byte {
+	return append([]byte("crux-delete:"), digest...)
+}
+
+// PrivacyGroupType is the type of privacy groups created by Crux, as named by Besu.
+const PrivacyGroupType = "PANTHEON"
+
+// PrivacyGroupState is the state of a privacy group.
+type PrivacyGroupState string
+
+const (
+	ActiveGroup  PrivacyGroupState = "ACTIVE"
+	DeletedGroup PrivacyGroupState = "DELETED"
+)
+
+// PrivacyGroup is a named group of public keys, which transactions can be sent to by its id.
+type PrivacyGroup struct {
+	PrivacyGroupId string            `json:"privacyGroupId"`
+	Name           string            `json:"name"`
+	Description    string            `json:"description"`
+	Type           string            `json:"type"`
+	Members        []string          `json:"members"`
+	State          PrivacyGroupState `json:"state"`
+}
+
+// CreatePrivacyGroupRequest creates a privacy group, which is distributed to all of its members.
+// From must be one of the members, and hosted by this node.
+type CreatePrivacyGroupRequest struct {
+	From        string   `json:"from"`
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Members     []string `json:"members"`
+}
+
+// FindPrivacyGroupRequest finds the active privacy groups with exactly the given members.
+type FindPrivacyGroupRequest struct {
+	Addresses []string `json:"addresses"`
+}
+
+// PrivacyGroupRequest retrieves, or deletes on behalf of From, a privacy group.
+type PrivacyGroupRequest struct {
+	PrivacyGroupId string `json:"privacyGroupId"`
+	From           string `json:"from,omitempty"`
+}
+
+// PushPrivacyGroupRequest distributes a privacy group, encoded as JSON, to the node hosting one
+// of its members. The proof is the PrivacyGroupProof of the encoded group, sealed with the shared
+// key of the sending and receiving members.
+type PushPrivacyGroupRequest struct {
+	Group     string `json:"group"`
+	Sender    string `json:"sender"`
+	Recipient string `json:"recipient"`
+	Nonce     string `json:"nonce"`
+	Proof     string `json:"proof"`
+}
+
+// PrivacyGroupProof returns the message sealed in the proof of a PushPrivacyGroupRequest for an
+// encoded privacy group.
+func PrivacyGroupProof(encodedGroup []byte) []byte {
+	return append([]byte("crux-privacy-group:"), utils.Sha3Hash(encodedGroup)...)
+}
+
 // ResendRequest is used to resend previous transactions.
 // There are two types of supported request.
 // 1. All transactions associated with a node, in which case the Key field should be omitted.
@@ -45,6 +208,114 @@ type ResendRequest struct {
 	Key       string `json:"key,omitempty"`
 }
 
+// Origins of stored payloads, other than the URL of the node which pushed them.
+const (
+	// LocalOrigin is the origin of payloads sent by this node.
+	LocalOrigin = "local"
+	// UnknownOrigin is the origin of payloads pushed by nodes whose URL is not known.
+	UnknownOrigin = "unknown"
+)
+
+// DeliveryStatus is the status of the delivery of a payload to one of its recipients.
+type DeliveryStatus string
+
+const (
+	Pending   DeliveryStatus = "pending"
+	Delivered DeliveryStatus = "delivered"
+	Failed    DeliveryStatus = "failed"
+	// Acknowledged is the status of a recipient whose node has deleted its copy of a payload.
+	Acknowledged DeliveryStatus = "acknowledged"
+)
+
+// PayloadMetadata describes where a stored payload came from, and its delivery to each of its
+// recipients if it was sent by this node.
+type PayloadMetadata struct {
+	// Key is the key of the payload.
+	Key string `json:"key"`
+	// Created is when the payload was sent, for payloads sent by this node.
+	Created *time.Time `json:"created,omitempty"`
+	// Received is when the payload was stored.
+	Received time.Time `json:"received"`
+	// Origin is LocalOrigin, UnknownOrigin or the URL of the node which pushed the payload.
+	Origin string `json:"origin"`
+	// Size is the size of the stored payload in bytes.
+	Size int `json:"size"`
+	// Recipients are the recipients of a payload sent by this node.
+	Recipients []RecipientStatus `json:"recipients,omitempty"`
+	// Recipient is the hosted key a payload pushed to this node was sealed for, recorded when
+	// the node hosts several keys.
+	Recipient string `json:"recipient,omitempty"`
+}
+
+// RecipientStatus is the delivery status of a payload to one of its recipients.
+type RecipientStatus struct {
+	PublicKey string         `json:"publicKey"`
+	Status    DeliveryStatus `json:"status"`
+	// Updated is when the status last changed.
+	Updated time.Time `json:"updated"`
+	// Error is the reason the last delivery failed.
+	Error string `json:"error,omitempty"`
+}
+
+// Operations recorded in the audit log.
+const (
+	AuditStore      = "store"
+	AuditStoreRaw   = "storeraw"
+	AuditSendSigned = "sendsignedtx"
+	AuditPush       = "push"
+	AuditRetrieve   = "retrieve"
+	AuditResend     = "resend"
+	AuditResendAll  = "resendall"
+	AuditDelete     = "delete"
+	AuditErase      = "erase"
+	AuditShare      = "share"
+	AuditPushDelete = "pushdelete"
+	AuditPartyInfo  = "partyinfo"
+
+	AuditCreatePrivacyGroup = "createprivacygroup"
+	AuditDeletePrivacyGroup = "deleteprivacygroup"
+	AuditPushPrivacyGroup   = "pushprivacygroup"
+)
+
+// AuditEntry is an entry in the audit log of operations on the enclave. Each entry includes the
+// hash of the previous entry, so that any change to the log can be detected.
+type AuditEntry struct {
+	// Seq is the position of the entry in the log, starting from 1.
+	Seq  uint64    `json:"seq"`
+	Time time.Time `json:"time"`
+	// Operation is one of the audited operations, such as AuditStore.
+	Operation string `json:"operation"`
+	// Caller identifies who requested the operation, "ipc" for requests via the IPC socket,
+	// otherwise the remote address of the request.
+	Caller string `json:"caller"`
+	// Keys are the fingerprints of the public keys involved, such as the sender and recipients.
+	Keys []string `json:"keys,omitempty"`
+	// Digest is the base64 encoded key of the payload, if any.
+	Digest string `json:"digest,omitempty"`
+	// Error is the code of the error the operation failed with, if it failed.
+	Error ErrorCode `json:"error,omitempty"`
+	// Prev is the hash of the previous entry, empty for the first entry.
+	Prev string `json:"prev"`
+	// Hash is the hex encoded SHA3-512 hash of the JSON encoding of the entry with an empty Hash.
+	Hash string `json:"hash"`
+}
+
+// KeyFingerprint returns the fingerprint of a public key used in the audit log, the hex encoded
+// first 8 bytes of its SHA3-512 hash.
+func KeyFingerprint(key []byte) string {
+	return hex.EncodeToString(utils.Sha3Hash(key)[:8])
+}
+
+// ErrorResponse is returned by the HTTP API when a request fails.
+type ErrorResponse struct {
+	// Code is the stable error code, such as NOT_FOUND.
+	Code ErrorCode `json:"code"`
+	// Message describes the error.
+	Message string `json:"message"`
+	// Field is the request field which was invalid, if applicable.
+	Field string `json:"field,omitempty"`
+}
+
 type UpdatePartyInfo struct {
 	Url        string            `json:"url"`
 	Recipients map[string][]byte `json:"recipients"`
@@ -2,6 +2,7 @@ package api
 
 import (
 	"encoding/binary"
+	"fmt"
 	"github.com/blk-io/crux/utils"
 	"github.com/kevinburke/nacl"
 )
@@ -39,6 +40,15 @@ func DecodePayload(encoded []byte) EncryptedPayload {
 }
 
 func EncodePayloadWithRecipients(ep EncryptedPayload, recipients [][]byte) []byte {
+	return EncodePayloadWithPrivacy(ep, recipients, PrivacyMetadata{})
+}
+
+// EncodePayloadWithPrivacy encodes a payload like EncodePayloadWithRecipients, followed by its
+// privacy metadata unless it is StandardPrivate without a privacy group, so that such payloads
+// are unchanged.
+func EncodePayloadWithPrivacy(
+	ep EncryptedPayload, recipients [][]byte, privacy PrivacyMetadata) []byte {
+
 	encoded := make([][]byte, 2)
 
 	encoded[0] = EncodePayload(ep)
@@ -47,10 +57,52 @@ func EncodePayloadWithRecipients(ep EncryptedPayload, recipients [][]byte) []byt
 	encodedRecipients, recipientsLength := writeSliceOfSlice(recipients, encodedRecipients, 0)
 	encoded[1] = encodedRecipients[:recipientsLength]
 
+	if privacy.Mode != StandardPrivate || len(privacy.PrivacyGroupId) > 0 {
+		encoded = append(encoded, EncodePrivacyMetadata(privacy))
+	}
+
 	encoded2, length := writeSliceOfSlice(encoded, make([]byte, 512), 0)
 	return encoded2[:length]
 }
 
+// EncodePrivacyMetadata encodes the privacy metadata of a payload.
+func EncodePrivacyMetadata(privacy PrivacyMetadata) []byte {
+	affected := make([][]byte, 0, 2*len(privacy.AffectedContracts))
+	for _, contract := range privacy.AffectedContracts {
+		affected = append(affected, contract.Digest, contract.SecurityHash)
+	}
+
+	encoded := make([]byte, 256)
+	offset := 0
+	encoded, offset = writeInt(int(privacy.Mode), encoded, offset)
+	encoded, offset = writeSliceOfSlice(affected, encoded, offset)
+	encoded, offset = writeSlice(privacy.ExecHash, encoded, offset)
+	encoded, offset = writeSliceOfSlice(privacy.Recipients, encoded, offset)
+	encoded, offset = writeSlice(privacy.PrivacyGroupId, encoded, offset)
+	return encoded[:offset]
+}
+
+// ParsePrivacyMetadata decodes privacy metadata encoded with EncodePrivacyMetadata.
+func ParsePrivacyMetadata(encoded []byte) (PrivacyMetadata, error) {
+	d := decoder{src: encoded}
+	privacy := PrivacyMetadata{Mode: PrivacyMode(d.readInt())}
+	affected := d.readSliceOfSlice()
+	privacy.ExecHash = append([]byte(nil), d.readSlice()...)
+	privacy.Recipients = d.readSliceOfSlice()
+	privacy.PrivacyGroupId = append([]byte(nil), d.readSlice()...)
+	if err := d.done(); err != nil {
+		return PrivacyMetadata{}, err
+	}
+	if len(affected)%2 != 0 {
+		return PrivacyMetadata{}, fmt.Errorf("malformed payload: incomplete affected contract")
+	}
+	for i := 0; i < len(affected); i += 2 {
+		privacy.AffectedContracts = append(privacy.AffectedContracts,
+			AffectedContract{Digest: affected[i], SecurityHash: affected[i+1]})
+	}
+	return privacy, nil
+}
+
 func DecodePayloadWithRecipients(encoded []byte) (EncryptedPayload, [][]byte) {
 
 	decoded, _ := readSliceOfSlice(encoded, 0)
@@ -191,3 +243,138 @@ func readSliceOfSlice(src []byte, offset int) ([][]byte, int) {
 	}
 	return result, offset
 }
+
+// ParsePayload decodes an encoded EncryptedPayload like DecodePayload, but returns an error
+// rather than panicking if it is malformed.
+func ParsePayload(encoded []byte) (EncryptedPayload, error) {
+	d := decoder{src: encoded}
+	ep := EncryptedPayload{
+		Sender:         new([nacl.KeySize]byte),
+		Nonce:          new([nacl.NonceSize]byte),
+		RecipientNonce: new([nacl.NonceSize]byte),
+	}
+	d.readArray("sender", (*ep.Sender)[:])
+	ep.CipherText = d.readSlice()
+	d.readArray("nonce", (*ep.Nonce)[:])
+	ep.RecipientBoxes = d.readSliceOfSlice()
+	d.readArray("recipient nonce", (*ep.RecipientNonce)[:])
+	return ep, d.done()
+}
+
+// ParsePayloadWithRecipients decodes a payload encoded with EncodePayloadWithRecipients like
+// DecodePayloadWithRecipients, but returns an error rather than panicking if it is malformed.
+func ParsePayloadWithRecipients(encoded []byte) (EncryptedPayload, [][]byte, error) {
+	ep, recipients, _, err := ParsePayloadWithPrivacy(encoded)
+	return ep, recipients, err
+}
+
+// ParsePayloadWithPrivacy decodes a payload encoded with EncodePayloadWithPrivacy, returning an
+// error if it is malformed. Payloads without privacy metadata are StandardPrivate.
+func ParsePayloadWithPrivacy(
+	encoded []byte) (EncryptedPayload, [][]byte, PrivacyMetadata, error) {
+
+	var privacy PrivacyMetadata
+	d := decoder{src: encoded}
+	decoded := d.readSliceOfSlice()
+	if err := d.done(); err != nil {
+		return EncryptedPayload{}, nil, privacy, err
+	}
+	if len(decoded) < 2 {
+		return EncryptedPayload{}, nil, privacy, fmt.Errorf("malformed payload: missing recipients")
+	}
+
+	ep, err := ParsePayload(decoded[0])
+	if err != nil {
+		return EncryptedPayload{}, nil, privacy, err
+	}
+	d = decoder{src: decoded[1]}
+	recipients := d.readSliceOfSlice()
+	if err = d.done(); err != nil {
+		return EncryptedPayload{}, nil, privacy, err
+	}
+	if len(decoded) > 2 {
+		privacy, err = ParsePrivacyMetadata(decoded[2])
+	}
+	return ep, recipients, privacy, err
+}
+
+// decoder reads the fields of an encoded value, checking that each is within its bounds. Once
+// a read has failed, subsequent reads return nothing.
+type decoder struct {
+	src    []byte
+	offset int
+	err    error
+}
+
+func (d *decoder) fail(format string, a ...interface{}) {
+	if d.err == nil {
+		d.err = fmt.Errorf("malformed payload: "+format, a...)
+	}
+}
+
+func (d *decoder) readLength() int {
+	if d.err != nil {
+		return 0
+	}
+	if len(d.src)-d.offset < 8 {
+		d.fail("truncated at offset %d", d.offset)
+		return 0
+	}
+	length := binary.BigEndian.Uint64(d.src[d.offset:])
+	d.offset += 8
+	if length > uint64(len(d.src)-d.offset) {
+		d.fail("length %d at offset %d exceeds the remaining %d bytes",
+			length, d.offset-8, len(d.src)-d.offset)
+		return 0
+	}
+	return int(length)
+}
+
+func (d *decoder) readInt() int {
+	if d.err != nil {
+		return 0
+	}
+	if len(d.src)-d.offset < 8 {
+		d.fail("truncated at offset %d", d.offset)
+		return 0
+	}
+	v := binary.BigEndian.Uint64(d.src[d.offset:])
+	d.offset += 8
+	return int(v)
+}
+
+func (d *decoder) readSlice() []byte {
+	length := d.readLength()
+	if d.err != nil {
+		return nil
+	}
+	s := d.src[d.offset : d.offset+length]
+	d.offset += length
+	return s
+}
+
+func (d *decoder) readArray(field string, dest []byte) {
+	s := d.readSlice()
+	if d.err == nil && len(s) != len(dest) {
+		d.fail("%s is %d bytes, expected %d", field, len(s), len(dest))
+	}
+	copy(dest, s)
+}
+
+func (d *decoder) readSliceOfSlice() [][]byte {
+	// Each element is at least 8 bytes, so the length also bounds the number of elements
+	count := d.readLength()
+	result := make([][]byte, 0, count)
+	for i := 0; i < count && d.err == nil; i++ {
+		result = append(result, append([]byte(nil), d.readSlice()...))
+	}
+	return result
+}
+
+// done returns the first error encountered, or an error if any of the input remains unread.
+func (d *decoder) done() error {
+	if d.err == nil && d.offset != len(d.src) {
+		d.fail("%d unexpected bytes at offset %d", len(d.src)-d.offset, d.offset)
+	}
+	return d.err
+}
@@ -112,3 +112,102 @@ func toKey(encodedKey string) [nacl.KeySize]byte {
 	key, _ := utils.LoadBase64Key(encodedKey)
 	return *key
 }
+
+func TestParsePayloadWithRecipients(t *testing.T) {
+	epl := EncryptedPayload{
+		Sender:         nacl.NewKey(),
+		CipherText:     []byte("C1ph3r T3xt"),
+		Nonce:          nacl.NewNonce(),
+		RecipientBoxes: [][]byte{[]byte("B0x1"), []byte("B0x2")},
+		RecipientNonce: nacl.NewNonce(),
+	}
+	recipients := [][]byte{(*nacl.NewKey())[:], (*nacl.NewKey())[:]}
+	encoded := EncodePayloadWithRecipients(epl, recipients)
+
+	decodedEpl, decodedRecipients, err := ParsePayloadWithRecipients(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(epl, decodedEpl) {
+		t.Errorf("Parsed payload: %v does not match input %v", decodedEpl, epl)
+	}
+	if !reflect.DeepEqual(recipients, decodedRecipients) {
+		t.Errorf("Parsed recipients: %v do not match input %v", decodedRecipients, recipients)
+	}
+
+	// Every truncation must be rejected, rather than panicking
+	for i := 0; i < len(encoded); i++ {
+		if _, _, err := ParsePayloadWithRecipients(encoded[:i]); err == nil {
+			t.Errorf("Payload truncated to %d bytes was parsed", i)
+		}
+	}
+
+	invalid := map[string][]byte{
+		"trailing bytes": append(append([]byte{}, encoded...), 0),
+		"huge length":    append([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, encoded[8:]...),
+	}
+	for name, encoded := range invalid {
+		if _, _, err := ParsePayloadWithRecipients(encoded); err == nil {
+			t.Errorf("Payload with %s was parsed", name)
+		}
+	}
+
+	// The sender is encoded first, shorten it by a byte
+	shortSender := EncodePayload(epl)
+	shortSender[7] = nacl.KeySize - 1
+	if _, err := ParsePayload(shortSender); err == nil {
+		t.Errorf("Payload with a short sender was parsed")
+	}
+}
+
+func TestEncodePayloadWithPrivacy(t *testing.T) {
+	epl := EncryptedPayload{
+		Sender:         nacl.NewKey(),
+		CipherText:     []byte("C1ph3r T3xt"),
+		Nonce:          nacl.NewNonce(),
+		RecipientBoxes: [][]byte{[]byte("B0x1")},
+		RecipientNonce: nacl.NewNonce(),
+	}
+	recipients := [][]byte{(*nacl.NewKey())[:]}
+
+	// Standard payloads are encoded as before
+	standard := EncodePayloadWithPrivacy(epl, recipients, PrivacyMetadata{})
+	if !reflect.DeepEqual(standard, EncodePayloadWithRecipients(epl, recipients)) {
+		t.Errorf("Standard payload should be encoded without privacy metadata")
+	}
+
+	privacy := PrivacyMetadata{
+		Mode: PrivateStateValidation,
+		AffectedContracts: []AffectedContract{
+			{Digest: []byte("D1g3st1"), SecurityHash: []byte("H4sh1")},
+			{Digest: []byte("D1g3st2"), SecurityHash: []byte("H4sh2")},
+		},
+		ExecHash:       []byte("3x3c"),
+		Recipients:     [][]byte{(*epl.Sender)[:], recipients[0]},
+		PrivacyGroupId: []byte("Gr0up"),
+	}
+	encoded := EncodePayloadWithPrivacy(epl, recipients, privacy)
+
+	decodedEpl, decodedRecipients, decodedPrivacy, err := ParsePayloadWithPrivacy(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(epl, decodedEpl) || !reflect.DeepEqual(recipients, decodedRecipients) {
+		t.Errorf("Parsed payload: %v, %v does not match input", decodedEpl, decodedRecipients)
+	}
+	if !reflect.DeepEqual(privacy, decodedPrivacy) {
+		t.Errorf("Parsed privacy metadata: %+v does not match input %+v", decodedPrivacy, privacy)
+	}
+
+	// Nodes which predate privacy metadata ignore it
+	oldEpl, oldRecipients := DecodePayloadWithRecipients(encoded)
+	if !reflect.DeepEqual(epl, oldEpl) || !reflect.DeepEqual(recipients, oldRecipients) {
+		t.Errorf("Payload with privacy metadata is not compatible with DecodePayloadWithRecipients")
+	}
+
+	for i := 0; i < len(encoded); i++ {
+		if _, _, _, err := ParsePayloadWithPrivacy(encoded[:i]); err == nil {
+			t.Errorf("Payload truncated to %d bytes was parsed", i)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package api
+
+import "fmt"
+
+// ErrorCode classifies the errors returned by the enclave. The codes are stable, and are returned
+// to clients of both the HTTP and gRPC APIs.
+type ErrorCode string
+
+const (
+	// NotFound indicates the requested payload does not exist, or is not available to the
+	// requesting party.
+	NotFound ErrorCode = "NOT_FOUND"
+	// InvalidArgument indicates a malformed request, such as an undecodable key.
+	InvalidArgument ErrorCode = "INVALID_ARGUMENT"
+	// Unauthorized indicates the caller is not permitted to perform the operation, such as sending
+	// from a key which is not hosted by this node.
+	Unauthorized ErrorCode = "UNAUTHORIZED"
+	// Deleted indicates the payload has been erased, and will not be stored again.
+	Deleted ErrorCode = "DELETED"
+	// Unavailable indicates a transient failure, such as a remote node not being reachable.
+	Unavailable ErrorCode = "UNAVAILABLE"
+	// Internal indicates an unexpected failure within the enclave.
+	Internal ErrorCode = "INTERNAL"
+)
+
+// Error is an error with an associated ErrorCode.
+type Error struct {
+	Code    ErrorCode
+	Message string
+	Field   string // The request field which was invalid, if applicable
+	Err     error  // The underlying cause, if any
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %v", e.Message, e.Err)
+	}
+	return e.Message
+}
+
+// NewError creates a new Error with the given code and formatted message.
+func NewError(code ErrorCode, format string, args ...interface{}) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// WrapError creates a new Error with the given code and formatted message, caused by err.
+func WrapError(code ErrorCode, err error, format string, args ...interface{}) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...), Err: err}
+}
+
+// FieldError creates a new InvalidArgument Error for the named request field.
+func FieldError(field string, err error, format string, args ...interface{}) *Error {
+	return &Error{
+		Code: InvalidArgument, Message: fmt.Sprintf(format, args...), Field: field, Err: err}
+}
+
+// CodeOf returns the ErrorCode of err, errors without a code are Internal.
+func CodeOf(err error) ErrorCode {
+	if e, ok := err.(*Error); ok {
+		return e.Code
+	}
+	return Internal
+}
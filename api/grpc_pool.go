@@ -0,0 +1,171 @@
+package api
+
+import (
+	"crypto/tls"
+	"expvar"
+	"fmt"
+	"github.com/blk-io/chimera-api/chimera"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMaxConcurrentCalls is the default number of in-flight calls permitted to each peer.
+	DefaultMaxConcurrentCalls = 32
+	// DefaultCallTimeout is applied to calls whose context does not already have a deadline.
+	DefaultCallTimeout = 10 * time.Second
+
+	// KeepaliveTime is the interval at which idle peer connections are pinged. Servers must permit
+	// pings at this rate via their keepalive enforcement policy.
+	KeepaliveTime    = 30 * time.Second
+	keepaliveTimeout = 10 * time.Second
+	maxBackoffDelay  = 30 * time.Second
+)
+
+// grpcPoolMetrics are published via expvar under crux.grpcpool.
+var grpcPoolMetrics = expvar.NewMap("crux.grpcpool")
+
+// GrpcPool maintains a single long-lived gRPC connection to each remote node, which is shared by
+// all calls made to that node. Connections are kept alive between calls and re-established with
+// backoff by the gRPC library if they fail. Nodes with https:// URLs are called over TLS, and
+// only those with http:// URLs over insecure connections.
+type GrpcPool struct {
+	mu             sync.Mutex
+	peers          map[string]*grpcPeer // host -> connection
+	maxConcurrent  int
+	defaultTimeout time.Duration
+	tlsConfig      *tls.Config
+	dialOpts       []grpc.DialOption
+}
+
+type grpcPeer struct {
+	conn   *grpc.ClientConn
+	client chimera.ClientClient
+	slots  chan struct{} // Bounds the number of concurrent calls to the peer
+}
+
+// NewGrpcPool creates a new GrpcPool permitting maxConcurrent in-flight calls per peer. Calls
+// without a deadline are given the provided timeout.
+func NewGrpcPool(maxConcurrent int, timeout time.Duration, opts ...grpc.DialOption) *GrpcPool {
+	dialOpts := []grpc.DialOption{
+		grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                KeepaliveTime,
+			Timeout:             keepaliveTimeout,
+			PermitWithoutStream: true,
+		}),
+		grpc.WithBackoffMaxDelay(maxBackoffDelay),
+	}
+
+	return &GrpcPool{
+		peers:          make(map[string]*grpcPeer),
+		maxConcurrent:  maxConcurrent,
+		defaultTimeout: timeout,
+		tlsConfig:      &tls.Config{},
+		dialOpts:       append(dialOpts, opts...),
+	}
+}
+
+// SetTlsConfig sets the TLS configuration used to connect to nodes with https:// URLs, which by
+// default verifies them against the system's certificate authorities. Connections which are
+// already established are unaffected.
+func (p *GrpcPool) SetTlsConfig(config *tls.Config) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.tlsConfig = config
+}
+
+// MaxConcurrentCalls returns the number of in-flight calls the pool permits to each peer.
+func (p *GrpcPool) MaxConcurrentCalls() int {
+	return p.maxConcurrent
+}
+
+// Invoke calls f with a client for the node at rawUrl, waiting for a free call slot if the
+// maximum number of concurrent calls to the node are in progress.
+func (p *GrpcPool) Invoke(
+	ctx context.Context, rawUrl string, f func(context.Context, chimera.ClientClient) error) error {
+
+	peer, err := p.getPeer(rawUrl)
+	if err != nil {
+		grpcPoolMetrics.Add("failures", 1)
+		return err
+	}
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.defaultTimeout)
+		defer cancel()
+	}
+
+	select {
+	case peer.slots <- struct{}{}:
+	case <-ctx.Done():
+		grpcPoolMetrics.Add("timeouts", 1)
+		return fmt.Errorf("no call slot available for %s: %v", rawUrl, ctx.Err())
+	}
+	defer func() { <-peer.slots }()
+
+	grpcPoolMetrics.Add("calls", 1)
+	grpcPoolMetrics.Add("inflight", 1)
+	err = f(ctx, peer.client)
+	grpcPoolMetrics.Add("inflight", -1)
+	if err != nil {
+		grpcPoolMetrics.Add("failures", 1)
+	}
+	return err
+}
+
+func (p *GrpcPool) getPeer(rawUrl string) (*grpcPeer, error) {
+	peerUrl, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL %s: %v", rawUrl, err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if peer, ok := p.peers[peerUrl.Host]; ok {
+		return peer, nil
+	}
+
+	// Dial does not block, the connection is established in the background and calls wait
+	// for it until their deadline expires
+	creds := grpc.WithInsecure()
+	if peerUrl.Scheme != "http" {
+		creds = grpc.WithTransportCredentials(credentials.NewTLS(p.tlsConfig))
+	}
+	conn, err := grpc.Dial(peerUrl.Host, append([]grpc.DialOption{creds}, p.dialOpts...)...)
+	if err != nil {
+		return nil, fmt.Errorf("connection to gRPC server %s failed: %v", peerUrl.Host, err)
+	}
+	grpcPoolMetrics.Add("dials", 1)
+	log.WithField("host", peerUrl.Host).Debug("Created gRPC connection")
+
+	peer := &grpcPeer{
+		conn:   conn,
+		client: chimera.NewClientClient(conn),
+		slots:  make(chan struct{}, p.maxConcurrent),
+	}
+	p.peers[peerUrl.Host] = peer
+	return peer, nil
+}
+
+// Close closes all connections held by the pool.
+func (p *GrpcPool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var err error
+	for host, peer := range p.peers {
+		if closeErr := peer.conn.Close(); closeErr != nil {
+			err = closeErr
+		}
+		delete(p.peers, host)
+	}
+	return err
+}
@@ -0,0 +1,64 @@
+package api
+
+import (
+	"github.com/blk-io/chimera-api/chimera"
+	"golang.org/x/net/context"
+	"testing"
+	"time"
+)
+
+func TestGrpcPoolReusesConnections(t *testing.T) {
+	pool := NewGrpcPool(DefaultMaxConcurrentCalls, DefaultCallTimeout)
+	defer pool.Close()
+
+	var clients []chimera.ClientClient
+	for i := 0; i < 3; i++ {
+		err := pool.Invoke(context.Background(), "http://localhost:9001/",
+			func(ctx context.Context, cli chimera.ClientClient) error {
+				if _, ok := ctx.Deadline(); !ok {
+					t.Errorf("Call context has no deadline")
+				}
+				clients = append(clients, cli)
+				return nil
+			})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, cli := range clients[1:] {
+		if cli != clients[0] {
+			t.Errorf("A new client was created for the same peer")
+		}
+	}
+	if len(pool.peers) != 1 {
+		t.Errorf("Pool should contain a single peer, actual: %d", len(pool.peers))
+	}
+}
+
+func TestGrpcPoolBoundsConcurrentCalls(t *testing.T) {
+	pool := NewGrpcPool(1, DefaultCallTimeout)
+	defer pool.Close()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	go pool.Invoke(context.Background(), "http://localhost:9001/",
+		func(ctx context.Context, cli chimera.ClientClient) error {
+			close(started)
+			<-release
+			return nil
+		})
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := pool.Invoke(ctx, "http://localhost:9001/",
+		func(ctx context.Context, cli chimera.ClientClient) error {
+			t.Errorf("Call should not have been made while the peer was busy")
+			return nil
+		})
+	if err == nil {
+		t.Errorf("Call should have failed waiting for a free slot")
+	}
+	close(release)
+}
@@ -10,12 +10,10 @@ import (
 	"github.com/kevinburke/nacl"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/net/context"
-	"google.golang.org/grpc"
 	"io/ioutil"
 	"math/rand"
 	"net/http"
 	"net/http/httputil"
-	"net/url"
 	"time"
 )
 
@@ -29,6 +27,36 @@ type EncryptedPayload struct {
 	RecipientNonce nacl.Nonce
 }
 
+// PayloadDetails is a decrypted payload, along with the keys involved in it and its privacy
+// metadata.
+type PayloadDetails struct {
+	Payload     []byte
+	DecryptedBy []byte // The hosted key which decrypted the payload
+	Sender      []byte
+	Recipients  [][]byte // The recipients of a payload sent by this node
+	Privacy     PrivacyMetadata
+}
+
+// PrivacyMetadata is the enhanced privacy metadata of a payload, which is encoded alongside it
+// unless it is StandardPrivate and not sent to a privacy group.
+type PrivacyMetadata struct {
+	Mode              PrivacyMode
+	AffectedContracts []AffectedContract
+	ExecHash          []byte
+	// Recipients are the public keys of all participants in a PrivateStateValidation payload,
+	// including its sender.
+	Recipients [][]byte
+	// PrivacyGroupId is the privacy group the payload was sent to, if any.
+	PrivacyGroupId []byte
+}
+
+// AffectedContract is a contract transaction affected by a payload. Its security hash can only
+// be computed by participants in both, proving the payload was sent by one of them.
+type AffectedContract struct {
+	Digest       []byte
+	SecurityHash []byte
+}
+
 // PartyInfo is a struct that stores details of all enclave nodes (or parties) on the network.
 type PartyInfo struct {
 	url        string                        // URL identifying this node
@@ -36,6 +64,7 @@ type PartyInfo struct {
 	parties    map[string]bool               // Node (or party) URLs
 	client     utils.HttpClient
 	grpc       bool
+	pool       *GrpcPool // Connections to other nodes when using gRPC
 }
 
 // GetRecipient retrieves the URL associated with the provided recipient.
@@ -61,6 +90,7 @@ func InitPartyInfo(rawUrl string, otherNodes []string, client utils.HttpClient,
 		parties:    parties,
 		client:     client,
 		grpc:       grpc,
+		pool:       NewGrpcPool(DefaultMaxConcurrentCalls, DefaultCallTimeout),
 	}
 }
 
@@ -83,9 +113,15 @@ func CreatePartyInfo(
 		recipients: recipients,
 		parties:    parties,
 		client:     client,
+		pool:       NewGrpcPool(DefaultMaxConcurrentCalls, DefaultCallTimeout),
 	}
 }
 
+// GrpcPool returns the pool of gRPC connections to other nodes.
+func (s *PartyInfo) GrpcPool() *GrpcPool {
+	return s.pool
+}
+
 // RegisterPublicKeys associates the provided public keys with this node.
 func (s *PartyInfo) RegisterPublicKeys(pubKeys []nacl.Key) {
 	for _, pubKey := range pubKeys {
@@ -107,22 +143,15 @@ func (s *PartyInfo) GetPartyInfoGrpc() {
 		if rawUrl == s.url {
 			continue
 		}
-		var completeUrl url.URL
-		url, err := completeUrl.Parse(rawUrl)
-		conn, err := grpc.Dial(url.Host, grpc.WithInsecure())
-		if err != nil {
-			log.Errorf("Connection to gRPC server failed with error %s", err)
-			continue
-		}
-		defer conn.Close()
-		cli := chimera.NewClientClient(conn)
-		if cli == nil {
-			log.Errorf("Client is not intialised")
-			continue
-		}
 		party := chimera.PartyInfo{Url: rawUrl, Recipients: recipients, Parties: s.parties}
 
-		partyInfoResp, err := cli.UpdatePartyInfo(context.Background(), &party)
+		var partyInfoResp *chimera.PartyInfoResponse
+		err := s.pool.Invoke(context.Background(), rawUrl,
+			func(ctx context.Context, cli chimera.ClientClient) error {
+				var err error
+				partyInfoResp, err = cli.UpdatePartyInfo(ctx, &party)
+				return err
+			})
 		if err != nil {
 			log.Errorf("Error in updating party info %s", err)
 			continue
@@ -302,19 +331,9 @@ func (s *PartyInfo) UpdatePartyInfoGrpc(url string, recipients map[[nacl.KeySize
 	}
 }
 
-func PushGrpc(encoded []byte, path string, epl EncryptedPayload) error {
-	var completeUrl url.URL
-	url, err := completeUrl.Parse(path)
-	conn, err := grpc.Dial(url.Host, grpc.WithInsecure())
-	if err != nil {
-		log.Fatalf("Connection to gRPC server failed with error %s", err)
-	}
-	defer conn.Close()
-	cli := chimera.NewClientClient(conn)
-	if cli == nil {
-		log.Fatalf("Client is not intialised")
-	}
-
+// PushGrpc propagates the encrypted payload to the given remote node using a pooled gRPC
+// connection. The call is bounded by the deadline of ctx, or the pool's default timeout.
+func PushGrpc(ctx context.Context, pool *GrpcPool, encoded []byte, path string, epl EncryptedPayload) error {
 	var sender [32]byte
 	var nonce [32]byte
 	var recipientNonce [32]byte
@@ -330,7 +349,10 @@ func PushGrpc(encoded []byte, path string, epl EncryptedPayload) error {
 		ReciepientBoxes: epl.RecipientBoxes,
 	}
 	pushPayload := chimera.PushPayload{Ep: &encrypt, Encoded: encoded}
-	_, err = cli.Push(context.Background(), &pushPayload)
+	err := pool.Invoke(ctx, path, func(ctx context.Context, cli chimera.ClientClient) error {
+		_, err := cli.Push(ctx, &pushPayload)
+		return err
+	})
 	if err != nil {
 		log.Errorf("Push failed with %s", err)
 		return err
@@ -373,6 +395,48 @@ func Push(encoded []byte, url string, client utils.HttpClient) (string, error) {
 	return string(body), nil
 }
 
+// PushDelete asks the remote node at url to delete its copy of a payload.
+func PushDelete(deleteReq PushDeleteRequest, url string, client utils.HttpClient) error {
+	return postJson(deleteReq, url, "/pushdelete", client)
+}
+
+// PushPrivacyGroup distributes a privacy group to the remote node at url.
+func PushPrivacyGroup(groupReq PushPrivacyGroupRequest, url string, client utils.HttpClient) error {
+	return postJson(groupReq, url, "/pushprivacygroup", client)
+}
+
+// postJson posts value to path on the remote node at url, returning an error unless it succeeds.
+func postJson(value interface{}, url, path string, client utils.HttpClient) error {
+	endPoint, err := utils.BuildUrl(url, path)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", endPoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	logRequest(req)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var errResp ErrorResponse
+		json.NewDecoder(resp.Body).Decode(&errResp)
+		return fmt.Errorf("status %d received: %s", resp.StatusCode, errResp.Message)
+	}
+	return nil
+}
+
 func logRequest(r *http.Request) {
 	if log.GetLevel() == log.DebugLevel {
 		dump, err := httputil.DumpRequestOut(r, true)
@@ -14,6 +14,8 @@ const (
 	VerbosityShorthand = "v"
 	AlwaysSendTo       = "alwayssendto"
 	Storage            = "storage"
+	StoragePassword    = "storagepassword"
+	HashStorageKeys    = "hashstoragekeys"
 	WorkDir            = "workdir"
 	Url                = "url"
 	OtherNodes         = "othernodes"
@@ -21,9 +23,20 @@ const (
 	PrivateKeys        = "privatekeys"
 	Port               = "port"
 	Socket             = "socket"
+	Retention          = "retention"
+	RetentionInterval  = "retentioninterval"
+	RetentionDryRun    = "retentiondryrun"
+	Audit              = "audit"
 
 	GenerateKeys = "generate-keys"
 
+	// Flags of the storage command
+	From       = "from"
+	To         = "to"
+	BackupKey  = "backupkey"
+	Quarantine = "quarantine"
+	AuditHead  = "audithead"
+
 	BerkeleyDb       = "berkeleydb"
 	UseGRPC          = "grpc"
 	GrpcJsonPort     = "grpcport"
@@ -52,9 +65,34 @@ func InitFlags() {
 	flag.String(OtherNodes, "", "\"Boot nodes\" to connect to to discover the network")
 	flag.String(PublicKeys, "", "Public keys hosted by this node")
 	flag.String(PrivateKeys, "", "Private keys hosted by this node")
-	flag.String(Storage, "crux.db", "Database storage file name")
+	flag.String(Storage, "crux.db",
+		"Database storage URL, of the form [leveldb:|bolt:|sqlite:|bdb:|dir:]path or "+
+			"postgres://... (default type is leveldb)")
+	flag.String(StoragePassword, "",
+		"File containing the password used to encrypt the database storage, with any previous "+
+			"passwords on subsequent lines")
+	flag.Bool(HashStorageKeys, false,
+		"Also hash the keys of newly encrypted database storage, hiding its indexes at the cost "+
+			"of decrypting the whole storage on every index lookup, made by resends, retention "+
+			"and privacy group searches")
+	flag.String(Retention, "",
+		"Comma separated payload retention rules of the form [<public key>:]<limit>, where the "+
+			"limit is a maximum age, such as 720h, or a maximum number of payloads")
+	flag.String(RetentionInterval, "1h", "How often expired payloads are deleted")
+	flag.Bool(RetentionDryRun, false,
+		"Report the number of expired payloads without deleting them")
+	flag.Bool(Audit, false, "Record enclave operations in a tamper-evident audit log")
 	flag.Bool(BerkeleyDb, false,
 		"Use Berkeley DB for working with an existing Constellation data store [experimental]")
+	flag.String(From, "", "Storage URL to copy payloads from, used by the storage command")
+	flag.String(To, "", "Storage URL to migrate payloads to, used by the storage command")
+	flag.String(BackupKey, "",
+		"File containing the base64 encoded key used to encrypt backups, used by the storage command")
+	flag.Bool(Quarantine, false,
+		"Move payloads which fail the storage check aside, used by the storage command")
+	flag.String(AuditHead, "",
+		"Audit log head recorded by an earlier verification or export, of the form <seq>:<hash>, "+
+			"which the audit log must still contain, used by the storage command")
 
 	flag.Int(Verbosity, 1, "Verbosity level of logs (0=fatal, 1=warn, 2=info, 3=debug)")
 	flag.Int(VerbosityShorthand, 1, "Verbosity level of logs (shorthand)")
@@ -63,11 +101,9 @@ func InitFlags() {
 	flag.Bool(Tls, false, "Use TLS to secure HTTP communications")
 	flag.String(TlsServerCert, "", "The server certificate to be used")
 	flag.String(TlsServerKey, "", "The server private key")
-	flag.Int(GrpcJsonPort, -1, "The local port to listen on for JSON extensions of gRPC")
+	flag.Int(GrpcJsonPort, -1, "Deprecated, JSON extensions of gRPC are served on the local port")
 	flag.String(NetworkInterface, "localhost", "The network interface to bind the server to")
 
-	// storage not currently supported as we use LevelDB
-
 	pflag.CommandLine.AddGoFlagSet(flag.CommandLine)
 	viper.BindPFlags(pflag.CommandLine) // Binding the flags to test the initial configuration
 }
@@ -85,6 +121,11 @@ func ParseCommandLine() {
 	viper.BindPFlags(pflag.CommandLine)
 }
 
+// Args returns the command line arguments remaining after flags have been parsed.
+func Args() []string {
+	return pflag.Args()
+}
+
 // LoadConfig loads all configuration settings in the provided configPath location.
 func LoadConfig(configPath string) error {
 	viper.SetConfigType("hcl")
@@ -1,12 +1,18 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
 	"github.com/blk-io/crux/api"
 	"github.com/blk-io/crux/config"
 	"github.com/blk-io/crux/enclave"
 	"github.com/blk-io/crux/server"
 	"github.com/blk-io/crux/storage"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"path"
@@ -55,6 +61,15 @@ func main() {
 	}
 	log.SetLevel(level)
 
+	if args := config.Args(); len(args) > 0 && args[0] == storageCommand {
+		err := runStorageCommand(args[1:])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	keyFile := config.GetString(config.GenerateKeys)
 	if keyFile != "" {
 		err := enclave.DoKeyGeneration(keyFile)
@@ -66,22 +81,23 @@ func main() {
 	}
 
 	workDir := config.GetString(config.WorkDir)
-	dbStorage := config.GetString(config.Storage)
 	ipcFile := config.GetString(config.Socket)
-	storagePath := path.Join(workDir, dbStorage)
 	ipcPath := path.Join(workDir, ipcFile)
-	var db storage.DataStore
-	var err error
-	if config.GetBool(config.BerkeleyDb) {
-		db, err = storage.InitBerkeleyDb(storagePath)
-	} else {
-		db, err = storage.InitLevelDb(storagePath)
+	// Held while the node runs, so that the storage is not restored from under it
+	lock, err := storage.LockStore(storageUrl(), workDir)
+	if err != nil {
+		log.Fatalf("Unable to lock storage, error: %v", err)
 	}
+	defer lock.Close()
+	db, err := openStorage(storageUrl(), workDir)
 
 	if err != nil {
 		log.Fatalf("Unable to initialise storage, error: %v", err)
 	}
 	defer db.Close()
+	if err = enclave.EnsureIndexes(context.Background(), db); err != nil {
+		log.Fatalf("Unable to index storage, error: %v", err)
+	}
 
 	allOtherNodes := config.GetString(config.OtherNodes)
 	otherNodes := strings.Split(allOtherNodes, ",")
@@ -99,32 +115,39 @@ func main() {
 	grpc := config.GetBool(config.UseGRPC)
 
 	pi := api.InitPartyInfo(url, otherNodes, httpClient, grpc)
-
-	privKeys := config.GetString(config.PrivateKeys)
-	pubKeys := config.GetString(config.PublicKeys)
-	pubKeyFiles := strings.Split(pubKeys, ",")
-	privKeyFiles := strings.Split(privKeys, ",")
-
-	if len(privKeyFiles) != len(pubKeyFiles) {
-		log.Fatalln("Private keys provided must have corresponding public keys")
-	}
-
-	if len(privKeyFiles) == 0 {
-		log.Fatalln("Node key files must be provided")
-	}
-
-	for i, keyFile := range privKeyFiles {
-		privKeyFiles[i] = path.Join(workDir, keyFile)
+	clientTls, err := clientTlsConfig(workDir)
+	if err != nil {
+		log.Fatalln(err)
 	}
+	pi.GrpcPool().SetTlsConfig(clientTls)
 
-	for i, keyFile := range pubKeyFiles {
-		pubKeyFiles[i] = path.Join(workDir, keyFile)
+	pubKeyFiles, privKeyFiles, err := keyFiles(workDir)
+	if err != nil {
+		log.Fatalln(err)
 	}
 
 	enc := enclave.Init(db, pubKeyFiles, privKeyFiles, pi, http.DefaultClient, grpc)
 
 	pi.RegisterPublicKeys(enc.PubKeys)
 
+	retentionRules, err := enclave.ParseRetentionRules(config.GetString(config.Retention))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if len(retentionRules) > 0 {
+		interval, err := time.ParseDuration(config.GetString(config.RetentionInterval))
+		if err != nil || interval <= 0 {
+			log.Fatalf("Invalid retention interval: %s", config.GetString(config.RetentionInterval))
+		}
+		enc.StartCollector(retentionRules, interval, config.GetBool(config.RetentionDryRun))
+	}
+
+	if config.GetBool(config.Audit) {
+		if err = enc.EnableAudit(context.Background()); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
 	tls := config.GetBool(config.Tls)
 	var tlsCertFile, tlsKeyFile string
 	if tls {
@@ -138,9 +161,12 @@ func main() {
 		tlsCertFile = path.Join(workDir, servCert)
 		tlsKeyFile = path.Join(workDir, servKey)
 	}
-	grpcJsonport := config.GetInt(config.GrpcJsonPort)
+	if config.GetInt(config.GrpcJsonPort) != -1 {
+		log.Warnf("--%s is deprecated, the JSON API is now served on --%s",
+			config.GrpcJsonPort, config.Port)
+	}
 	networkInterface := config.GetString(config.NetworkInterface)
-	_, err = server.Init(enc, networkInterface, port, ipcPath, grpc, grpcJsonport, tls, tlsCertFile, tlsKeyFile)
+	_, err = server.Init(enc, networkInterface, port, ipcPath, grpc, tls, tlsCertFile, tlsKeyFile)
 	if err != nil {
 		log.Fatalf("Error starting server: %v\n", err)
 	}
@@ -150,6 +176,77 @@ func main() {
 	select {}
 }
 
+// keyFiles returns the paths of the configured public and private key files.
+func keyFiles(workDir string) ([]string, []string, error) {
+	privKeys := config.GetString(config.PrivateKeys)
+	pubKeys := config.GetString(config.PublicKeys)
+	pubKeyFiles := strings.Split(pubKeys, ",")
+	privKeyFiles := strings.Split(privKeys, ",")
+
+	if len(privKeyFiles) != len(pubKeyFiles) {
+		return nil, nil, errors.New("Private keys provided must have corresponding public keys")
+	}
+
+	if len(privKeyFiles) == 0 {
+		return nil, nil, errors.New("Node key files must be provided")
+	}
+
+	for i, keyFile := range privKeyFiles {
+		privKeyFiles[i] = path.Join(workDir, keyFile)
+	}
+
+	for i, keyFile := range pubKeyFiles {
+		pubKeyFiles[i] = path.Join(workDir, keyFile)
+	}
+	return pubKeyFiles, privKeyFiles, nil
+}
+
+// clientTlsConfig returns the TLS configuration used to call other nodes with https:// URLs over
+// gRPC, from the configured client certificate and server trust settings. Servers are verified
+// against the system's certificate authorities and those in the server chain.
+func clientTlsConfig(workDir string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+
+	certFile := config.GetString(config.TlsClientCert)
+	keyFile := config.GetString(config.TlsClientKey)
+	if certFile != "" && keyFile != "" {
+		certFile, keyFile = path.Join(workDir, certFile), path.Join(workDir, keyFile)
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load TLS client certificate %s and key %s: %s",
+				certFile, keyFile, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if chain := config.GetStringSlice(config.TlsServerChain); len(chain) > 0 {
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		for _, file := range chain {
+			pem, err := ioutil.ReadFile(path.Join(workDir, file))
+			if err != nil {
+				return nil, err
+			}
+			if !roots.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in TLS server chain file %s", file)
+			}
+		}
+		tlsConfig.RootCAs = roots
+	}
+
+	switch trust := config.GetString(config.TlsServerTrust); trust {
+	case "", "ca":
+	case "insecure-no-validation":
+		tlsConfig.InsecureSkipVerify = true
+	default:
+		log.Warnf("TLS server trust mode %s is not supported, "+
+			"servers are verified by their certificate authority", trust)
+	}
+	return tlsConfig, nil
+}
+
 func exit() {
 	config.Usage()
 	os.Exit(1)
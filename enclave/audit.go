@@ -0,0 +1,238 @@
+package enclave
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/blk-io/crux/api"
+	"github.com/blk-io/crux/storage"
+	"github.com/blk-io/crux/utils"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The audit log is a sequence of JSON encoded api.AuditEntry records, keyed by their big endian
+// sequence number. The sequence number and hash of the last entry are kept in the head record,
+// so that truncation of the log is also detected.
+var (
+	auditPrefix  = append(append([]byte{}, storage.ReservedPrefix...), "audit/"...)
+	auditHeadKey = append(append([]byte{}, storage.ReservedPrefix...), "audithead"...)
+)
+
+// AuditHead identifies the last entry in the audit log.
+//
+// Anyone able to write to the storage can replace the whole log with one which verifies, so
+// operators record the head off-node, and pass it to VerifyAudit to check that the log has not
+// been rewritten since.
+type AuditHead struct {
+	Seq  uint64 `json:"seq"`
+	Hash string `json:"hash"`
+}
+
+// String returns the head in the form <seq>:<hash> accepted by ParseAuditHead.
+func (h AuditHead) String() string {
+	return fmt.Sprintf("%d:%s", h.Seq, h.Hash)
+}
+
+// ParseAuditHead parses a head of the form <seq>:<hash>.
+func ParseAuditHead(head string) (AuditHead, error) {
+	parts := strings.SplitN(head, ":", 2)
+	if len(parts) != 2 {
+		return AuditHead{}, fmt.Errorf("invalid audit head %s, expected <seq>:<hash>", head)
+	}
+	seq, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil || seq == 0 {
+		return AuditHead{}, fmt.Errorf("invalid audit head sequence number %s", parts[0])
+	}
+	return AuditHead{Seq: seq, Hash: parts[1]}, nil
+}
+
+// auditLog appends entries to the audit log in a DataStore.
+type auditLog struct {
+	db   storage.DataStore
+	mu   sync.Mutex
+	head AuditHead
+}
+
+func auditKey(seq uint64) []byte {
+	encoded := make([]byte, 8)
+	binary.BigEndian.PutUint64(encoded, seq)
+	return indexKey(auditPrefix, encoded, nil)
+}
+
+// hashAuditEntry returns the hash of entry, ignoring its Hash.
+func hashAuditEntry(entry api.AuditEntry) (string, error) {
+	entry.Hash = ""
+	encoded, err := json.Marshal(entry)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(utils.Sha3Hash(encoded)), nil
+}
+
+// readAuditHead reads the head of the audit log in db, which is empty if the log is.
+func readAuditHead(ctx context.Context, db storage.DataStore) (AuditHead, error) {
+	var head AuditHead
+	encoded, err := db.Read(ctx, auditHeadKey)
+	if err == storage.ErrNotFound {
+		return head, nil
+	} else if err != nil {
+		return head, err
+	}
+	err = json.Unmarshal(encoded, &head)
+	return head, err
+}
+
+// append completes entry and appends it to the log.
+func (l *auditLog) append(ctx context.Context, entry *api.AuditEntry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entry.Seq = l.head.Seq + 1
+	entry.Time = time.Now().UTC()
+	entry.Prev = l.head.Hash
+	hash, err := hashAuditEntry(*entry)
+	if err != nil {
+		return err
+	}
+	entry.Hash = hash
+
+	head := AuditHead{Seq: entry.Seq, Hash: entry.Hash}
+	encodedEntry, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	encodedHead, err := json.Marshal(head)
+	if err != nil {
+		return err
+	}
+	batch := new(storage.Batch)
+	batch.Put(auditKey(entry.Seq), encodedEntry)
+	batch.Put(auditHeadKey, encodedHead)
+	if err = l.db.WriteBatch(ctx, batch); err != nil {
+		return err
+	}
+	l.head = head
+	return nil
+}
+
+// EnableAudit records the operations subsequently passed to Audit in the audit log of the
+// SecureEnclave's store.
+func (s *SecureEnclave) EnableAudit(ctx context.Context) error {
+	head, err := readAuditHead(ctx, s.Db)
+	if err != nil {
+		return fmt.Errorf("unable to read the audit log: %v", err)
+	}
+	s.audit = &auditLog{db: s.Db, head: head}
+	log.WithField("head", head.String()).Info("Audit log enabled")
+	return nil
+}
+
+// Audit appends entry to the audit log, if it is enabled, completing its sequence number, time
+// and hashes.
+func (s *SecureEnclave) Audit(entry *api.AuditEntry) {
+	if s.audit == nil {
+		return
+	}
+	if err := s.audit.append(context.Background(), entry); err != nil {
+		log.WithField("operation", entry.Operation).Errorf("Unable to write audit log: %v", err)
+	}
+}
+
+// VerifyAudit checks that each entry in the audit log of db is intact and follows the previous
+// entry, up to the head of the log, which is returned. If a head recorded earlier is given, the
+// log must still contain it.
+func VerifyAudit(
+	ctx context.Context, db storage.DataStore, recorded *AuditHead) (AuditHead, error) {
+
+	expected, err := readAuditHead(ctx, db)
+	if err != nil {
+		return expected, fmt.Errorf("unable to read the head of the audit log: %v", err)
+	}
+
+	// Entries are read by sequence number, as stores with hashed keys are not ordered
+	var head AuditHead
+	for seq := uint64(1); seq <= expected.Seq; seq++ {
+		entry, err := readAuditEntry(ctx, db, seq)
+		if err != nil {
+			return head, err
+		}
+		if entry.Seq != seq {
+			return head, fmt.Errorf("audit entry %d has been moved", seq)
+		}
+		if entry.Prev != head.Hash {
+			return head, fmt.Errorf("audit entry %d does not follow entry %d", seq, head.Seq)
+		}
+		hash, err := hashAuditEntry(*entry)
+		if err != nil {
+			return head, err
+		}
+		if hash != entry.Hash {
+			return head, fmt.Errorf("audit entry %d has been modified", seq)
+		}
+		if recorded != nil && recorded.Seq == seq && recorded.Hash != entry.Hash {
+			return head, fmt.Errorf(
+				"audit log has been rewritten, entry %d is not the recorded head", seq)
+		}
+		head = AuditHead{Seq: entry.Seq, Hash: entry.Hash}
+	}
+	if recorded != nil && recorded.Seq > expected.Seq {
+		return head, fmt.Errorf("audit log has been truncated before the recorded head, entry %d",
+			recorded.Seq)
+	}
+	if head != expected {
+		return head, fmt.Errorf("audit log does not end with its head")
+	}
+	if _, err = db.Read(ctx, auditKey(head.Seq+1)); err != storage.ErrNotFound {
+		return head, fmt.Errorf("audit log continues after its head, entry %d", head.Seq)
+	}
+	return head, nil
+}
+
+// readAuditEntry reads the audit entry with the given sequence number from db.
+func readAuditEntry(
+	ctx context.Context, db storage.DataStore, seq uint64) (*api.AuditEntry, error) {
+
+	encoded, err := db.Read(ctx, auditKey(seq))
+	if err == storage.ErrNotFound {
+		return nil, fmt.Errorf("audit entry %d is missing", seq)
+	} else if err != nil {
+		return nil, err
+	}
+	var entry api.AuditEntry
+	if err = json.Unmarshal(encoded, &entry); err != nil {
+		return nil, fmt.Errorf("audit entry %d cannot be decoded: %v", seq, err)
+	}
+	return &entry, nil
+}
+
+// ExportAudit writes the entries of the audit log of db to w as JSON lines, returning the head of
+// the entries written.
+func ExportAudit(ctx context.Context, db storage.DataStore, w io.Writer) (AuditHead, error) {
+	var head AuditHead
+	expected, err := readAuditHead(ctx, db)
+	if err != nil {
+		return head, err
+	}
+	for seq := uint64(1); seq <= expected.Seq; seq++ {
+		entry, err := readAuditEntry(ctx, db, seq)
+		if err != nil {
+			return head, err
+		}
+		encoded, err := json.Marshal(entry)
+		if err != nil {
+			return head, err
+		}
+		if _, err = w.Write(append(encoded, '\n')); err != nil {
+			return head, err
+		}
+		head = AuditHead{Seq: entry.Seq, Hash: entry.Hash}
+	}
+	return head, nil
+}
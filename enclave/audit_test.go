@@ -0,0 +1,195 @@
+package enclave
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/blk-io/crux/api"
+	"github.com/blk-io/crux/storage"
+	"golang.org/x/net/context"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestAudit(t *testing.T) {
+	dbPath, err := ioutil.TempDir("", "TestAudit")
+	if err != nil {
+		t.Fatal(err)
+	} else {
+		defer os.RemoveAll(dbPath)
+	}
+	ctx := context.Background()
+
+	enc, rcpt1 := initIndexedEnclave(t, dbPath)
+
+	// Nothing is recorded until the audit log is enabled
+	enc.Audit(&api.AuditEntry{Operation: api.AuditStore})
+	if err = enc.EnableAudit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, operation := range []string{api.AuditStore, api.AuditRetrieve, api.AuditDelete} {
+		enc.Audit(&api.AuditEntry{
+			Operation: operation,
+			Caller:    "127.0.0.1:9000",
+			Keys:      []string{api.KeyFingerprint(rcpt1)},
+		})
+	}
+
+	// Entries are appended to the existing log when it is enabled again
+	if err = enc.EnableAudit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	enc.Audit(&api.AuditEntry{Operation: api.AuditErase, Error: api.NotFound})
+
+	head, err := VerifyAudit(ctx, enc.Db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head.Seq != 4 {
+		t.Errorf("Expected 4 audit entries, actual: %d", head.Seq)
+	}
+
+	var exported bytes.Buffer
+	exportedHead, err := ExportAudit(ctx, enc.Db, &exported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := bytes.Split(bytes.TrimSpace(exported.Bytes()), []byte("\n"))
+	if exportedHead != head || len(lines) != 4 {
+		t.Fatalf("Expected 4 exported entries ending with %v, actual: %v, %d lines",
+			head, exportedHead, len(lines))
+	}
+	var last api.AuditEntry
+	if err = json.Unmarshal(lines[3], &last); err != nil {
+		t.Fatal(err)
+	}
+	if last.Operation != api.AuditErase || last.Error != api.NotFound || last.Hash != head.Hash {
+		t.Errorf("Unexpected last audit entry: %+v", last)
+	}
+
+	tamper := func(name string, f func()) {
+		original, err := enc.Db.Read(ctx, auditKey(2))
+		if err != nil {
+			t.Fatal(err)
+		}
+		originalHead, err := enc.Db.Read(ctx, auditHeadKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f()
+		if _, err = VerifyAudit(ctx, enc.Db, nil); err == nil {
+			t.Errorf("Audit log with %s should fail verification", name)
+		}
+
+		if err = enc.Db.Write(ctx, auditKey(2), original); err != nil {
+			t.Fatal(err)
+		}
+		if err = enc.Db.Write(ctx, auditHeadKey, originalHead); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = VerifyAudit(ctx, enc.Db, nil); err != nil {
+			t.Fatalf("Restored audit log should pass verification: %v", err)
+		}
+	}
+
+	tamper("a modified entry", func() {
+		modified := bytes.Replace(lines[1], []byte(api.AuditRetrieve), []byte(api.AuditResend), 1)
+		if err := enc.Db.Write(ctx, auditKey(2), modified); err != nil {
+			t.Fatal(err)
+		}
+	})
+	tamper("a deleted entry", func() {
+		if err := enc.Db.Delete(ctx, auditKey(2)); err != nil {
+			t.Fatal(err)
+		}
+	})
+	tamper("a rehashed entry", func() {
+		var entry api.AuditEntry
+		if err := json.Unmarshal(lines[1], &entry); err != nil {
+			t.Fatal(err)
+		}
+		entry.Caller = "ipc"
+		entry.Hash, _ = hashAuditEntry(entry)
+		encoded, _ := json.Marshal(entry)
+		if err := enc.Db.Write(ctx, auditKey(2), encoded); err != nil {
+			t.Fatal(err)
+		}
+	})
+	tamper("a truncated head", func() {
+		var entry api.AuditEntry
+		if err := json.Unmarshal(lines[2], &entry); err != nil {
+			t.Fatal(err)
+		}
+		encoded, _ := json.Marshal(AuditHead{Seq: entry.Seq, Hash: entry.Hash})
+		if err := enc.Db.Write(ctx, auditHeadKey, encoded); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestAuditRecordedHead(t *testing.T) {
+	dbPath, err := ioutil.TempDir("", "TestAuditRecordedHead")
+	if err != nil {
+		t.Fatal(err)
+	} else {
+		defer os.RemoveAll(dbPath)
+	}
+	ctx := context.Background()
+
+	enc, _ := initIndexedEnclave(t, dbPath)
+	if err = enc.EnableAudit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	record := func(entries int) AuditHead {
+		for i := 0; i < entries; i++ {
+			enc.Audit(&api.AuditEntry{Operation: api.AuditStore, Caller: "ipc"})
+		}
+		head, err := VerifyAudit(ctx, enc.Db, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return head
+	}
+	recorded := record(3)
+
+	parsed, err := ParseAuditHead(recorded.String())
+	if err != nil || parsed != recorded {
+		t.Fatalf("Parsing %s returned %v, %v", recorded, parsed, err)
+	}
+	for _, invalid := range []string{"", "3", "0:abc", "x:abc"} {
+		if _, err = ParseAuditHead(invalid); err == nil {
+			t.Errorf("Parsing audit head %q should fail", invalid)
+		}
+	}
+
+	// The log may grow beyond the recorded head
+	record(2)
+	if _, err = VerifyAudit(ctx, enc.Db, &recorded); err != nil {
+		t.Errorf("Extended audit log should pass verification: %v", err)
+	}
+
+	// Replacing the whole log is only detected against the recorded head
+	rewrite := func(entries int) {
+		batch := new(storage.Batch)
+		for seq := uint64(1); seq <= 5; seq++ {
+			batch.Delete(auditKey(seq))
+		}
+		batch.Delete(auditHeadKey)
+		if err := enc.Db.WriteBatch(ctx, batch); err != nil {
+			t.Fatal(err)
+		}
+		if err := enc.EnableAudit(ctx); err != nil {
+			t.Fatal(err)
+		}
+		record(entries)
+	}
+	rewrite(4)
+	if _, err = VerifyAudit(ctx, enc.Db, &recorded); err == nil {
+		t.Error("Rewritten audit log should fail verification against the recorded head")
+	}
+	rewrite(2)
+	if _, err = VerifyAudit(ctx, enc.Db, &recorded); err == nil {
+		t.Error("Truncated audit log should fail verification against the recorded head")
+	}
+}
@@ -0,0 +1,168 @@
+package enclave
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/blk-io/crux/api"
+	"github.com/blk-io/crux/storage"
+	"github.com/blk-io/crux/utils"
+	"github.com/kevinburke/nacl"
+	"github.com/kevinburke/nacl/box"
+	"github.com/kevinburke/nacl/secretbox"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+)
+
+// Problems found with stored payloads by CheckPayload.
+var (
+	ErrMalformedPayload = errors.New("payload cannot be decoded")
+	ErrDigestMismatch   = errors.New("key does not match the digest of the payload ciphertext")
+	ErrNoHostedKey      = errors.New("no recipient box can be opened with a hosted key")
+	ErrCorruptPayload   = errors.New("payload secret box cannot be opened with its master key")
+)
+
+// CheckProblems lists the problems found by CheckPayload, in the order they are checked.
+var CheckProblems = []error{
+	ErrMalformedPayload, ErrDigestMismatch, ErrNoHostedKey, ErrCorruptPayload,
+}
+
+// quarantinePrefix prefixes the keys of payloads which have been moved aside by Check.
+var quarantinePrefix = append(append([]byte{}, storage.ReservedPrefix...), "quarantine/"...)
+
+// CheckReport is the result of checking the payloads in a store.
+type CheckReport struct {
+	Checked     int
+	Problems    map[error][][]byte // The digests of the payloads with each of the CheckProblems
+	Quarantined int
+}
+
+// CheckPayload checks that a stored payload can be decoded, that digest is the hash of its
+// ciphertext, and that it can be decrypted with one of the SecureEnclave's keys. It returns nil
+// or one of the CheckProblems.
+func (s *SecureEnclave) CheckPayload(digest, encoded []byte) error {
+	epl, recipients, err := api.ParsePayloadWithRecipients(encoded)
+	if err != nil {
+		log.WithField("digest", fmt.Sprintf("%x", digest)).Debugf("%v", err)
+		return ErrMalformedPayload
+	}
+	if !bytes.Equal(utils.Sha3Hash(epl.CipherText), digest) {
+		return ErrDigestMismatch
+	}
+
+	masterKey, ok := s.openMasterKey(epl, recipients)
+	if !ok {
+		return ErrNoHostedKey
+	}
+	if _, ok = secretbox.Open(nil, epl.CipherText, epl.Nonce, masterKey); !ok {
+		return ErrCorruptPayload
+	}
+	return nil
+}
+
+// openMasterKey tries to open each of the recipient boxes of a payload with the hosted keys.
+func (s *SecureEnclave) openMasterKey(
+	epl api.EncryptedPayload, recipients [][]byte) (nacl.Key, bool) {
+
+	if len(recipients) == 0 {
+		masterKey, _, ok := s.openPushedBox(epl, s.PubKeys)
+		return masterKey, ok
+	}
+
+	// The key cache is not used, as keys decoded from payloads would never be found in it
+	masterKey := new([nacl.KeySize]byte)
+
+	// A payload which originated with us has a box for each recipient, sealed by the sender
+	senderPrivKey, err := s.resolvePrivateKey(epl.Sender)
+	if err != nil || len(epl.RecipientBoxes) != len(recipients) {
+		return nil, false
+	}
+	for i, recipient := range recipients {
+		recipientKey, err := utils.ToKey(recipient)
+		if err != nil {
+			continue
+		}
+		sharedKey := box.Precompute(recipientKey, senderPrivKey)
+		_, ok := secretbox.Open(masterKey[:0], epl.RecipientBoxes[i], epl.RecipientNonce, sharedKey)
+		if ok {
+			return masterKey, true
+		}
+	}
+	return nil, false
+}
+
+// openPushedBox tries to open the box of a payload pushed to us by another node, which has a
+// single box for one of our keys, with each of the given hosted keys in turn. The master key is
+// returned along with the hosted key which opened it.
+func (s *SecureEnclave) openPushedBox(
+	epl api.EncryptedPayload, hostedKeys []nacl.Key) (nacl.Key, nacl.Key, bool) {
+
+	if len(epl.RecipientBoxes) != 1 {
+		return nil, nil, false
+	}
+	// The key cache is not used, as keys decoded from payloads would never be found in it
+	masterKey := new([nacl.KeySize]byte)
+	for _, pubKey := range hostedKeys {
+		privKey, err := s.resolvePrivateKey(pubKey)
+		if err != nil {
+			continue
+		}
+		sharedKey := box.Precompute(epl.Sender, privKey)
+		_, ok := secretbox.Open(masterKey[:0], epl.RecipientBoxes[0], epl.RecipientNonce, sharedKey)
+		if ok {
+			return masterKey, pubKey, true
+		}
+	}
+	return nil, nil, false
+}
+
+// Check checks every payload in the SecureEnclave's store with CheckPayload. If quarantine is
+// true, payloads with problems are moved aside, so that they are no longer retrieved or resent.
+func (s *SecureEnclave) Check(ctx context.Context, quarantine bool) (CheckReport, error) {
+	report := CheckReport{Problems: make(map[error][][]byte)}
+	var bad [][]byte
+
+	err := s.Db.Iterate(ctx, storage.All, func(key, value []byte) error {
+		if storage.IsReserved(key) {
+			return nil
+		}
+		report.Checked++
+		if problem := s.CheckPayload(key, value); problem != nil {
+			digest := append([]byte{}, key...)
+			report.Problems[problem] = append(report.Problems[problem], digest)
+			bad = append(bad, digest)
+		}
+		return nil
+	})
+	if err != nil || !quarantine {
+		return report, err
+	}
+
+	for _, digest := range bad {
+		if err = s.quarantinePayload(ctx, digest); err != nil {
+			return report, err
+		}
+		report.Quarantined++
+	}
+	return report, nil
+}
+
+// quarantinePayload moves a payload and its index entries aside, keeping it under the
+// quarantine prefix for later inspection.
+func (s *SecureEnclave) quarantinePayload(ctx context.Context, digest []byte) error {
+	encoded, err := s.Db.Read(ctx, digest)
+	if err == storage.ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	batch := new(storage.Batch)
+	batch.Put(indexKey(quarantinePrefix, digest, nil), encoded)
+	batch.Delete(digest)
+	batch.Delete(metadataKey(digest))
+	if err = unindexPayload(ctx, s.Db, batch, digest, encoded); err != nil {
+		return err
+	}
+	return s.Db.WriteBatch(ctx, batch)
+}
@@ -0,0 +1,128 @@
+package enclave
+
+import (
+	"bytes"
+	"github.com/blk-io/crux/api"
+	"github.com/blk-io/crux/storage"
+	"github.com/blk-io/crux/utils"
+	"github.com/kevinburke/nacl"
+	"golang.org/x/net/context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	dbPath, err := ioutil.TempDir("", "TestCheck")
+	if err != nil {
+		t.Fatal(err)
+	} else {
+		defer os.RemoveAll(dbPath)
+	}
+	ctx := context.Background()
+
+	enc, rcpt1 := initIndexedEnclave(t, dbPath)
+
+	// A second enclave, hosting rcpt1, which sends payloads to enc
+	db2, err := storage.InitLevelDb(path.Join(dbPath, "db2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mockClient := &MockClient{}
+	pi := api.CreatePartyInfo(
+		"http://localhost:8001", []string{"http://localhost:8000"}, []nacl.Key{enc.PubKeys[0]},
+		mockClient)
+	enc2 := Init(db2, []string{"testdata/rcpt1.pub"}, []string{"testdata/rcpt1"}, pi,
+		mockClient, false)
+	key := enc.PubKeys[0][:]
+
+	// Valid payloads sent to another node, to ourselves, and pushed to us
+	sentDigest, err := enc.Store(&message, []byte{}, [][]byte{rcpt1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = enc.Store(&message, []byte{}, [][]byte{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = enc2.Store(&message, []byte{}, [][]byte{key}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = enc.StorePayload(mockClient.requests[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	sent, err := enc.Db.Read(ctx, sentDigest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	epl, recipients := api.DecodePayloadWithRecipients(sent)
+	corrupt := epl
+	corrupt.CipherText = append([]byte{}, epl.CipherText...)
+	corrupt.CipherText[0] ^= 1
+
+	// A payload sent by rcpt1, which we do not host
+	message2 := []byte("Another message")
+	notHostedDigest, err := enc2.Store(&message2, []byte{}, [][]byte{key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	notHosted, err := db2.Read(ctx, notHostedDigest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[error][]byte{
+		ErrMalformedPayload: []byte("malformed"),
+		ErrDigestMismatch:   []byte("mismatch"),
+		ErrNoHostedKey:      notHostedDigest,
+		ErrCorruptPayload:   utils.Sha3Hash(corrupt.CipherText),
+	}
+	batch := new(storage.Batch)
+	batch.Put(expected[ErrMalformedPayload], sent[:len(sent)-1])
+	batch.Put(expected[ErrDigestMismatch], sent)
+	batch.Put(expected[ErrNoHostedKey], notHosted)
+	batch.Put(expected[ErrCorruptPayload], api.EncodePayloadWithRecipients(corrupt, recipients))
+	if err = enc.Db.WriteBatch(ctx, batch); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := enc.Check(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Checked != 7 || report.Quarantined != 0 {
+		t.Errorf("Expected 7 payloads checked and none quarantined, actual: %+v", report)
+	}
+	for _, problem := range CheckProblems {
+		digests := report.Problems[problem]
+		if len(digests) != 1 || !bytes.Equal(digests[0], expected[problem]) {
+			t.Errorf("Expected %q for %x, actual: %x", problem, expected[problem], digests)
+		}
+	}
+
+	report, err = enc.Check(ctx, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Quarantined != 4 {
+		t.Errorf("Expected 4 payloads to be quarantined, actual: %d", report.Quarantined)
+	}
+	for _, digest := range expected {
+		if _, err := enc.Db.Read(ctx, digest); err != storage.ErrNotFound {
+			t.Errorf("Quarantined payload %x should not be found, read returned %v", digest, err)
+		}
+		if _, err := enc.Db.Read(ctx, indexKey(quarantinePrefix, digest, nil)); err != nil {
+			t.Errorf("Quarantined payload %x should be kept, read returned %v", digest, err)
+		}
+	}
+	checkIndexed(t, enc.Db, indexKey(recipientIndexPrefix, rcpt1, nil), sentDigest, true)
+
+	report, err = enc.Check(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Checked != 3 || len(report.Problems) != 0 {
+		t.Errorf("Expected 3 payloads checked without problems, actual: %+v", report)
+	}
+}
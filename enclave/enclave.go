@@ -7,7 +7,6 @@ import (
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"github.com/blk-io/crux/api"
 	"github.com/blk-io/crux/storage"
@@ -16,9 +15,12 @@ import (
 	"github.com/kevinburke/nacl/box"
 	"github.com/kevinburke/nacl/secretbox"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"io"
 	"io/ioutil"
 	"path/filepath"
 	"strings"
+	"sync"
 )
 
 // SecureEnclave is the secure transaction enclave.
@@ -31,6 +33,8 @@ type SecureEnclave struct {
 	keyCache   map[nacl.Key]map[nacl.Key]nacl.Key // Maps sender -> recipient -> shared key
 	client     utils.HttpClient                   // The underlying HTTP client used to propagate requests
 	grpc       bool
+	metadataMu sync.Mutex // Serialises updates of payload metadata
+	audit      *auditLog  // The audit log, if it is enabled
 }
 
 // Init creates a new instance of the SecureEnclave.
@@ -108,36 +112,76 @@ func Init(
 func (s *SecureEnclave) Store(
 	message *[]byte, sender []byte, recipients [][]byte) ([]byte, error) {
 
-	var err error
-	var senderPubKey, senderPrivKey nacl.Key
+	return s.StoreWithPrivacy(message, sender, recipients, api.PrivacyMetadata{})
+}
+
+// StoreWithPrivacy stores and distributes a payload like Store, along with the enhanced privacy
+// metadata of its transaction. The security hashes of the contract transactions it affects, and
+// for PrivateStateValidation its participants, are filled in by the SecureEnclave. If a privacy
+// group is given, the payload is sent to its other members in place of recipients.
+func (s *SecureEnclave) StoreWithPrivacy(
+	message *[]byte, sender []byte, recipients [][]byte,
+	privacy api.PrivacyMetadata) ([]byte, error) {
+
+	senderPubKey, senderPrivKey, err := s.resolveSender(sender)
+	if err != nil {
+		return nil, err
+	}
+	recipients, err = s.resolveRecipients(senderPubKey, recipients, privacy)
+	if err != nil {
+		return nil, err
+	}
+
+	epl, masterKey := createEncryptedPayload(message, senderPubKey)
+	return s.store(epl, masterKey, senderPubKey, senderPrivKey, recipients, privacy)
+}
 
+// resolveSender resolves the key pair of sender, which must be hosted by this node, or our
+// default key pair if no sender is given.
+func (s *SecureEnclave) resolveSender(sender []byte) (nacl.Key, nacl.Key, error) {
 	if len(sender) == 0 {
 		// from address is either default or specified on communication
-		senderPubKey = s.PubKeys[0]
-		senderPrivKey = s.PrivKeys[0]
-	} else {
-		senderPubKey, err = utils.ToKey(sender)
-		if err != nil {
-			log.WithField("senderPubKey", sender).Errorf(
-				"Unable to load sender public key, %v", err)
-			return nil, err
-		}
+		return s.PubKeys[0], s.PrivKeys[0], nil
+	}
 
-		senderPrivKey, err = s.resolvePrivateKey(senderPubKey)
-		if err != nil {
-			log.WithField("senderPubKey", sender).Errorf(
-				"Unable to locate private key for sender public key, %v", err)
-			return nil, err
-		}
+	senderPubKey, err := utils.ToKey(sender)
+	if err != nil {
+		log.WithField("senderPubKey", sender).Errorf(
+			"Unable to load sender public key, %v", err)
+		return nil, nil, api.FieldError("from", err, "invalid sender public key")
 	}
 
-	return s.store(message, senderPubKey, senderPrivKey, recipients)
+	senderPrivKey, err := s.resolvePrivateKey(senderPubKey)
+	if err != nil {
+		log.WithField("senderPubKey", sender).Errorf(
+			"Unable to locate private key for sender public key, %v", err)
+		return nil, nil, api.WrapError(
+			api.Unauthorized, err, "sender public key is not hosted by this node")
+	}
+	return senderPubKey, senderPrivKey, nil
+}
+
+// resolveRecipients returns the recipients of a payload, which are the other members of its
+// privacy group if it has one.
+func (s *SecureEnclave) resolveRecipients(
+	senderPubKey nacl.Key, recipients [][]byte, privacy api.PrivacyMetadata) ([][]byte, error) {
+
+	if len(privacy.PrivacyGroupId) == 0 {
+		return recipients, nil
+	}
+	if len(recipients) > 0 {
+		return nil, api.FieldError(
+			"to", nil, "recipients cannot be given along with a privacy group")
+	}
+	return s.groupRecipients(privacy.PrivacyGroupId, senderPubKey)
 }
 
+// store seals the masterKey of epl for each of its recipients, then stores and distributes it.
 func (s *SecureEnclave) store(
-	message *[]byte,
-	senderPubKey, senderPrivKey nacl.Key,
-	recipients [][]byte) ([]byte, error) {
+	epl api.EncryptedPayload,
+	masterKey, senderPubKey, senderPrivKey nacl.Key,
+	recipients [][]byte,
+	privacy api.PrivacyMetadata) ([]byte, error) {
 
 	var toSelf bool
 	if len(recipients) == 0 {
@@ -146,8 +190,20 @@ func (s *SecureEnclave) store(
 	} else {
 		toSelf = false
 	}
+	var deliverTo [][]byte
+	if !toSelf {
+		deliverTo = recipients
+	}
 
-	epl, masterKey := createEncryptedPayload(message, senderPubKey, recipients)
+	epl.RecipientBoxes = make([][]byte, len(recipients))
+	participants := [][]byte{(*senderPubKey)[:]}
+	if !toSelf {
+		participants = append(participants, recipients...)
+	}
+	privacy, err := s.sentPrivacy(privacy, participants, masterKey)
+	if err != nil {
+		return nil, err
+	}
 
 	for i, recipient := range recipients {
 
@@ -171,8 +227,9 @@ func (s *SecureEnclave) store(
 		epl.RecipientBoxes[i] = sealedBox
 	}
 
-	encodedEpl := api.EncodePayloadWithRecipients(epl, recipients)
-	digest, err := s.storePayload(epl, encodedEpl)
+	encodedEpl := api.EncodePayloadWithPrivacy(epl, recipients, privacy)
+	digest, err := s.storePayload(
+		epl, recipients, encodedEpl, newMetadata(encodedEpl, api.LocalOrigin, deliverTo))
 
 	if !toSelf {
 		for i, recipient := range recipients {
@@ -188,15 +245,18 @@ func (s *SecureEnclave) store(
 				"recipient": hex.EncodeToString(recipient), "digest": hex.EncodeToString(digest),
 			}).Debug("Publishing payload")
 
-			s.publishPayload(recipientEpl, recipient)
+			s.recordDelivery(
+				digest, recipient, s.publishPayload(recipientEpl, recipient, privacy))
 		}
 	}
 
 	return digest, err
 }
 
+// createEncryptedPayload encrypts message with a new master key, which is returned for sealing
+// to the recipients of the payload.
 func createEncryptedPayload(
-	message *[]byte, senderPubKey nacl.Key, recipients [][]byte) (api.EncryptedPayload, nacl.Key) {
+	message *[]byte, senderPubKey nacl.Key) (api.EncryptedPayload, nacl.Key) {
 
 	nonce := nacl.NewNonce()
 	masterKey := nacl.NewKey()
@@ -208,29 +268,33 @@ func createEncryptedPayload(
 		Sender:         senderPubKey,
 		CipherText:     sealedMessage,
 		Nonce:          nonce,
-		RecipientBoxes: make([][]byte, len(recipients)),
 		RecipientNonce: recipientNonce,
 	}, masterKey
 }
 
-func (s *SecureEnclave) publishPayload(epl api.EncryptedPayload, recipient []byte) {
+// publishPayload pushes epl and its privacy metadata to the node hosting recipient, returning an
+// error if it was not delivered.
+func (s *SecureEnclave) publishPayload(
+	epl api.EncryptedPayload, recipient []byte, privacy api.PrivacyMetadata) error {
 
 	key, err := utils.ToKey(recipient)
 	if err != nil {
 		log.WithField("recipient", recipient).Errorf(
 			"Unable to decode key for recipient, error: %v", err)
+		return err
 	}
 
 	if url, ok := s.PartyInfo.GetRecipient(key); ok {
-		encoded := api.EncodePayloadWithRecipients(epl, [][]byte{})
+		encoded := api.EncodePayloadWithPrivacy(epl, [][]byte{}, privacy)
 		if s.grpc {
-			api.PushGrpc(encoded, url, epl)
+			err = api.PushGrpc(context.Background(), s.PartyInfo.GrpcPool(), encoded, url, epl)
 		} else {
-			api.Push(encoded, url, s.client)
+			_, err = api.Push(encoded, url, s.client)
 		}
-	} else {
-		log.WithField("recipientKey", hex.EncodeToString(recipient)).Error("Unable to resolve host")
+		return err
 	}
+	log.WithField("recipientKey", hex.EncodeToString(recipient)).Error("Unable to resolve host")
+	return fmt.Errorf("unable to resolve host")
 }
 
 func (s *SecureEnclave) resolveSharedKey(
@@ -266,18 +330,112 @@ func (s *SecureEnclave) resolvePrivateKey(publicKey nacl.Key) (nacl.Key, error)
 // transaction. I.e. it is not the original recipient of the transaction, but one of the recipients
 // it is intended for.
 func (s *SecureEnclave) StorePayload(encoded []byte) ([]byte, error) {
-	epl, _ := api.DecodePayloadWithRecipients(encoded)
-	return s.storePayload(epl, encoded)
+	epl, recipients, err := api.ParsePayloadWithRecipients(encoded)
+	if err != nil {
+		return nil, api.WrapError(api.InvalidArgument, err, "unable to decode payload")
+	}
+	encoded, err = s.checkPushedPrivacy(epl, recipients, encoded)
+	if err != nil {
+		return nil, err
+	}
+	return s.storePayload(epl, recipients, encoded, s.pushedMetadata(epl, encoded))
 }
 
+// StorePayloadGrpc stores a payload pushed to us over gRPC, which carries both the payload and
+// its encoding. The encoding is what is stored, so it must be of the same payload.
 func (s *SecureEnclave) StorePayloadGrpc(epl api.EncryptedPayload, encoded []byte) ([]byte, error) {
-	return s.storePayload(epl, encoded)
+	encodedEpl, _, err := api.ParsePayloadWithRecipients(encoded)
+	if err != nil {
+		return nil, api.WrapError(api.InvalidArgument, err, "unable to decode payload")
+	}
+	if !bytes.Equal(utils.Sha3Hash(encodedEpl.CipherText), utils.Sha3Hash(epl.CipherText)) {
+		return nil, api.NewError(api.InvalidArgument, "encoded payload does not match the payload")
+	}
+	epl = encodedEpl
+	// Payloads pushed to us never specify their recipients
+	encoded, err = s.checkPushedPrivacy(epl, nil, encoded)
+	if err != nil {
+		return nil, err
+	}
+	return s.storePayload(epl, nil, encoded, s.pushedMetadata(epl, encoded))
+}
+
+// pushedMetadata creates the metadata of a payload pushed to us, whose origin is the node
+// hosting its sender.
+func (s *SecureEnclave) pushedMetadata(
+	epl api.EncryptedPayload, encoded []byte) *api.PayloadMetadata {
+
+	origin := api.UnknownOrigin
+	if epl.Sender != nil {
+		if url, ok := s.PartyInfo.GetRecipient(epl.Sender); ok {
+			origin = url
+		}
+	}
+	meta := newMetadata(encoded, origin, nil)
+	if len(s.PubKeys) > 1 {
+		// Record which of our keys it was sent to, so that it can be retrieved without one
+		if _, hostedKey, ok := s.openPushedBox(epl, s.PubKeys); ok {
+			meta.Recipient = base64.StdEncoding.EncodeToString((*hostedKey)[:])
+		}
+	}
+	return meta
 }
 
-func (s *SecureEnclave) storePayload(epl api.EncryptedPayload, encoded []byte) ([]byte, error) {
+// storePayload writes the encoded payload, its metadata and its index entries to the store,
+// unless it has been erased.
+func (s *SecureEnclave) storePayload(
+	epl api.EncryptedPayload, recipients [][]byte, encoded []byte,
+	meta *api.PayloadMetadata) ([]byte, error) {
+
+	ctx := context.Background()
 	digestHash := utils.Sha3Hash(epl.CipherText)
-	err := s.Db.Write(&digestHash, &encoded)
-	return digestHash, err
+	if err := checkTombstone(ctx, s.Db, digestHash, (*epl.Sender)[:]); err != nil {
+		return digestHash, err
+	}
+	// A payload which is resent or pushed again keeps the time it was first received, so that
+	// its time index entry is replaced rather than duplicated
+	received, err := readReceived(ctx, s.Db, digestHash)
+	if err == nil {
+		meta.Received = received
+	} else if err != storage.ErrNotFound {
+		return digestHash, api.WrapError(api.Internal, err, "unable to read payload index")
+	}
+	meta.Key = base64.StdEncoding.EncodeToString(digestHash)
+	batch := new(storage.Batch)
+	// The index entries of a previous encoding of the payload, such as one sent to us with other
+	// recipients, are replaced by those of this one
+	previous, err := s.Db.Read(ctx, digestHash)
+	if err == nil {
+		err = unindexPayload(ctx, s.Db, batch, digestHash, previous)
+	} else if err == storage.ErrNotFound {
+		err = nil
+	}
+	if err != nil {
+		return digestHash, api.WrapError(api.Internal, err, "unable to read payload")
+	}
+	batch.Put(digestHash, encoded)
+	indexPayload(batch, digestHash, epl, recipients, meta.Received)
+	err = putMetadata(batch, digestHash, meta)
+
+	if err == nil {
+		err = s.Db.WriteBatch(ctx, batch)
+	}
+	if err != nil {
+		return digestHash, api.WrapError(api.Internal, err, "unable to store payload")
+	}
+	return digestHash, nil
+}
+
+// readPayload reads the encoded payload with the given digestHash from the store.
+func (s *SecureEnclave) readPayload(digestHash *[]byte) (*[]byte, error) {
+	encoded, err := s.Db.Read(context.Background(), *digestHash)
+	if err == storage.ErrNotFound {
+		return nil, api.NewError(api.NotFound,
+			"payload %s not found", base64.StdEncoding.EncodeToString(*digestHash))
+	} else if err != nil {
+		return nil, api.WrapError(api.Internal, err, "unable to read payload")
+	}
+	return &encoded, nil
 }
 
 func sealPayload(
@@ -292,73 +450,135 @@ func sealPayload(
 		sharedKey)
 }
 
-// RetrieveDefault is used to retrieve the provided payload. It attempts to use a default key
-// value of the first public key associated with this SecureEnclave instance.
+// RetrieveDefault is used to retrieve the provided payload with whichever of the public keys
+// associated with this SecureEnclave instance it was sent to.
 // If the payload cannot be found, or decrypted successfully an error is returned.
 func (s *SecureEnclave) RetrieveDefault(digestHash *[]byte) ([]byte, error) {
-	// to address is either default or specified on communication
-	key := (*s.PubKeys[0])[:]
-	return s.Retrieve(digestHash, &key)
+	return s.Retrieve(digestHash, nil)
 }
 
-// Retrieve is used to retrieve the provided payload.
+// Retrieve is used to retrieve the provided payload, sent to the hosted key to, or any hosted key
+// if to is nil or empty.
 // If the payload cannot be found, or decrypted successfully an error is returned.
 func (s *SecureEnclave) Retrieve(digestHash *[]byte, to *[]byte) ([]byte, error) {
+	payload, _, _, err := s.retrieve(digestHash, to)
+	return payload, err
+}
 
-	encoded, err := s.Db.Read(digestHash)
+// RetrieveDetails retrieves a payload like Retrieve, along with the hosted key which decrypted it,
+// its sender, the recipients of a payload sent by this node and its privacy metadata.
+func (s *SecureEnclave) RetrieveDetails(digestHash, to []byte) (*api.PayloadDetails, error) {
+	payload, decryptedBy, encoded, err := s.retrieve(&digestHash, &to)
 	if err != nil {
 		return nil, err
 	}
+	epl, recipients, privacy, err := api.ParsePayloadWithPrivacy(encoded)
+	if err != nil {
+		return nil, api.WrapError(api.Internal, err, "unable to decode payload")
+	}
 
-	epl, recipients := api.DecodePayloadWithRecipients(*encoded)
+	details := &api.PayloadDetails{
+		Payload:     payload,
+		DecryptedBy: (*decryptedBy)[:],
+		Sender:      (*epl.Sender)[:],
+		Privacy:     privacy,
+	}
+	for _, recipient := range recipients {
+		// Payloads sent to no one are sealed for our ephemeral key
+		if !bytes.Equal(recipient, (*s.selfPubKey)[:]) {
+			details.Recipients = append(details.Recipients, recipient)
+		}
+	}
+	return details, nil
+}
 
-	masterKey := new([nacl.KeySize]byte)
+// retrieve decrypts the payload with digestHash, returning it with the hosted key which decrypted
+// it and the encoded payload.
+func (s *SecureEnclave) retrieve(
+	digestHash *[]byte, to *[]byte) ([]byte, nacl.Key, []byte, error) {
+
+	encoded, err := s.readPayload(digestHash)
+	if err != nil {
+		return nil, nil, nil, err
+	}
 
-	var senderPubKey, senderPrivKey, recipientPubKey, sharedKey nacl.Key
+	epl, recipients := api.DecodePayloadWithRecipients(*encoded)
 
+	var masterKey, hostedKey nacl.Key
+	var ok bool
 	if len(recipients) == 0 {
 		// This is a payload originally sent to us by another node
-		recipientPubKey = epl.Sender
-		senderPubKey, err = utils.ToKey(*to)
+		hostedKeys, err := s.candidateKeys(*digestHash, to)
 		if err != nil {
-			return nil, err
+			return nil, nil, nil, err
 		}
+		masterKey, hostedKey, ok = s.openPushedBox(epl, hostedKeys)
 	} else {
 		// This is a payload that originated from us
-		senderPubKey = epl.Sender
+		hostedKey = epl.Sender
+		var senderPrivKey, recipientPubKey nacl.Key
 		recipientPubKey, err = utils.ToKey(recipients[0])
 		if err != nil {
-			return nil, err
+			return nil, nil, nil, api.WrapError(
+				api.Internal, err, "invalid recipient stored with payload")
+		}
+		senderPrivKey, err = s.resolvePrivateKey(hostedKey)
+		if err != nil {
+			return nil, nil, nil, api.WrapError(api.NotFound, err, "not a recipient of the payload")
 		}
-	}
 
-	senderPrivKey, err = s.resolvePrivateKey(senderPubKey)
-	if err != nil {
-		return nil, err
+		// we might not have the key in our cache if constellation was restarted, hence we may
+		// need to recreate
+		sharedKey := s.resolveSharedKey(senderPrivKey, hostedKey, recipientPubKey)
+		masterKey = new([nacl.KeySize]byte)
+		_, ok = secretbox.Open(masterKey[:0], epl.RecipientBoxes[0], epl.RecipientNonce, sharedKey)
 	}
-
-	// we might not have the key in our cache if constellation was restarted, hence we may
-	// need to recreate
-	sharedKey = s.resolveSharedKey(senderPrivKey, senderPubKey, recipientPubKey)
-
-	_, ok := secretbox.Open(masterKey[:0], epl.RecipientBoxes[0], epl.RecipientNonce, sharedKey)
 	if !ok {
-		return nil, errors.New("unable to open master key secret box")
+		return nil, nil, nil, api.NewError(api.NotFound, "not a recipient of the payload")
 	}
 
 	var payload []byte
 	payload, ok = secretbox.Open(payload[:0], epl.CipherText, epl.Nonce, masterKey)
 	if !ok {
-		return payload, errors.New("unable to open payload secret box")
+		return payload, nil, nil, api.NewError(api.Internal, "unable to open payload secret box")
 	}
 
-	return payload, nil
+	return payload, hostedKey, *encoded, nil
+}
+
+// candidateKeys returns the hosted keys to try to open a payload pushed to us with, which is to
+// if given, otherwise the key recorded in its metadata followed by every hosted key.
+func (s *SecureEnclave) candidateKeys(digestHash []byte, to *[]byte) ([]nacl.Key, error) {
+	if to != nil && len(*to) > 0 {
+		toKey, err := utils.ToKey(*to)
+		if err != nil {
+			return nil, api.FieldError("to", err, "invalid recipient public key")
+		}
+		return []nacl.Key{toKey}, nil
+	}
+
+	meta, err := readMetadata(context.Background(), s.Db, digestHash)
+	if err != nil || meta.Recipient == "" {
+		return s.PubKeys, nil
+	}
+	recipient, err := base64.StdEncoding.DecodeString(meta.Recipient)
+	if err != nil {
+		return s.PubKeys, nil
+	}
+	for i, pubKey := range s.PubKeys {
+		if bytes.Equal(recipient, (*pubKey)[:]) {
+			keys := []nacl.Key{pubKey}
+			keys = append(keys, s.PubKeys[:i]...)
+			return append(keys, s.PubKeys[i+1:]...), nil
+		}
+	}
+	return s.PubKeys, nil
 }
 
 // RetrieveFor retrieves a payload with the given digestHash for a specific recipient who was one
 // of the original recipients specified on the payload.
 func (s *SecureEnclave) RetrieveFor(digestHash *[]byte, reqRecipient *[]byte) (*[]byte, error) {
-	encoded, err := s.Db.Read(digestHash)
+	encoded, err := s.readPayload(digestHash)
 	if err != nil {
 		return nil, err
 	}
@@ -378,16 +598,35 @@ func (s *SecureEnclave) RetrieveFor(digestHash *[]byte, reqRecipient *[]byte) (*
 			return &encoded, nil
 		}
 	}
-	return nil, fmt.Errorf("invalid recipient %x requested for payload", reqRecipient)
+	return nil, api.NewError(api.NotFound, "invalid recipient %x requested for payload", *reqRecipient)
 }
 
 // RetrieveAllFor retrieves all payloads that the specified recipient was an original recipient
 // for.
-// Each payload found is published to the specified recipient.
+// Each payload found is published to the specified recipient, in the background.
 func (s *SecureEnclave) RetrieveAllFor(reqRecipient *[]byte) error {
-	return s.Db.ReadAll(func(key, value *[]byte) {
-		epl, recipients := api.DecodePayloadWithRecipients(*value)
+	ctx := context.Background()
+	digests, err := indexedDigests(ctx, s.Db, indexKey(recipientIndexPrefix, *reqRecipient, nil))
+	if err != nil {
+		return api.WrapError(api.Internal, err, "unable to read payload index")
+	}
 
+	var resends []resend
+	for _, digest := range digests {
+		encoded, err := s.readPayload(&digest)
+		if api.CodeOf(err) == api.NotFound {
+			// Deleted since the index was read
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		epl, recipients, privacy, err := api.ParsePayloadWithPrivacy(*encoded)
+		if err != nil {
+			log.WithField("digest", hex.EncodeToString(digest)).Errorf(
+				"Unable to decode payload, %v", err)
+			continue
+		}
 		for i, recipient := range recipients {
 			if bytes.Equal(*reqRecipient, recipient) {
 				recipientEpl := api.EncryptedPayload{
@@ -397,17 +636,78 @@ func (s *SecureEnclave) RetrieveAllFor(reqRecipient *[]byte) error {
 					RecipientBoxes: [][]byte{epl.RecipientBoxes[i]},
 					RecipientNonce: epl.RecipientNonce,
 				}
-				func() {
-					go s.publishPayload(recipientEpl, *reqRecipient)
-				}()
+				resends = append(resends, resend{digest, recipientEpl, privacy})
 			}
 		}
-	})
+	}
+
+	go s.publishAll(resends, *reqRecipient)
+	return nil
+}
+
+// A resend is a payload to be published to one of its recipients.
+type resend struct {
+	digest  []byte
+	epl     api.EncryptedPayload
+	privacy api.PrivacyMetadata
 }
 
-// Delete deletes the payload associated with the given digestHash from the SecureEnclave's store.
+// publishAll publishes each of resends to recipient. As many payloads are published at once as
+// the gRPC pool permits calls to a node, so that they do not wait for a call slot until their
+// call times out.
+func (s *SecureEnclave) publishAll(resends []resend, recipient []byte) {
+	concurrency := api.DefaultMaxConcurrentCalls
+	if pool := s.PartyInfo.GrpcPool(); s.grpc && pool != nil {
+		concurrency = pool.MaxConcurrentCalls()
+	}
+
+	slots := make(chan struct{}, concurrency)
+	for _, r := range resends {
+		slots <- struct{}{}
+		go func(r resend) {
+			defer func() { <-slots }()
+			err := s.publishPayload(r.epl, recipient, r.privacy)
+			s.recordDelivery(r.digest, recipient, err)
+		}(r)
+	}
+}
+
+// Delete deletes the payload associated with the given digestHash, its metadata and its index
+// entries, from the SecureEnclave's store.
 func (s *SecureEnclave) Delete(digestHash *[]byte) error {
-	return s.Db.Delete(digestHash)
+	ctx := context.Background()
+	batch := new(storage.Batch)
+	_, err := deletePayload(ctx, s.Db, batch, *digestHash)
+	if err == nil && batch.Len() > 0 {
+		err = s.Db.WriteBatch(ctx, batch)
+	}
+	if err != nil {
+		return api.WrapError(api.Internal, err, "unable to delete payload")
+	}
+	return nil
+}
+
+// deletePayload adds the deletion of the payload with digest, its metadata and its index entries
+// to batch, returning the size of the payload, or -1 if it does not exist.
+func deletePayload(
+	ctx context.Context, db storage.DataStore, batch *storage.Batch, digest []byte) (int, error) {
+
+	encoded, err := db.Read(ctx, digest)
+	if err == storage.ErrNotFound {
+		return -1, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	batch.Delete(digest)
+	batch.Delete(metadataKey(digest))
+	return len(encoded), unindexPayload(ctx, db, batch, digest, encoded)
+}
+
+// Backup writes an unencrypted backup of the SecureEnclave's store to w, returning the number of
+// records written.
+func (s *SecureEnclave) Backup(ctx context.Context, w io.Writer) (int, error) {
+	return storage.WriteBackup(ctx, s.Db, w, nil)
 }
 
 // UpdatePartyInfo applies the provided binary encoded party details to the SecureEnclave's
@@ -2,14 +2,17 @@ package enclave
 
 import (
 	"bytes"
+	"encoding/base64"
 	"github.com/blk-io/crux/api"
 	"github.com/blk-io/crux/storage"
 	"github.com/blk-io/crux/utils"
 	"github.com/kevinburke/nacl"
+	"golang.org/x/net/context"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"path"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -33,7 +36,7 @@ func (c *MockClient) Do(req *http.Request) (*http.Response, error) {
 	c.serviceMu.Unlock()
 
 	respBody := ioutil.NopCloser(bytes.NewReader([]byte("")))
-	return &http.Response{Body: respBody}, nil
+	return &http.Response{StatusCode: http.StatusOK, Body: respBody}, nil
 }
 
 func (c *MockClient) reqCount() int {
@@ -450,3 +453,283 @@ func TestDoKeyGeneration(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestRetrieveNotFound(t *testing.T) {
+	dbPath, err := ioutil.TempDir("", "TestRetrieveNotFound")
+	if err != nil {
+		t.Fatal(err)
+	} else {
+		defer os.RemoveAll(dbPath)
+	}
+
+	enc := initDefaultEnclave(t, dbPath)
+
+	digest := utils.Sha3Hash(message)
+	_, err = enc.RetrieveDefault(&digest)
+	if api.CodeOf(err) != api.NotFound {
+		t.Errorf("Retrieving an unknown payload should fail with %s, actual: %v",
+			api.NotFound, err)
+	}
+}
+
+// slowClient is a MockClient which takes a while to respond, recording the most requests it
+// has had in flight at once.
+type slowClient struct {
+	MockClient
+	mu          sync.Mutex
+	inFlight    int
+	maxInFlight int
+}
+
+func (c *slowClient) Do(req *http.Request) (*http.Response, error) {
+	c.mu.Lock()
+	c.inFlight++
+	if c.inFlight > c.maxInFlight {
+		c.maxInFlight = c.inFlight
+	}
+	c.mu.Unlock()
+	time.Sleep(5 * time.Millisecond)
+	c.mu.Lock()
+	c.inFlight--
+	c.mu.Unlock()
+	return c.MockClient.Do(req)
+}
+
+func TestRetrieveAllForConcurrency(t *testing.T) {
+	dbPath, err := ioutil.TempDir("", "TestRetrieveAllForConcurrency")
+	if err != nil {
+		t.Fatal(err)
+	} else {
+		defer os.RemoveAll(dbPath)
+	}
+
+	pubKeys, err := loadPubKeys([]string{"testdata/rcpt1.pub"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rcpt1 := (*pubKeys[0])[:]
+	client := &slowClient{}
+	pi := api.CreatePartyInfo(
+		"http://localhost:8000", []string{"http://localhost:8001"}, pubKeys, client)
+	enc := initEnclave(t, dbPath, pi, client)
+
+	count := api.DefaultMaxConcurrentCalls + 8
+	for i := 0; i < count; i++ {
+		_, err = enc.Store(&message, []byte{}, [][]byte{rcpt1})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = enc.RetrieveAllFor(&rcpt1); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for client.reqCount() < 2*count {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d payloads to be resent, actual: %d", count, client.reqCount()-count)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.maxInFlight > api.DefaultMaxConcurrentCalls {
+		t.Errorf("Expected at most %d payloads to be resent at once, actual: %d",
+			api.DefaultMaxConcurrentCalls, client.maxInFlight)
+	}
+}
+
+func TestStoreMalformedPayload(t *testing.T) {
+	dbPath, err := ioutil.TempDir("", "TestStoreMalformedPayload")
+	if err != nil {
+		t.Fatal(err)
+	} else {
+		defer os.RemoveAll(dbPath)
+	}
+
+	enc := initDefaultEnclave(t, dbPath)
+
+	epl, _ := createEncryptedPayload(&message, enc.PubKeys[0])
+	encoded := api.EncodePayloadWithRecipients(epl, [][]byte{})
+	for _, malformed := range [][]byte{nil, encoded[:len(encoded)-1], []byte("malformed")} {
+		_, err = enc.StorePayload(malformed)
+		if api.CodeOf(err) != api.InvalidArgument {
+			t.Errorf("Storing a malformed payload should fail with %s, actual: %v",
+				api.InvalidArgument, err)
+		}
+	}
+}
+
+func TestStoreMismatchedPayloadGrpc(t *testing.T) {
+	dbPath, err := ioutil.TempDir("", "TestStoreMismatchedPayloadGrpc")
+	if err != nil {
+		t.Fatal(err)
+	} else {
+		defer os.RemoveAll(dbPath)
+	}
+
+	enc := initDefaultEnclave(t, dbPath)
+
+	epl, _ := createEncryptedPayload(&message, enc.PubKeys[0])
+	other, _ := createEncryptedPayload(&message, enc.PubKeys[0])
+	encoded := api.EncodePayloadWithRecipients(other, [][]byte{})
+	_, err = enc.StorePayloadGrpc(epl, encoded)
+	if api.CodeOf(err) != api.InvalidArgument {
+		t.Errorf("Storing a payload with the encoding of another should fail with %s, actual: %v",
+			api.InvalidArgument, err)
+	}
+	_, err = enc.StorePayloadGrpc(epl, []byte("malformed"))
+	if api.CodeOf(err) != api.InvalidArgument {
+		t.Errorf("Storing a malformed payload should fail with %s, actual: %v",
+			api.InvalidArgument, err)
+	}
+	digest := utils.Sha3Hash(other.CipherText)
+	if _, err = enc.Db.Read(context.Background(), digest); err != storage.ErrNotFound {
+		t.Errorf("Mismatched payload should not be stored, actual: %v", err)
+	}
+}
+
+func TestRetrieveDetails(t *testing.T) {
+	dbPath, err := ioutil.TempDir("", "TestRetrieveDetails")
+	if err != nil {
+		t.Fatal(err)
+	} else {
+		defer os.RemoveAll(dbPath)
+	}
+
+	enc, rcpt1 := initIndexedEnclave(t, dbPath)
+	mockClient := enc.client.(*MockClient)
+	sender := (*enc.PubKeys[0])[:]
+
+	// A second enclave, hosting rcpt1
+	db2, err := storage.InitLevelDb(path.Join(dbPath, "db2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pi := api.CreatePartyInfo(
+		"http://localhost:8001", []string{"http://localhost:8000"}, []nacl.Key{enc.PubKeys[0]},
+		&MockClient{})
+	enc2 := Init(db2, []string{"testdata/rcpt1.pub"}, []string{"testdata/rcpt1"}, pi,
+		&MockClient{}, false)
+
+	privacy := api.PrivacyMetadata{Mode: api.PartyProtection}
+	digest, err := enc.StoreWithPrivacy(&message, sender, [][]byte{rcpt1}, privacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = enc2.StorePayload(mockClient.requests[0]); err != nil {
+		t.Fatal(err)
+	}
+	selfDigest, err := enc.Store(&message, sender, [][]byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		enc                 *SecureEnclave
+		digest, to          []byte
+		decryptedBy, sender []byte
+		recipients          [][]byte
+	}{
+		{enc, digest, nil, sender, sender, [][]byte{rcpt1}},
+		{enc2, digest, rcpt1, rcpt1, sender, nil},
+		{enc, selfDigest, nil, sender, sender, nil},
+	}
+	for i, test := range tests {
+		details, err := test.enc.RetrieveDetails(test.digest, test.to)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(details.Payload, message) ||
+			!bytes.Equal(details.DecryptedBy, test.decryptedBy) ||
+			!bytes.Equal(details.Sender, test.sender) ||
+			len(details.Recipients) != len(test.recipients) {
+			t.Errorf("Unexpected details of payload %d: %+v", i, details)
+			continue
+		}
+		for j, recipient := range test.recipients {
+			if !bytes.Equal(details.Recipients[j], recipient) {
+				t.Errorf("Unexpected recipients of payload %d: %v", i, details.Recipients)
+			}
+		}
+	}
+
+	details, err := enc2.RetrieveDetails(digest, rcpt1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if details.Privacy.Mode != api.PartyProtection {
+		t.Errorf("Expected the privacy metadata of the payload, actual: %+v", details.Privacy)
+	}
+	if _, err = enc2.RetrieveDetails(digest, sender); api.CodeOf(err) != api.NotFound {
+		t.Errorf("Retrieving details for another recipient should fail, actual: %v", err)
+	}
+}
+
+func TestRetrieveAnyHostedKey(t *testing.T) {
+	dbPath, err := ioutil.TempDir("", "TestRetrieveAnyHostedKey")
+	if err != nil {
+		t.Fatal(err)
+	} else {
+		defer os.RemoveAll(dbPath)
+	}
+
+	enc, rcpt1 := initIndexedEnclave(t, dbPath)
+	mockClient := enc.client.(*MockClient)
+	sender := (*enc.PubKeys[0])[:]
+
+	// A second enclave, hosting rcpt1 after another key
+	db2, err := storage.InitLevelDb(path.Join(dbPath, "db2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pi := api.CreatePartyInfo(
+		"http://localhost:8001", []string{"http://localhost:8000"}, []nacl.Key{enc.PubKeys[0]},
+		&MockClient{})
+	enc2 := Init(db2, []string{"testdata/key.pub", "testdata/rcpt1.pub"},
+		[]string{"testdata/key", "testdata/rcpt1"}, pi, &MockClient{}, false)
+
+	digest, err := enc.Store(&message, sender, [][]byte{rcpt1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = enc2.StorePayload(mockClient.requests[0]); err != nil {
+		t.Fatal(err)
+	}
+	meta, err := enc2.Metadata(digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Recipient != base64.StdEncoding.EncodeToString(rcpt1) {
+		t.Errorf("Expected metadata to record rcpt1 as the recipient, actual: %+v", meta)
+	}
+
+	retrieve := func() {
+		returned, err := enc2.RetrieveDefault(&digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(returned, message) {
+			t.Errorf("Retrieved %v, expected %v", returned, message)
+		}
+		details, err := enc2.RetrieveDetails(digest, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(details.DecryptedBy, rcpt1) {
+			t.Errorf("Expected rcpt1 to decrypt the payload, actual: %x", details.DecryptedBy)
+		}
+	}
+	retrieve()
+
+	// Without metadata, every hosted key is tried
+	if err = enc2.Db.Delete(context.Background(), metadataKey(digest)); err != nil {
+		t.Fatal(err)
+	}
+	retrieve()
+
+	_, err = enc2.Retrieve(&digest, &sender)
+	if api.CodeOf(err) != api.NotFound || !strings.Contains(err.Error(), "not a recipient") {
+		t.Errorf("Retrieving for another hosted key should not be a recipient, actual: %v", err)
+	}
+}
@@ -0,0 +1,173 @@
+package enclave
+
+import (
+	"bytes"
+	"encoding/base64"
+	"github.com/blk-io/crux/api"
+	"github.com/blk-io/crux/storage"
+	"github.com/blk-io/crux/utils"
+	"github.com/kevinburke/nacl"
+	"github.com/kevinburke/nacl/box"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"time"
+)
+
+// Erased payloads leave a tombstone for their sender, whose value is the time they were erased,
+// so that they are not stored again if they are pushed or resent to us.
+var tombstonePrefix = append(append([]byte{}, storage.ReservedPrefix...), "tomb/"...)
+
+func tombstoneKey(digest, sender []byte) []byte {
+	return indexKey(tombstonePrefix, digest, sender)
+}
+
+// checkTombstone returns a Deleted error if the payload with digest from sender has been erased.
+func checkTombstone(ctx context.Context, db storage.DataStore, digest, sender []byte) error {
+	_, err := db.Read(ctx, tombstoneKey(digest, sender))
+	if err == nil {
+		return api.NewError(
+			api.Deleted, "payload %s has been erased", base64.StdEncoding.EncodeToString(digest))
+	} else if err != storage.ErrNotFound {
+		return api.WrapError(api.Internal, err, "unable to read payload tombstone")
+	}
+	return nil
+}
+
+// erasePayload deletes the payload with digest, its metadata and its index entries, leaving a
+// tombstone for payloads from sender.
+func (s *SecureEnclave) erasePayload(ctx context.Context, digest, sender []byte) error {
+	batch := new(storage.Batch)
+	_, err := deletePayload(ctx, s.Db, batch, digest)
+	if err == nil {
+		batch.Put(tombstoneKey(digest, sender), encodeTime(time.Now()))
+		err = s.Db.WriteBatch(ctx, batch)
+	}
+	if err != nil {
+		return api.WrapError(api.Internal, err, "unable to erase payload")
+	}
+	return nil
+}
+
+// Erase deletes a payload sent by one of the SecureEnclave's keys, and asks the node hosting each
+// of its recipients to delete its copy, proving that the request comes from the sender. The
+// payload is tombstoned, so it is never stored again. The status of each recipient is returned,
+// which is Acknowledged if its node deleted its copy.
+func (s *SecureEnclave) Erase(digestHash []byte) ([]api.RecipientStatus, error) {
+	encoded, err := s.readPayload(&digestHash)
+	if err != nil {
+		return nil, err
+	}
+	epl, recipients, err := api.ParsePayloadWithRecipients(*encoded)
+	if err != nil {
+		return nil, api.WrapError(api.Internal, err, "unable to decode payload")
+	}
+	if len(recipients) == 0 {
+		return nil, api.NewError(api.Unauthorized, "payload was not sent by this node")
+	}
+	senderPrivKey, err := s.resolvePrivateKey(epl.Sender)
+	if err != nil {
+		return nil, api.WrapError(
+			api.Unauthorized, err, "payload sender is not hosted by this node")
+	}
+
+	if err = s.erasePayload(context.Background(), digestHash, (*epl.Sender)[:]); err != nil {
+		return nil, err
+	}
+
+	b64Digest := base64.StdEncoding.EncodeToString(digestHash)
+	statuses := make([]api.RecipientStatus, len(recipients))
+	for i, recipient := range recipients {
+		err = s.pushDelete(digestHash, epl.Sender, senderPrivKey, recipient)
+		statuses[i] = api.RecipientStatus{
+			PublicKey: base64.StdEncoding.EncodeToString(recipient),
+			Status:    api.Acknowledged,
+			Updated:   time.Now(),
+		}
+		if err != nil {
+			statuses[i].Status = api.Failed
+			statuses[i].Error = err.Error()
+		}
+		log.WithFields(log.Fields{
+			"digest": b64Digest, "recipient": statuses[i].PublicKey, "status": statuses[i].Status,
+		}).Info("Erased payload")
+	}
+	return statuses, nil
+}
+
+// pushDelete asks the node hosting recipient to delete its copy of the payload with digest.
+func (s *SecureEnclave) pushDelete(
+	digest []byte, senderPubKey, senderPrivKey nacl.Key, recipient []byte) error {
+
+	recipientKey, err := utils.ToKey(recipient)
+	if err != nil {
+		return err
+	}
+	url, ok := s.PartyInfo.GetRecipient(recipientKey)
+	if !ok {
+		return api.NewError(api.Unavailable, "unable to resolve host")
+	}
+
+	sharedKey := s.resolveSharedKey(senderPrivKey, senderPubKey, recipientKey)
+	nonce := nacl.NewNonce()
+	proof := box.SealAfterPrecomputation(nil, api.DeleteProof(digest), nonce, sharedKey)
+	return api.PushDelete(api.PushDeleteRequest{
+		Key:       base64.StdEncoding.EncodeToString(digest),
+		Sender:    base64.StdEncoding.EncodeToString((*senderPubKey)[:]),
+		Recipient: base64.StdEncoding.EncodeToString(recipient),
+		Nonce:     base64.StdEncoding.EncodeToString((*nonce)[:]),
+		Proof:     base64.StdEncoding.EncodeToString(proof),
+	}, url, s.client)
+}
+
+// PushDelete deletes our copy of the payload with digestHash at the request of its sender, given
+// the proof of a PushDeleteRequest from the sender to one of our keys. The payload is tombstoned,
+// even if it has not arrived yet. As the sender of a payload which has not arrived cannot be
+// checked, the tombstone only applies to the payload if it arrives from the requesting sender.
+func (s *SecureEnclave) PushDelete(digestHash, sender, recipient, nonce, proof []byte) error {
+	err := s.checkProof(sender, recipient, nonce, proof, api.DeleteProof(digestHash))
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	encoded, err := s.Db.Read(ctx, digestHash)
+	if err == nil {
+		epl, _, err := api.ParsePayloadWithRecipients(encoded)
+		if err == nil && epl.Sender != nil && !bytes.Equal((*epl.Sender)[:], sender) {
+			return api.NewError(api.Unauthorized, "not the sender of the payload")
+		}
+	} else if err != storage.ErrNotFound {
+		return api.WrapError(api.Internal, err, "unable to read payload")
+	}
+	return s.erasePayload(ctx, digestHash, sender)
+}
+
+// checkProof checks that proof is the expected message, sealed by sender for recipient, which
+// must be one of our keys.
+func (s *SecureEnclave) checkProof(sender, recipient, nonce, proof, expected []byte) error {
+	recipientKey, err := utils.ToKey(recipient)
+	if err != nil {
+		return api.FieldError("recipient", err, "invalid recipient public key")
+	}
+	recipientPrivKey, err := s.resolvePrivateKey(recipientKey)
+	if err != nil {
+		return api.WrapError(api.NotFound, err, "recipient is not hosted by this node")
+	}
+	senderKey, err := utils.ToKey(sender)
+	if err != nil {
+		return api.FieldError("sender", err, "invalid sender public key")
+	}
+	if len(nonce) != nacl.NonceSize {
+		return api.FieldError("nonce", nil, "invalid nonce")
+	}
+	n := new([nacl.NonceSize]byte)
+	copy(n[:], nonce)
+
+	// Not cached, as the sender is not yet trusted
+	sharedKey := box.Precompute(senderKey, recipientPrivKey)
+	message, ok := box.OpenAfterPrecomputation(nil, proof, n, sharedKey)
+	if !ok || !bytes.Equal(message, expected) {
+		return api.NewError(api.Unauthorized, "invalid proof of the sender")
+	}
+	return nil
+}
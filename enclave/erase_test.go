@@ -0,0 +1,164 @@
+package enclave
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/blk-io/crux/api"
+	"github.com/blk-io/crux/storage"
+	"github.com/kevinburke/nacl"
+	"github.com/kevinburke/nacl/box"
+	"golang.org/x/net/context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestErase(t *testing.T) {
+	dbPath, err := ioutil.TempDir("", "TestErase")
+	if err != nil {
+		t.Fatal(err)
+	} else {
+		defer os.RemoveAll(dbPath)
+	}
+	ctx := context.Background()
+
+	enc, rcpt1 := initIndexedEnclave(t, dbPath)
+	mockClient := enc.client.(*MockClient)
+
+	// A second enclave, hosting rcpt1
+	db2, err := storage.InitLevelDb(path.Join(dbPath, "db2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pi := api.CreatePartyInfo(
+		"http://localhost:8001", []string{"http://localhost:8000"}, []nacl.Key{enc.PubKeys[0]},
+		&MockClient{})
+	enc2 := Init(db2, []string{"testdata/rcpt1.pub"}, []string{"testdata/rcpt1"}, pi,
+		&MockClient{}, false)
+
+	digest, err := enc.Store(&message, []byte{}, [][]byte{rcpt1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pushed := mockClient.requests[0]
+	if _, err = enc2.StorePayload(pushed); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the sender can erase a payload
+	if _, err = enc2.Erase(digest); api.CodeOf(err) != api.Unauthorized {
+		t.Errorf("Erasing a payload pushed to us should be unauthorized, actual: %v", err)
+	}
+
+	statuses, err := enc.Erase(digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != 1 || statuses[0].Status != api.Acknowledged ||
+		statuses[0].PublicKey != base64.StdEncoding.EncodeToString(rcpt1) {
+		t.Errorf("Expected rcpt1 to acknowledge the deletion, actual: %+v", statuses)
+	}
+	if _, err = enc.Db.Read(ctx, digest); err != storage.ErrNotFound {
+		t.Errorf("Erased payload should not be found, read returned %v", err)
+	}
+
+	var deleteReq api.PushDeleteRequest
+	if err = json.Unmarshal(mockClient.requests[1], &deleteReq); err != nil {
+		t.Fatal(err)
+	}
+	decode := func(value string) []byte {
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return decoded
+	}
+	sender, recipient := decode(deleteReq.Sender), decode(deleteReq.Recipient)
+	nonce, proof := decode(deleteReq.Nonce), decode(deleteReq.Proof)
+
+	// The proof is only valid for the payload it was made for, from its sender
+	otherDigest := append([]byte{}, digest...)
+	otherDigest[0] ^= 1
+	err = enc2.PushDelete(otherDigest, sender, recipient, nonce, proof)
+	if api.CodeOf(err) != api.Unauthorized {
+		t.Errorf("Proof of another payload should be unauthorized, actual: %v", err)
+	}
+	err = enc2.PushDelete(digest, rcpt1, recipient, nonce, proof)
+	if api.CodeOf(err) != api.Unauthorized {
+		t.Errorf("Proof of another sender should be unauthorized, actual: %v", err)
+	}
+	if _, err = enc2.Db.Read(ctx, digest); err != nil {
+		t.Errorf("Payload should not have been deleted, read returned %v", err)
+	}
+
+	if err = enc2.PushDelete(digest, sender, recipient, nonce, proof); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = enc2.Db.Read(ctx, digest); err != storage.ErrNotFound {
+		t.Errorf("Deleted payload should not be found, read returned %v", err)
+	}
+
+	// Erased payloads are never stored again
+	for _, e := range []*SecureEnclave{enc, enc2} {
+		if _, err = e.StorePayload(pushed); api.CodeOf(err) != api.Deleted {
+			t.Errorf("Storing an erased payload should fail, actual: %v", err)
+		}
+	}
+}
+
+func TestPushDeleteBeforeArrival(t *testing.T) {
+	dbPath, err := ioutil.TempDir("", "TestPushDeleteBeforeArrival")
+	if err != nil {
+		t.Fatal(err)
+	} else {
+		defer os.RemoveAll(dbPath)
+	}
+
+	enc, rcpt1 := initIndexedEnclave(t, dbPath)
+	mockClient := enc.client.(*MockClient)
+	db2, err := storage.InitLevelDb(path.Join(dbPath, "db2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc2 := Init(db2, []string{"testdata/rcpt1.pub"}, []string{"testdata/rcpt1"},
+		api.PartyInfo{}, &MockClient{}, false)
+
+	digest, err := enc.Store(&message, []byte{}, [][]byte{rcpt1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pushed := mockClient.requests[0]
+
+	// Deletion requested with a valid proof by a key which did not send the payload
+	rcpt1Key := enc2.PubKeys[0]
+	otherPubKey, otherPrivKey, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pushDelete := func(senderPubKey, senderPrivKey nacl.Key) error {
+		nonce := nacl.NewNonce()
+		proof := box.Seal(nil, api.DeleteProof(digest), nonce, rcpt1Key, senderPrivKey)
+		return enc2.PushDelete(digest, (*senderPubKey)[:], rcpt1, (*nonce)[:], proof)
+	}
+	if err = pushDelete(otherPubKey, otherPrivKey); err != nil {
+		t.Fatal(err)
+	}
+
+	// Its tombstone does not apply to the payload from the real sender
+	if _, err = enc2.StorePayload(pushed); err != nil {
+		t.Errorf("Payload should be stored despite another sender's deletion, actual: %v", err)
+	}
+	if err = enc2.Delete(&digest); err != nil {
+		t.Fatal(err)
+	}
+
+	// Whereas the real sender's does
+	if err = pushDelete(enc.PubKeys[0], enc.PrivKeys[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = enc2.StorePayload(pushed); api.CodeOf(err) != api.Deleted {
+		t.Errorf("Storing a payload erased by its sender should fail, actual: %v", err)
+	}
+}
@@ -0,0 +1,292 @@
+package enclave
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/blk-io/crux/api"
+	"github.com/blk-io/crux/storage"
+	"github.com/blk-io/crux/utils"
+	"github.com/kevinburke/nacl"
+	"github.com/kevinburke/nacl/box"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"strings"
+)
+
+// Privacy groups are stored as JSON encoded api.PrivacyGroup records, keyed by their id. Deleted
+// groups are kept, so that a deletion is not undone by a stale push of the group.
+var groupPrefix = append(append([]byte{}, storage.ReservedPrefix...), "group/"...)
+
+func groupKey(id []byte) []byte {
+	return indexKey(groupPrefix, id, nil)
+}
+
+// decodeGroup decodes a JSON encoded privacy group, along with its id and members.
+func decodeGroup(encoded []byte) (*api.PrivacyGroup, []byte, [][]byte, error) {
+	var group api.PrivacyGroup
+	if err := json.Unmarshal(encoded, &group); err != nil {
+		return nil, nil, nil, err
+	}
+	id, err := base64.StdEncoding.DecodeString(group.PrivacyGroupId)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	members := make([][]byte, len(group.Members))
+	for i, b64Member := range group.Members {
+		if members[i], err = base64.StdEncoding.DecodeString(b64Member); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	return &group, id, members, nil
+}
+
+// readGroup reads the privacy group with id, returning it with its members.
+func (s *SecureEnclave) readGroup(
+	ctx context.Context, id []byte) (*api.PrivacyGroup, [][]byte, error) {
+
+	encoded, err := s.Db.Read(ctx, groupKey(id))
+	if err == storage.ErrNotFound {
+		return nil, nil, api.NewError(
+			api.NotFound, "privacy group %s not found", base64.StdEncoding.EncodeToString(id))
+	} else if err != nil {
+		return nil, nil, api.WrapError(api.Internal, err, "unable to read privacy group")
+	}
+	group, _, members, err := decodeGroup(encoded)
+	if err != nil {
+		return nil, nil, api.WrapError(api.Internal, err, "unable to decode privacy group")
+	}
+	return group, members, nil
+}
+
+func (s *SecureEnclave) writeGroup(ctx context.Context, id []byte, group *api.PrivacyGroup) error {
+	encoded, err := json.Marshal(group)
+	if err == nil {
+		err = s.Db.Write(ctx, groupKey(id), encoded)
+	}
+	if err != nil {
+		return api.WrapError(api.Internal, err, "unable to store privacy group")
+	}
+	return nil
+}
+
+// hostedMember resolves the key pair of from, which must be hosted by this node and be one of
+// members.
+func (s *SecureEnclave) hostedMember(from []byte, members [][]byte) (nacl.Key, nacl.Key, error) {
+	fromKey, err := utils.ToKey(from)
+	if err != nil {
+		return nil, nil, api.FieldError("from", err, "invalid sender public key")
+	}
+	fromPrivKey, err := s.resolvePrivateKey(fromKey)
+	if err != nil {
+		return nil, nil, api.WrapError(
+			api.Unauthorized, err, "sender public key is not hosted by this node")
+	}
+	if !isParticipant(members, from) {
+		return nil, nil, api.NewError(
+			api.Unauthorized, "sender is not a member of the privacy group")
+	}
+	return fromKey, fromPrivKey, nil
+}
+
+// CreatePrivacyGroup creates a privacy group of members on behalf of from, one of its members,
+// and distributes it to the nodes hosting the other members. The group is kept even if it could
+// not be distributed to every member.
+func (s *SecureEnclave) CreatePrivacyGroup(
+	from []byte, name, description string, members [][]byte) (*api.PrivacyGroup, error) {
+
+	var unique [][]byte
+	for _, member := range members {
+		if _, err := utils.ToKey(member); err != nil {
+			return nil, api.FieldError("members", err, "invalid member public key")
+		}
+		if !isParticipant(unique, member) {
+			unique = append(unique, member)
+		}
+	}
+	fromKey, fromPrivKey, err := s.hostedMember(from, unique)
+	if err != nil {
+		return nil, err
+	}
+
+	id := make([]byte, 32)
+	if _, err = rand.Read(id); err != nil {
+		return nil, api.WrapError(api.Internal, err, "unable to generate privacy group id")
+	}
+	group := &api.PrivacyGroup{
+		PrivacyGroupId: base64.StdEncoding.EncodeToString(id),
+		Name:           name,
+		Description:    description,
+		Type:           api.PrivacyGroupType,
+		State:          api.ActiveGroup,
+	}
+	for _, member := range unique {
+		group.Members = append(group.Members, base64.StdEncoding.EncodeToString(member))
+	}
+	if err = s.writeGroup(context.Background(), id, group); err != nil {
+		return nil, err
+	}
+	return group, s.distributeGroup(group, unique, fromKey, fromPrivKey)
+}
+
+// distributeGroup pushes group to the node hosting each of its members, once per node, with
+// proof that it comes from the member with the given key pair.
+func (s *SecureEnclave) distributeGroup(
+	group *api.PrivacyGroup, members [][]byte, senderPubKey, senderPrivKey nacl.Key) error {
+
+	encoded, err := json.Marshal(group)
+	if err != nil {
+		return api.WrapError(api.Internal, err, "unable to encode privacy group")
+	}
+	pushed := make(map[string]bool)
+	var failed []string
+	for i, member := range members {
+		memberKey, _ := utils.ToKey(member)
+		if _, err = s.resolvePrivateKey(memberKey); err == nil {
+			// Hosted by this node
+			continue
+		}
+		url, ok := s.PartyInfo.GetRecipient(memberKey)
+		if !ok {
+			failed = append(failed, group.Members[i])
+			continue
+		} else if pushed[url] {
+			continue
+		}
+
+		sharedKey := s.resolveSharedKey(senderPrivKey, senderPubKey, memberKey)
+		nonce := nacl.NewNonce()
+		proof := box.SealAfterPrecomputation(nil, api.PrivacyGroupProof(encoded), nonce, sharedKey)
+		err = api.PushPrivacyGroup(api.PushPrivacyGroupRequest{
+			Group:     base64.StdEncoding.EncodeToString(encoded),
+			Sender:    base64.StdEncoding.EncodeToString((*senderPubKey)[:]),
+			Recipient: group.Members[i],
+			Nonce:     base64.StdEncoding.EncodeToString((*nonce)[:]),
+			Proof:     base64.StdEncoding.EncodeToString(proof),
+		}, url, s.client)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"privacyGroupId": group.PrivacyGroupId, "member": group.Members[i],
+			}).Errorf("Unable to push privacy group, %v", err)
+			failed = append(failed, group.Members[i])
+			continue
+		}
+		pushed[url] = true
+	}
+	if len(failed) > 0 {
+		return api.NewError(api.Unavailable,
+			"unable to distribute privacy group to %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// FindPrivacyGroups returns the active privacy groups with exactly the given members.
+func (s *SecureEnclave) FindPrivacyGroups(members [][]byte) ([]api.PrivacyGroup, error) {
+	groups := []api.PrivacyGroup{}
+	err := s.Db.Iterate(context.Background(), storage.PrefixRange(groupPrefix),
+		func(key, value []byte) error {
+			group, _, groupMembers, err := decodeGroup(value)
+			if err != nil {
+				log.WithField("key", string(key)).Errorf("Unable to decode privacy group, %v", err)
+				return nil
+			}
+			if group.State == api.ActiveGroup && sameParticipants(groupMembers, members) {
+				groups = append(groups, *group)
+			}
+			return nil
+		})
+	if err != nil {
+		return nil, api.WrapError(api.Internal, err, "unable to read privacy groups")
+	}
+	return groups, nil
+}
+
+// PrivacyGroup returns the privacy group with id, which may have been deleted.
+func (s *SecureEnclave) PrivacyGroup(id []byte) (*api.PrivacyGroup, error) {
+	group, _, err := s.readGroup(context.Background(), id)
+	return group, err
+}
+
+// DeletePrivacyGroup deletes the privacy group with id on behalf of from, one of its members,
+// and distributes the deletion to the nodes hosting the other members.
+func (s *SecureEnclave) DeletePrivacyGroup(id, from []byte) (*api.PrivacyGroup, error) {
+	ctx := context.Background()
+	group, members, err := s.readGroup(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if group.State == api.DeletedGroup {
+		return nil, api.NewError(
+			api.Deleted, "privacy group %s has been deleted", group.PrivacyGroupId)
+	}
+	fromKey, fromPrivKey, err := s.hostedMember(from, members)
+	if err != nil {
+		return nil, err
+	}
+
+	group.State = api.DeletedGroup
+	if err = s.writeGroup(ctx, id, group); err != nil {
+		return nil, err
+	}
+	return group, s.distributeGroup(group, members, fromKey, fromPrivKey)
+}
+
+// PushPrivacyGroup stores a JSON encoded privacy group pushed to one of our keys by another of
+// its members, given the proof of a PushPrivacyGroupRequest. The members of a group cannot be
+// changed, and once deleted it stays deleted.
+func (s *SecureEnclave) PushPrivacyGroup(encoded, sender, recipient, nonce, proof []byte) error {
+	err := s.checkProof(sender, recipient, nonce, proof, api.PrivacyGroupProof(encoded))
+	if err != nil {
+		return err
+	}
+	group, id, members, err := decodeGroup(encoded)
+	if err != nil {
+		return api.FieldError("group", err, "unable to decode privacy group")
+	}
+	if group.State != api.ActiveGroup && group.State != api.DeletedGroup {
+		return api.FieldError("group", nil, "invalid privacy group state %s", group.State)
+	}
+	if !isParticipant(members, sender) || !isParticipant(members, recipient) {
+		return api.NewError(api.Unauthorized, "not a member of the privacy group")
+	}
+
+	ctx := context.Background()
+	existing, existingMembers, err := s.readGroup(ctx, id)
+	if err == nil {
+		if !sameParticipants(members, existingMembers) {
+			return api.NewError(api.Unauthorized, "members of a privacy group cannot change")
+		}
+		if existing.State == api.DeletedGroup {
+			return nil
+		}
+	} else if api.CodeOf(err) != api.NotFound {
+		return err
+	}
+	return s.writeGroup(ctx, id, group)
+}
+
+// groupRecipients returns the members of the active privacy group with id, other than sender,
+// which must be one of them.
+func (s *SecureEnclave) groupRecipients(id []byte, sender nacl.Key) ([][]byte, error) {
+	group, members, err := s.readGroup(context.Background(), id)
+	if api.CodeOf(err) == api.NotFound {
+		return nil, api.FieldError("privacyGroupId", err, "privacy group not found")
+	} else if err != nil {
+		return nil, err
+	}
+	if group.State == api.DeletedGroup {
+		return nil, api.NewError(
+			api.Deleted, "privacy group %s has been deleted", group.PrivacyGroupId)
+	}
+	if !isParticipant(members, (*sender)[:]) {
+		return nil, api.NewError(api.Unauthorized, "sender is not a member of the privacy group")
+	}
+	var recipients [][]byte
+	for _, member := range members {
+		if !bytes.Equal(member, (*sender)[:]) {
+			recipients = append(recipients, member)
+		}
+	}
+	return recipients, nil
+}
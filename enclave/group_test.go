@@ -0,0 +1,177 @@
+package enclave
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"github.com/blk-io/crux/api"
+	"github.com/blk-io/crux/storage"
+	"github.com/kevinburke/nacl"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestPrivacyGroups(t *testing.T) {
+	dbPath, err := ioutil.TempDir("", "TestPrivacyGroups")
+	if err != nil {
+		t.Fatal(err)
+	} else {
+		defer os.RemoveAll(dbPath)
+	}
+
+	enc, rcpt1 := initIndexedEnclave(t, dbPath)
+	mockClient := enc.client.(*MockClient)
+	sender := (*enc.PubKeys[0])[:]
+
+	// A second enclave, hosting rcpt1
+	db2, err := storage.InitLevelDb(path.Join(dbPath, "db2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pi := api.CreatePartyInfo(
+		"http://localhost:8001", []string{"http://localhost:8000"}, []nacl.Key{enc.PubKeys[0]},
+		&MockClient{})
+	enc2 := Init(db2, []string{"testdata/rcpt1.pub"}, []string{"testdata/rcpt1"}, pi,
+		&MockClient{}, false)
+
+	decode := func(value string) []byte {
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return decoded
+	}
+	// push stores the last privacy group pushed by enc in enc2, with the group modified by f
+	push := func(f func(group *api.PrivacyGroup)) error {
+		var pushReq api.PushPrivacyGroupRequest
+		err := json.Unmarshal(mockClient.requests[len(mockClient.requests)-1], &pushReq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encoded := decode(pushReq.Group)
+		if f != nil {
+			var group api.PrivacyGroup
+			if err = json.Unmarshal(encoded, &group); err != nil {
+				t.Fatal(err)
+			}
+			f(&group)
+			if encoded, err = json.Marshal(group); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return enc2.PushPrivacyGroup(encoded, decode(pushReq.Sender),
+			decode(pushReq.Recipient), decode(pushReq.Nonce), decode(pushReq.Proof))
+	}
+
+	// Groups can only be created by one of their members
+	_, err = enc.CreatePrivacyGroup(rcpt1, "group", "", [][]byte{sender, rcpt1})
+	if api.CodeOf(err) != api.Unauthorized {
+		t.Errorf("Creating a group for a key not hosted should be unauthorized, actual: %v", err)
+	}
+	_, err = enc.CreatePrivacyGroup(sender, "group", "", [][]byte{rcpt1})
+	if api.CodeOf(err) != api.Unauthorized {
+		t.Errorf("Creating a group without its creator should be unauthorized, actual: %v", err)
+	}
+
+	group, err := enc.CreatePrivacyGroup(
+		sender, "group", "A test group", [][]byte{sender, rcpt1, rcpt1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(group.Members) != 2 || group.State != api.ActiveGroup {
+		t.Errorf("Unexpected privacy group: %+v", group)
+	}
+	id := decode(group.PrivacyGroupId)
+
+	// The proof is only valid for the group it was made for
+	err = push(func(group *api.PrivacyGroup) { group.Name = "forged" })
+	if api.CodeOf(err) != api.Unauthorized {
+		t.Errorf("Proof of another group should be unauthorized, actual: %v", err)
+	}
+	if err = push(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, e := range []*SecureEnclave{enc, enc2} {
+		found, err := e.FindPrivacyGroups([][]byte{rcpt1, sender})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(found) != 1 || found[0].PrivacyGroupId != group.PrivacyGroupId {
+			t.Errorf("Expected to find the privacy group, actual: %+v", found)
+		}
+		if found, err = e.FindPrivacyGroups([][]byte{rcpt1}); err != nil || len(found) != 0 {
+			t.Errorf("Expected to find no privacy groups of rcpt1 only, actual: %+v %v",
+				found, err)
+		}
+	}
+
+	// Sending to a group sends to its other members
+	_, err = enc.StoreWithPrivacy(&message, sender, [][]byte{rcpt1},
+		api.PrivacyMetadata{PrivacyGroupId: id})
+	if api.CodeOf(err) != api.InvalidArgument {
+		t.Errorf("Sending to both a group and recipients should be invalid, actual: %v", err)
+	}
+	_, err = enc.StoreWithPrivacy(&message, sender, nil,
+		api.PrivacyMetadata{PrivacyGroupId: []byte("unknown")})
+	if api.CodeOf(err) != api.InvalidArgument {
+		t.Errorf("Sending to an unknown group should be invalid, actual: %v", err)
+	}
+	digest, err := enc.StoreWithPrivacy(&message, sender, nil,
+		api.PrivacyMetadata{PrivacyGroupId: id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = enc2.StorePayload(mockClient.requests[len(mockClient.requests)-1]); err != nil {
+		t.Fatal(err)
+	}
+	returned, err := enc2.Retrieve(&digest, &rcpt1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(returned) != string(message) {
+		t.Errorf("Expected rcpt1 to receive the message sent to the group, actual: %v", returned)
+	}
+	privacy, err := enc2.Privacy(digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(privacy.PrivacyGroupId) != string(id) {
+		t.Errorf("Expected payload to carry the privacy group id, actual: %+v", privacy)
+	}
+
+	// The members of a group cannot change
+	if _, err = enc.DeletePrivacyGroup(id, sender); err != nil {
+		t.Fatal(err)
+	}
+	err = push(func(group *api.PrivacyGroup) { group.Members = group.Members[1:] })
+	if api.CodeOf(err) != api.Unauthorized {
+		t.Errorf("Changed members should be unauthorized, actual: %v", err)
+	}
+	if err = push(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, e := range []*SecureEnclave{enc, enc2} {
+		deleted, err := e.PrivacyGroup(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if deleted.State != api.DeletedGroup {
+			t.Errorf("Expected privacy group to be deleted, actual: %+v", deleted)
+		}
+		found, err := e.FindPrivacyGroups([][]byte{rcpt1, sender})
+		if err != nil || len(found) != 0 {
+			t.Errorf("Deleted privacy group should not be found, actual: %+v %v", found, err)
+		}
+	}
+
+	if _, err = enc.DeletePrivacyGroup(id, sender); api.CodeOf(err) != api.Deleted {
+		t.Errorf("Deleting a deleted group should fail, actual: %v", err)
+	}
+	_, err = enc.StoreWithPrivacy(&message, sender, nil, api.PrivacyMetadata{PrivacyGroupId: id})
+	if api.CodeOf(err) != api.Deleted {
+		t.Errorf("Sending to a deleted group should fail, actual: %v", err)
+	}
+}
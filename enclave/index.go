@@ -0,0 +1,235 @@
+package enclave
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/blk-io/crux/api"
+	"github.com/blk-io/crux/storage"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"sort"
+	"time"
+)
+
+// Payloads are indexed by their recipients, sender and the time they were received. Index
+// entries are records with empty values, whose keys are the index prefix, the indexed value and
+// the digest of the payload. They are written in the same batch as the payload itself.
+var (
+	indexPrefix          = append(append([]byte{}, storage.ReservedPrefix...), "idx/"...)
+	recipientIndexPrefix = append(append([]byte{}, indexPrefix...), "r/"...)
+	senderIndexPrefix    = append(append([]byte{}, indexPrefix...), "s/"...)
+	timeIndexPrefix      = append(append([]byte{}, indexPrefix...), "t/"...)
+	// Maps each digest to the time it was received, so that its time index entry can be found
+	receivedPrefix = append(append([]byte{}, indexPrefix...), "d/"...)
+)
+
+// indexVersionKey records the version of the indexes in a store. It is outside indexPrefix, so
+// that it survives RebuildIndexes discarding the indexes.
+var indexVersionKey = append(append([]byte{}, storage.ReservedPrefix...), "idxversion"...)
+
+// indexVersion is the current version of the indexes, which is incremented whenever existing
+// stores need to be reindexed.
+const indexVersion = 1
+
+// rebuildBatchSize is the number of payloads indexed in each batch by RebuildIndexes.
+const rebuildBatchSize = 1000
+
+func indexKey(prefix, value, digest []byte) []byte {
+	key := make([]byte, 0, len(prefix)+len(value)+len(digest))
+	return append(append(append(key, prefix...), value...), digest...)
+}
+
+func encodeTime(t time.Time) []byte {
+	encoded := make([]byte, 8)
+	binary.BigEndian.PutUint64(encoded, uint64(t.UnixNano()))
+	return encoded
+}
+
+// indexPayload adds the index entries for a payload received at the given time to batch.
+func indexPayload(
+	batch *storage.Batch, digest []byte, epl api.EncryptedPayload, recipients [][]byte,
+	received time.Time) {
+
+	for _, recipient := range recipients {
+		batch.Put(indexKey(recipientIndexPrefix, recipient, digest), []byte{})
+	}
+	if epl.Sender != nil {
+		batch.Put(indexKey(senderIndexPrefix, (*epl.Sender)[:], digest), []byte{})
+	}
+	encodedTime := encodeTime(received)
+	batch.Put(indexKey(timeIndexPrefix, encodedTime, digest), []byte{})
+	batch.Put(indexKey(receivedPrefix, digest, nil), encodedTime)
+}
+
+// unindexPayload adds the deletion of the index entries of the encoded payload to batch.
+func unindexPayload(
+	ctx context.Context, db storage.DataStore, batch *storage.Batch,
+	digest []byte, encoded []byte) error {
+
+	// Malformed payloads were never indexed by recipient or sender
+	epl, recipients, err := api.ParsePayloadWithRecipients(encoded)
+	if err == nil {
+		for _, recipient := range recipients {
+			batch.Delete(indexKey(recipientIndexPrefix, recipient, digest))
+		}
+		if epl.Sender != nil {
+			batch.Delete(indexKey(senderIndexPrefix, (*epl.Sender)[:], digest))
+		}
+	}
+
+	receivedKey := indexKey(receivedPrefix, digest, nil)
+	encodedTime, err := db.Read(ctx, receivedKey)
+	if err == nil {
+		batch.Delete(indexKey(timeIndexPrefix, encodedTime, digest))
+		batch.Delete(receivedKey)
+	} else if err != storage.ErrNotFound {
+		return err
+	}
+	return nil
+}
+
+// readReceived returns the time the payload with digest was received, or storage.ErrNotFound if
+// it has not been indexed.
+func readReceived(ctx context.Context, db storage.DataStore, digest []byte) (time.Time, error) {
+	encodedTime, err := db.Read(ctx, indexKey(receivedPrefix, digest, nil))
+	if err != nil {
+		return time.Time{}, err
+	} else if len(encodedTime) != 8 {
+		return time.Time{}, storage.ErrNotFound
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(encodedTime))), nil
+}
+
+// indexedDigests returns the digests of all payloads in the index entries under prefix.
+func indexedDigests(ctx context.Context, db storage.DataStore, prefix []byte) ([][]byte, error) {
+	var digests [][]byte
+	err := db.Iterate(ctx, storage.PrefixRange(prefix), func(key, value []byte) error {
+		digests = append(digests, append([]byte{}, key[len(prefix):]...))
+		return nil
+	})
+	return digests, err
+}
+
+// digestsReceived returns the digests of the payloads received in the interval [from, to), in
+// the order they were received.
+func digestsReceived(
+	ctx context.Context, db storage.DataStore, from, to time.Time) ([][]byte, error) {
+
+	return timeIndexed(ctx, db, storage.Range{
+		Start: indexKey(timeIndexPrefix, encodeTime(from), nil),
+		Limit: indexKey(timeIndexPrefix, encodeTime(to), nil),
+	})
+}
+
+// timeIndexed returns the digests of the time index entries in r, in the order they were
+// received. The entries are sorted, as not every DataStore iterates in key order.
+func timeIndexed(ctx context.Context, db storage.DataStore, r storage.Range) ([][]byte, error) {
+	var keys [][]byte
+	err := db.Iterate(ctx, r, func(key, value []byte) error {
+		keys = append(keys, append([]byte{}, key...))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Entry keys start with the big endian received time, so they sort by it
+	sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 })
+	digests := make([][]byte, len(keys))
+	for i, key := range keys {
+		digests[i] = key[len(timeIndexPrefix)+8:]
+	}
+	return digests, nil
+}
+
+// EnsureIndexes rebuilds the indexes of db if they were created by an earlier version of Crux, or
+// the store has never been indexed.
+func EnsureIndexes(ctx context.Context, db storage.DataStore) error {
+	encoded, err := db.Read(ctx, indexVersionKey)
+	if err == nil && len(encoded) == 8 && binary.BigEndian.Uint64(encoded) >= indexVersion {
+		return nil
+	} else if err != nil && err != storage.ErrNotFound {
+		return err
+	}
+
+	log.Info("Indexes are out of date, rebuilding them")
+	indexed, err := RebuildIndexes(ctx, db)
+	if err != nil {
+		return err
+	}
+	log.Infof("Indexed %d payloads", indexed)
+	return nil
+}
+
+// RebuildIndexes discards and recreates the indexes of all payloads in db, returning the number
+// of payloads indexed. Payloads which have not been indexed before are treated as received at
+// the time of the rebuild.
+func RebuildIndexes(ctx context.Context, db storage.DataStore) (int, error) {
+	received := make(map[string][]byte)
+	var digests, stale [][]byte
+
+	err := db.Iterate(ctx, storage.All, func(key, value []byte) error {
+		if !storage.IsReserved(key) {
+			digests = append(digests, append([]byte{}, key...))
+		} else if storage.PrefixRange(indexPrefix).Contains(key) {
+			stale = append(stale, append([]byte{}, key...))
+			if storage.PrefixRange(receivedPrefix).Contains(key) {
+				received[string(key[len(receivedPrefix):])] = append([]byte{}, value...)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	batch := new(storage.Batch)
+	for _, key := range stale {
+		batch.Delete(key)
+		if batch.Len() >= rebuildBatchSize {
+			if err = db.WriteBatch(ctx, batch); err != nil {
+				return 0, err
+			}
+			batch = new(storage.Batch)
+		}
+	}
+
+	now := time.Now()
+	indexed := 0
+	for _, digest := range digests {
+		encoded, err := db.Read(ctx, digest)
+		if err == storage.ErrNotFound {
+			// Deleted since the store was scanned
+			continue
+		} else if err != nil {
+			return indexed, err
+		}
+
+		epl, recipients, err := api.ParsePayloadWithRecipients(encoded)
+		if err != nil {
+			log.WithField("digest", fmt.Sprintf("%x", digest)).Errorf(
+				"Unable to index payload: %v", err)
+			continue
+		}
+
+		receivedAt := now
+		if encodedTime, ok := received[string(digest)]; ok && len(encodedTime) == 8 {
+			receivedAt = time.Unix(0, int64(binary.BigEndian.Uint64(encodedTime)))
+		}
+		indexPayload(batch, digest, epl, recipients, receivedAt)
+		indexed++
+
+		if indexed%rebuildBatchSize == 0 {
+			if err = db.WriteBatch(ctx, batch); err != nil {
+				return indexed, err
+			}
+			batch = new(storage.Batch)
+			log.Infof("Indexed %d of %d payloads", indexed, len(digests))
+		}
+	}
+	encodedVersion := make([]byte, 8)
+	binary.BigEndian.PutUint64(encodedVersion, indexVersion)
+	batch.Put(indexVersionKey, encodedVersion)
+	return indexed, db.WriteBatch(ctx, batch)
+}
@@ -0,0 +1,218 @@
+package enclave
+
+import (
+	"bytes"
+	"github.com/blk-io/crux/api"
+	"github.com/blk-io/crux/storage"
+	"github.com/blk-io/crux/utils"
+	"github.com/kevinburke/nacl"
+	"golang.org/x/net/context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func initIndexedEnclave(t *testing.T, dbPath string) (*SecureEnclave, []byte) {
+	pubKeys, err := loadPubKeys([]string{"testdata/rcpt1.pub"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rcpt1 := pubKeys[0]
+
+	var client utils.HttpClient
+	client = &MockClient{}
+	pi := api.CreatePartyInfo(
+		"http://localhost:8000",
+		[]string{"http://localhost:8001"},
+		[]nacl.Key{rcpt1},
+		client)
+
+	return initEnclave(t, dbPath, pi, client), (*rcpt1)[:]
+}
+
+func checkIndexed(t *testing.T, db storage.DataStore, prefix, digest []byte, expected bool) {
+	digests, err := indexedDigests(context.Background(), db, prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, d := range digests {
+		if bytes.Equal(d, digest) {
+			found = true
+		}
+	}
+	if found != expected {
+		t.Errorf("Digest %x indexed under %q should be %t, actual: %t",
+			digest, prefix, expected, found)
+	}
+}
+
+func checkReceived(t *testing.T, db storage.DataStore, from time.Time, expected [][]byte) {
+	digests, err := digestsReceived(context.Background(), db, from, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(digests) != len(expected) {
+		t.Fatalf("Expected %d received digests, actual: %d", len(expected), len(digests))
+	}
+	for i := range expected {
+		if !bytes.Equal(digests[i], expected[i]) {
+			t.Errorf("Received digest %d should be %x, actual: %x", i, expected[i], digests[i])
+		}
+	}
+}
+
+func TestStoreIndexes(t *testing.T) {
+	dbPath, err := ioutil.TempDir("", "TestStoreIndexes")
+	if err != nil {
+		t.Fatal(err)
+	} else {
+		defer os.RemoveAll(dbPath)
+	}
+
+	enc, rcpt1 := initIndexedEnclave(t, dbPath)
+	sender := enc.PubKeys[0][:]
+	start := time.Now()
+
+	digest, err := enc.Store(&message, []byte{}, [][]byte{rcpt1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	message2 := []byte("Another message")
+	digest2, err := enc.Store(&message2, []byte{}, [][]byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkIndexed(t, enc.Db, indexKey(recipientIndexPrefix, rcpt1, nil), digest, true)
+	checkIndexed(t, enc.Db, indexKey(recipientIndexPrefix, rcpt1, nil), digest2, false)
+	checkIndexed(t, enc.Db, indexKey(senderIndexPrefix, sender, nil), digest, true)
+	checkIndexed(t, enc.Db, indexKey(senderIndexPrefix, sender, nil), digest2, true)
+	checkReceived(t, enc.Db, start, [][]byte{digest, digest2})
+
+	// Storing a payload again keeps its original time index entry
+	encoded, err := enc.Db.Read(context.Background(), digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	epl, recipients, err := api.ParsePayloadWithRecipients(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = enc.storePayload(epl, recipients, encoded, newMetadata(encoded, api.LocalOrigin, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkReceived(t, enc.Db, start, [][]byte{digest, digest2})
+
+	// Whereas storing another encoding of it replaces its index entries
+	encoded = api.EncodePayloadWithRecipients(epl, [][]byte{})
+	_, err = enc.storePayload(epl, nil, encoded, newMetadata(encoded, api.LocalOrigin, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkIndexed(t, enc.Db, indexKey(recipientIndexPrefix, rcpt1, nil), digest, false)
+	checkIndexed(t, enc.Db, indexKey(senderIndexPrefix, sender, nil), digest, true)
+	checkReceived(t, enc.Db, start, [][]byte{digest, digest2})
+
+	err = enc.Delete(&digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkIndexed(t, enc.Db, indexKey(recipientIndexPrefix, rcpt1, nil), digest, false)
+	checkIndexed(t, enc.Db, indexKey(senderIndexPrefix, sender, nil), digest, false)
+	checkReceived(t, enc.Db, start, [][]byte{digest2})
+}
+
+func TestRebuildIndexes(t *testing.T) {
+	dbPath, err := ioutil.TempDir("", "TestRebuildIndexes")
+	if err != nil {
+		t.Fatal(err)
+	} else {
+		defer os.RemoveAll(dbPath)
+	}
+
+	enc, rcpt1 := initIndexedEnclave(t, dbPath)
+	sender := enc.PubKeys[0][:]
+	start := time.Now()
+
+	digest, err := enc.Store(&message, []byte{}, [][]byte{rcpt1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Discard the indexes, leaving a stale entry behind for a payload which no longer exists
+	ctx := context.Background()
+	batch := new(storage.Batch)
+	encoded, err := enc.Db.Read(ctx, digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = unindexPayload(ctx, enc.Db, batch, digest, encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale := []byte("stale digest")
+	batch.Put(indexKey(recipientIndexPrefix, rcpt1, stale), []byte{})
+	if err = enc.Db.WriteBatch(ctx, batch); err != nil {
+		t.Fatal(err)
+	}
+	checkIndexed(t, enc.Db, indexKey(recipientIndexPrefix, rcpt1, nil), digest, false)
+
+	indexed, err := RebuildIndexes(ctx, enc.Db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if indexed != 1 {
+		t.Errorf("Expected 1 payload to be indexed, actual: %d", indexed)
+	}
+	checkIndexed(t, enc.Db, indexKey(recipientIndexPrefix, rcpt1, nil), digest, true)
+	checkIndexed(t, enc.Db, indexKey(recipientIndexPrefix, rcpt1, nil), stale, false)
+	checkIndexed(t, enc.Db, indexKey(senderIndexPrefix, sender, nil), digest, true)
+	checkReceived(t, enc.Db, start, [][]byte{digest})
+}
+
+func TestEnsureIndexes(t *testing.T) {
+	dbPath, err := ioutil.TempDir("", "TestEnsureIndexes")
+	if err != nil {
+		t.Fatal(err)
+	} else {
+		defer os.RemoveAll(dbPath)
+	}
+
+	enc, rcpt1 := initIndexedEnclave(t, dbPath)
+	digest, err := enc.Store(&message, []byte{}, [][]byte{rcpt1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A store from an earlier version has payloads but no indexes
+	ctx := context.Background()
+	unindex := func() {
+		encoded, err := enc.Db.Read(ctx, digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		batch := new(storage.Batch)
+		if err = unindexPayload(ctx, enc.Db, batch, digest, encoded); err != nil {
+			t.Fatal(err)
+		}
+		if err = enc.Db.WriteBatch(ctx, batch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	unindex()
+
+	if err = EnsureIndexes(ctx, enc.Db); err != nil {
+		t.Fatal(err)
+	}
+	checkIndexed(t, enc.Db, indexKey(recipientIndexPrefix, rcpt1, nil), digest, true)
+
+	// Once indexed, the indexes are not rebuilt again
+	unindex()
+	if err = EnsureIndexes(ctx, enc.Db); err != nil {
+		t.Fatal(err)
+	}
+	checkIndexed(t, enc.Db, indexKey(recipientIndexPrefix, rcpt1, nil), digest, false)
+}
@@ -0,0 +1,137 @@
+package enclave
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"github.com/blk-io/crux/api"
+	"github.com/blk-io/crux/storage"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"time"
+)
+
+// Each payload has a metadata record, a JSON encoded api.PayloadMetadata, which is written in
+// the same batch as the payload itself.
+var metadataPrefix = append(append([]byte{}, storage.ReservedPrefix...), "meta/"...)
+
+func metadataKey(digest []byte) []byte {
+	return indexKey(metadataPrefix, digest, nil)
+}
+
+// newMetadata creates the metadata of an encoded payload from origin, which is received now. The
+// delivery of payloads sent by this node to each of recipients is pending. Its key is set when
+// it is stored.
+func newMetadata(encoded []byte, origin string, recipients [][]byte) *api.PayloadMetadata {
+	now := time.Now()
+	meta := &api.PayloadMetadata{
+		Received: now,
+		Origin:   origin,
+		Size:     len(encoded),
+	}
+	if origin == api.LocalOrigin {
+		meta.Created = &now
+		for _, recipient := range recipients {
+			meta.Recipients = append(meta.Recipients, api.RecipientStatus{
+				PublicKey: base64.StdEncoding.EncodeToString(recipient),
+				Status:    api.Pending,
+				Updated:   now,
+			})
+		}
+	}
+	return meta
+}
+
+// putMetadata adds the write of the metadata of the payload with digest to batch.
+func putMetadata(batch *storage.Batch, digest []byte, meta *api.PayloadMetadata) error {
+	encoded, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	batch.Put(metadataKey(digest), encoded)
+	return nil
+}
+
+// readMetadata reads the metadata of the payload with digest, returning storage.ErrNotFound if
+// it has none.
+func readMetadata(
+	ctx context.Context, db storage.DataStore, digest []byte) (*api.PayloadMetadata, error) {
+
+	encoded, err := db.Read(ctx, metadataKey(digest))
+	if err != nil {
+		return nil, err
+	}
+	var meta api.PayloadMetadata
+	if err = json.Unmarshal(encoded, &meta); err != nil {
+		return nil, err
+	}
+	return &meta, nil
+}
+
+// Metadata returns the metadata of the payload with the given digestHash. Payloads stored before
+// metadata was recorded are described by their size and the time they were indexed, with an
+// unknown origin.
+func (s *SecureEnclave) Metadata(digestHash []byte) (*api.PayloadMetadata, error) {
+	ctx := context.Background()
+	meta, err := readMetadata(ctx, s.Db, digestHash)
+	if err == nil {
+		return meta, nil
+	} else if err != storage.ErrNotFound {
+		return nil, api.WrapError(api.Internal, err, "unable to read payload metadata")
+	}
+
+	encoded, err := s.readPayload(&digestHash)
+	if err != nil {
+		return nil, err
+	}
+	meta = &api.PayloadMetadata{
+		Key:    base64.StdEncoding.EncodeToString(digestHash),
+		Origin: api.UnknownOrigin,
+		Size:   len(*encoded),
+	}
+	if received, err := readReceived(ctx, s.Db, digestHash); err == nil {
+		meta.Received = received
+	}
+	return meta, nil
+}
+
+// recordDelivery records the result of delivering the payload with digest to recipient, where
+// err is nil if it was delivered.
+func (s *SecureEnclave) recordDelivery(digest, recipient []byte, err error) {
+	s.metadataMu.Lock()
+	defer s.metadataMu.Unlock()
+
+	ctx := context.Background()
+	meta, readErr := readMetadata(ctx, s.Db, digest)
+	if readErr == storage.ErrNotFound {
+		// Deleted, or stored before metadata was recorded
+		return
+	} else if readErr != nil {
+		log.WithField("digest", base64.StdEncoding.EncodeToString(digest)).Errorf(
+			"Unable to read payload metadata, %v", readErr)
+		return
+	}
+
+	status := api.RecipientStatus{
+		PublicKey: base64.StdEncoding.EncodeToString(recipient),
+		Status:    api.Delivered,
+		Updated:   time.Now(),
+	}
+	if err != nil {
+		status.Status = api.Failed
+		status.Error = err.Error()
+	}
+	for i, existing := range meta.Recipients {
+		if existing.PublicKey == status.PublicKey {
+			meta.Recipients[i] = status
+		}
+	}
+
+	batch := new(storage.Batch)
+	err = putMetadata(batch, digest, meta)
+	if err == nil {
+		err = s.Db.WriteBatch(ctx, batch)
+	}
+	if err != nil {
+		log.WithField("digest", meta.Key).Errorf("Unable to update payload metadata, %v", err)
+	}
+}
@@ -0,0 +1,93 @@
+package enclave
+
+import (
+	"encoding/base64"
+	"github.com/blk-io/crux/api"
+	"github.com/blk-io/crux/storage"
+	"github.com/blk-io/crux/utils"
+	"github.com/kevinburke/nacl"
+	"golang.org/x/net/context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMetadata(t *testing.T) {
+	dbPath, err := ioutil.TempDir("", "TestMetadata")
+	if err != nil {
+		t.Fatal(err)
+	} else {
+		defer os.RemoveAll(dbPath)
+	}
+	ctx := context.Background()
+	start := time.Now()
+
+	enc, rcpt1 := initIndexedEnclave(t, dbPath)
+	unknown := (*nacl.NewKey())[:]
+
+	digest, err := enc.Store(&message, []byte{}, [][]byte{rcpt1, unknown})
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := enc.Metadata(digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Key != base64.StdEncoding.EncodeToString(digest) || meta.Origin != api.LocalOrigin ||
+		meta.Created == nil || meta.Received.Before(start) || meta.Size == 0 {
+		t.Errorf("Unexpected metadata of a sent payload: %+v", meta)
+	}
+	expected := []api.DeliveryStatus{api.Delivered, api.Failed}
+	if len(meta.Recipients) != len(expected) {
+		t.Fatalf("Expected the status of 2 recipients, actual: %+v", meta.Recipients)
+	}
+	for i, status := range expected {
+		if meta.Recipients[i].Status != status {
+			t.Errorf("Expected recipient %d to be %s, actual: %+v", i, status, meta.Recipients[i])
+		}
+	}
+
+	// A payload pushed by the node hosting rcpt1
+	encoded, err := enc.Db.Read(ctx, digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	epl, _ := api.DecodePayloadWithRecipients(encoded)
+	pushed := epl
+	pushed.Sender, _ = utils.ToKey(rcpt1)
+	pushed.CipherText = append([]byte{0}, epl.CipherText...)
+	pushedDigest, err := enc.StorePayload(api.EncodePayloadWithRecipients(pushed, [][]byte{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err = enc.Metadata(pushedDigest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Origin != "http://localhost:8001" || meta.Created != nil || len(meta.Recipients) != 0 {
+		t.Errorf("Unexpected metadata of a pushed payload: %+v", meta)
+	}
+
+	// Payloads stored before metadata was recorded
+	if err = enc.Db.Delete(ctx, metadataKey(pushedDigest)); err != nil {
+		t.Fatal(err)
+	}
+	meta, err = enc.Metadata(pushedDigest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Origin != api.UnknownOrigin || meta.Received.Before(start) || meta.Size == 0 {
+		t.Errorf("Unexpected metadata of a payload stored without metadata: %+v", meta)
+	}
+
+	if err = enc.Delete(&digest); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = enc.Db.Read(ctx, metadataKey(digest)); err != storage.ErrNotFound {
+		t.Errorf("Metadata of a deleted payload should not be found, read returned %v", err)
+	}
+	if _, err = enc.Metadata(digest); api.CodeOf(err) != api.NotFound {
+		t.Errorf("Expected metadata of a deleted payload to be not found, actual: %v", err)
+	}
+}
@@ -0,0 +1,192 @@
+package enclave
+
+import (
+	"bytes"
+	"encoding/base64"
+	"github.com/blk-io/crux/api"
+	"github.com/blk-io/crux/utils"
+	"github.com/kevinburke/nacl"
+	log "github.com/sirupsen/logrus"
+)
+
+// securityHash binds a payload, given its master key, to a contract transaction it affects. It can
+// only be computed by participants in both.
+func securityHash(affected api.EncryptedPayload, masterKey nacl.Key) []byte {
+	data := make([]byte, 0, len(affected.CipherText)+nacl.NonceSize+nacl.KeySize)
+	data = append(data, affected.CipherText...)
+	data = append(data, (*affected.Nonce)[:]...)
+	data = append(data, (*masterKey)[:]...)
+	return utils.Sha3Hash(data)
+}
+
+// sameParticipants returns true if a and b contain the same public keys, in any order.
+func sameParticipants(a, b [][]byte) bool {
+	keys := make(map[string]bool, len(a))
+	for _, key := range a {
+		keys[string(key)] = true
+	}
+	for _, key := range b {
+		if !keys[string(key)] {
+			return false
+		}
+	}
+	return len(keys) == len(b)
+}
+
+func isParticipant(participants [][]byte, key []byte) bool {
+	for _, participant := range participants {
+		if bytes.Equal(participant, key) {
+			return true
+		}
+	}
+	return false
+}
+
+func checkPrivacyMode(privacy api.PrivacyMetadata) error {
+	switch privacy.Mode {
+	case api.StandardPrivate, api.PartyProtection:
+		return nil
+	case api.PrivateStateValidation:
+		if len(privacy.ExecHash) == 0 {
+			return api.FieldError("execHash", nil, "private state validation requires an execHash")
+		}
+		return nil
+	default:
+		return api.FieldError("privacyFlag", nil, "invalid privacy flag %d", privacy.Mode)
+	}
+}
+
+// readAffected reads the contract transaction with digest, and its privacy metadata.
+func (s *SecureEnclave) readAffected(
+	digest []byte) (api.EncryptedPayload, api.PrivacyMetadata, error) {
+
+	encoded, err := s.readPayload(&digest)
+	if err != nil {
+		return api.EncryptedPayload{}, api.PrivacyMetadata{}, err
+	}
+	epl, _, privacy, err := api.ParsePayloadWithPrivacy(*encoded)
+	if err != nil {
+		return epl, privacy, api.WrapError(api.Internal, err, "unable to decode payload")
+	}
+	return epl, privacy, nil
+}
+
+// sentPrivacy checks the privacy metadata of a payload we are sending to participants against
+// the contract transactions it affects, each of which must have the same privacy mode, and for
+// PrivateStateValidation, the same participants. The completed privacy metadata is returned.
+func (s *SecureEnclave) sentPrivacy(
+	privacy api.PrivacyMetadata, participants [][]byte,
+	masterKey nacl.Key) (api.PrivacyMetadata, error) {
+
+	if err := checkPrivacyMode(privacy); err != nil {
+		return privacy, err
+	}
+	if privacy.Mode == api.PrivateStateValidation {
+		privacy.Recipients = participants
+	} else {
+		privacy.Recipients = nil
+	}
+
+	affectedContracts := make([]api.AffectedContract, len(privacy.AffectedContracts))
+	for i, affected := range privacy.AffectedContracts {
+		b64Digest := base64.StdEncoding.EncodeToString(affected.Digest)
+		affectedEpl, affectedPrivacy, err := s.readAffected(affected.Digest)
+		if api.CodeOf(err) == api.NotFound {
+			return privacy, api.FieldError("affectedContractTransactions", nil,
+				"affected contract transaction %s not found", b64Digest)
+		} else if err != nil {
+			return privacy, err
+		}
+		if affectedPrivacy.Mode != privacy.Mode {
+			return privacy, api.NewError(api.Unauthorized,
+				"privacy flag %d of affected contract transaction %s does not match %d",
+				affectedPrivacy.Mode, b64Digest, privacy.Mode)
+		}
+		if privacy.Mode == api.PrivateStateValidation &&
+			!sameParticipants(affectedPrivacy.Recipients, participants) {
+			return privacy, api.NewError(api.Unauthorized,
+				"participants of affected contract transaction %s do not match", b64Digest)
+		}
+		affectedContracts[i] = api.AffectedContract{
+			Digest:       affected.Digest,
+			SecurityHash: securityHash(affectedEpl, masterKey),
+		}
+	}
+	privacy.AffectedContracts = affectedContracts
+	return privacy, nil
+}
+
+// checkPushedPrivacy validates the privacy metadata of a payload pushed to us against the
+// contract transactions it affects which we are a party to. Those of a PartyProtection payload
+// with an invalid security hash are removed, returning the payload re-encoded without them.
+func (s *SecureEnclave) checkPushedPrivacy(
+	epl api.EncryptedPayload, recipients [][]byte, encoded []byte) ([]byte, error) {
+
+	_, _, privacy, err := api.ParsePayloadWithPrivacy(encoded)
+	if err != nil {
+		return nil, api.WrapError(api.InvalidArgument, err, "unable to decode payload")
+	}
+	if privacy.Mode == api.StandardPrivate {
+		return encoded, nil
+	}
+	if err = checkPrivacyMode(privacy); err != nil {
+		return nil, err
+	}
+	psv := privacy.Mode == api.PrivateStateValidation
+	if psv && !isParticipant(privacy.Recipients, (*epl.Sender)[:]) {
+		return nil, api.NewError(api.Unauthorized, "sender is not a participant of the payload")
+	}
+
+	masterKey, ok := s.openMasterKey(epl, nil)
+	if !ok {
+		return nil, api.NewError(api.Unauthorized, "not a recipient of the payload")
+	}
+
+	var valid []api.AffectedContract
+	for _, affected := range privacy.AffectedContracts {
+		b64Digest := base64.StdEncoding.EncodeToString(affected.Digest)
+		affectedEpl, affectedPrivacy, err := s.readAffected(affected.Digest)
+		if api.CodeOf(err) == api.NotFound {
+			if psv {
+				return nil, api.NewError(api.Unauthorized,
+					"affected contract transaction %s is unknown", b64Digest)
+			}
+			// We are not a party to it, so cannot check it
+			valid = append(valid, affected)
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if affectedPrivacy.Mode != privacy.Mode {
+			return nil, api.NewError(api.Unauthorized,
+				"privacy flag %d of affected contract transaction %s does not match %d",
+				affectedPrivacy.Mode, b64Digest, privacy.Mode)
+		}
+		if !bytes.Equal(securityHash(affectedEpl, masterKey), affected.SecurityHash) {
+			if psv {
+				return nil, api.NewError(api.Unauthorized,
+					"invalid security hash for affected contract transaction %s", b64Digest)
+			}
+			log.WithField("affected", b64Digest).Warn(
+				"Ignoring affected contract transaction with an invalid security hash")
+			continue
+		}
+		if psv && !sameParticipants(affectedPrivacy.Recipients, privacy.Recipients) {
+			return nil, api.NewError(api.Unauthorized,
+				"participants of affected contract transaction %s do not match", b64Digest)
+		}
+		valid = append(valid, affected)
+	}
+
+	if len(valid) == len(privacy.AffectedContracts) {
+		return encoded, nil
+	}
+	privacy.AffectedContracts = valid
+	return api.EncodePayloadWithPrivacy(epl, recipients, privacy), nil
+}
+
+// Privacy returns the enhanced privacy metadata of the payload with digestHash.
+func (s *SecureEnclave) Privacy(digestHash []byte) (api.PrivacyMetadata, error) {
+	_, privacy, err := s.readAffected(digestHash)
+	return privacy, err
+}
@@ -0,0 +1,160 @@
+package enclave
+
+import (
+	"github.com/blk-io/crux/api"
+	"github.com/blk-io/crux/storage"
+	"github.com/kevinburke/nacl"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestPrivacy(t *testing.T) {
+	dbPath, err := ioutil.TempDir("", "TestPrivacy")
+	if err != nil {
+		t.Fatal(err)
+	} else {
+		defer os.RemoveAll(dbPath)
+	}
+
+	enc, rcpt1 := initIndexedEnclave(t, dbPath)
+	mockClient := enc.client.(*MockClient)
+
+	// A second enclave, hosting rcpt1
+	db2, err := storage.InitLevelDb(path.Join(dbPath, "db2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pi := api.CreatePartyInfo(
+		"http://localhost:8001", []string{"http://localhost:8000"}, []nacl.Key{enc.PubKeys[0]},
+		&MockClient{})
+	enc2 := Init(db2, []string{"testdata/rcpt1.pub"}, []string{"testdata/rcpt1"}, pi,
+		&MockClient{}, false)
+
+	// send stores a payload sent to rcpt1, returning its digest and the payload pushed to enc2
+	send := func(privacy api.PrivacyMetadata) ([]byte, []byte, error) {
+		digest, err := enc.StoreWithPrivacy(&message, []byte{}, [][]byte{rcpt1}, privacy)
+		if err != nil {
+			return nil, nil, err
+		}
+		return digest, mockClient.requests[len(mockClient.requests)-1], nil
+	}
+	affecting := func(mode api.PrivacyMode, digests ...[]byte) api.PrivacyMetadata {
+		privacy := api.PrivacyMetadata{Mode: mode}
+		if mode == api.PrivateStateValidation {
+			privacy.ExecHash = []byte("3x3c")
+		}
+		for _, digest := range digests {
+			privacy.AffectedContracts = append(
+				privacy.AffectedContracts, api.AffectedContract{Digest: digest})
+		}
+		return privacy
+	}
+	tamper := func(pushed []byte) []byte {
+		epl, recipients, privacy, err := api.ParsePayloadWithPrivacy(pushed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		privacy.AffectedContracts[0].SecurityHash = []byte("invalid")
+		return api.EncodePayloadWithPrivacy(epl, recipients, privacy)
+	}
+
+	invalid := []api.PrivacyMetadata{{Mode: 2}, {Mode: api.PrivateStateValidation}}
+	for _, privacy := range invalid {
+		if _, _, err = send(privacy); api.CodeOf(err) != api.InvalidArgument {
+			t.Errorf("Sending with %+v should be invalid, actual: %v", privacy, err)
+		}
+	}
+
+	for _, mode := range []api.PrivacyMode{api.PartyProtection, api.PrivateStateValidation} {
+		contract, pushed, err := send(affecting(mode))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = enc2.StorePayload(pushed); err != nil {
+			t.Fatal(err)
+		}
+
+		// Affected contracts must have the same privacy mode
+		_, _, err = send(affecting(api.StandardPrivate, contract))
+		if api.CodeOf(err) != api.Unauthorized {
+			t.Errorf("Standard transaction affecting mode %d should be unauthorized, actual: %v",
+				mode, err)
+		}
+		_, _, err = send(affecting(mode, []byte("unknown")))
+		if api.CodeOf(err) != api.InvalidArgument {
+			t.Errorf("Transaction affecting an unknown contract should be invalid, actual: %v", err)
+		}
+
+		digest, pushed, err := send(affecting(mode, contract))
+		if err != nil {
+			t.Fatal(err)
+		}
+		privacy, err := enc.Privacy(digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if privacy.Mode != mode || len(privacy.AffectedContracts) != 1 ||
+			len(privacy.AffectedContracts[0].SecurityHash) == 0 {
+			t.Errorf("Unexpected privacy metadata of mode %d: %+v", mode, privacy)
+		}
+
+		// Payloads with invalid security hashes are rejected with private state validation,
+		// otherwise the affected contract is removed
+		_, err = enc2.StorePayload(tamper(pushed))
+		if mode == api.PrivateStateValidation {
+			if api.CodeOf(err) != api.Unauthorized {
+				t.Errorf("Invalid security hash should be unauthorized, actual: %v", err)
+			}
+		} else {
+			if err != nil {
+				t.Fatal(err)
+			}
+			if privacy, err = enc2.Privacy(digest); err != nil {
+				t.Fatal(err)
+			}
+			if len(privacy.AffectedContracts) != 0 {
+				t.Errorf("Invalid affected contract should be removed: %+v", privacy)
+			}
+			if err = enc2.Delete(&digest); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if _, err = enc2.StorePayload(pushed); err != nil {
+			t.Fatalf("Valid payload of mode %d should be stored, actual: %v", mode, err)
+		}
+		if privacy, err = enc2.Privacy(digest); err != nil {
+			t.Fatal(err)
+		}
+		if privacy.Mode != mode || len(privacy.AffectedContracts) != 1 {
+			t.Errorf("Unexpected privacy metadata of mode %d: %+v", mode, privacy)
+		}
+	}
+
+	// Private state validation requires every affected contract to be known to the recipient
+	contract, err := enc.StoreWithPrivacy(
+		&message, []byte{}, [][]byte{rcpt1}, affecting(api.PrivateStateValidation))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, pushed, err := send(affecting(api.PrivateStateValidation, contract))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = enc2.StorePayload(pushed); api.CodeOf(err) != api.Unauthorized {
+		t.Errorf("Unknown affected contract should be unauthorized, actual: %v", err)
+	}
+
+	// and to have the same participants
+	contract, err = enc.StoreWithPrivacy(
+		&message, []byte{}, [][]byte{}, affecting(api.PrivateStateValidation))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = send(affecting(api.PrivateStateValidation, contract))
+	if api.CodeOf(err) != api.Unauthorized {
+		t.Errorf("Affected contract with other participants should be unauthorized, actual: %v", err)
+	}
+}
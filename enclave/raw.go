@@ -0,0 +1,85 @@
+package enclave
+
+import (
+	"encoding/base64"
+	"github.com/blk-io/crux/api"
+	"github.com/blk-io/crux/storage"
+	"github.com/blk-io/crux/utils"
+	"github.com/kevinburke/nacl"
+	"golang.org/x/net/context"
+)
+
+// Raw payloads are encrypted for their sender only, until their transaction has been signed and
+// they are sent to its recipients. They are stored apart from other payloads, so cannot be
+// retrieved or resent, keyed by the same digest they are sent under.
+var rawPrefix = append(append([]byte{}, storage.ReservedPrefix...), "raw/"...)
+
+func rawKey(digestHash []byte) []byte {
+	return indexKey(rawPrefix, digestHash, nil)
+}
+
+// StoreRaw encrypts a payload for its sender only, which must be hosted by this node, without
+// distributing it. The hash of the encrypted payload is returned, which the payload is sent under
+// by SendSignedTx.
+func (s *SecureEnclave) StoreRaw(message *[]byte, sender []byte) ([]byte, error) {
+	senderPubKey, senderPrivKey, err := s.resolveSender(sender)
+	if err != nil {
+		return nil, err
+	}
+
+	epl, masterKey := createEncryptedPayload(message, senderPubKey)
+	sharedKey := s.resolveSharedKey(senderPrivKey, senderPubKey, senderPubKey)
+	epl.RecipientBoxes = [][]byte{sealPayload(epl.RecipientNonce, masterKey, sharedKey)}
+
+	digestHash := utils.Sha3Hash(epl.CipherText)
+	encoded := api.EncodePayloadWithRecipients(epl, [][]byte{(*senderPubKey)[:]})
+	if err = s.Db.Write(context.Background(), rawKey(digestHash), encoded); err != nil {
+		return nil, api.WrapError(api.Internal, err, "unable to store raw payload")
+	}
+	return digestHash, nil
+}
+
+// SendSignedTx sends the raw payload with digestHash to recipients, or the other members of its
+// privacy group, as Store would have done. Its master key is sealed for the recipients, so the
+// payload is stored and distributed under the same digest. The raw payload is then removed.
+func (s *SecureEnclave) SendSignedTx(
+	digestHash []byte, recipients [][]byte, privacy api.PrivacyMetadata) ([]byte, error) {
+
+	ctx := context.Background()
+	encoded, err := s.Db.Read(ctx, rawKey(digestHash))
+	if err == storage.ErrNotFound {
+		return nil, api.NewError(api.NotFound,
+			"raw payload %s not found", base64.StdEncoding.EncodeToString(digestHash))
+	} else if err != nil {
+		return nil, api.WrapError(api.Internal, err, "unable to read raw payload")
+	}
+
+	epl, senders, err := api.ParsePayloadWithRecipients(encoded)
+	if err != nil {
+		return nil, api.WrapError(api.Internal, err, "unable to decode raw payload")
+	}
+	senderPubKey, senderPrivKey, err := s.resolveSender((*epl.Sender)[:])
+	if err != nil {
+		return nil, err
+	}
+	masterKey, ok := s.openMasterKey(epl, senders)
+	if !ok {
+		return nil, api.NewError(api.Internal, "unable to open master key of raw payload")
+	}
+
+	recipients, err = s.resolveRecipients(senderPubKey, recipients, privacy)
+	if err != nil {
+		return nil, err
+	}
+	// The sender's box was sealed with the current nonce, which is not reused for recipients
+	epl.RecipientNonce = nacl.NewNonce()
+	digestHash, err = s.store(epl, masterKey, senderPubKey, senderPrivKey, recipients, privacy)
+	if err != nil {
+		return digestHash, err
+	}
+
+	if err = s.Db.Delete(ctx, rawKey(digestHash)); err != nil {
+		return digestHash, api.WrapError(api.Internal, err, "unable to remove raw payload")
+	}
+	return digestHash, nil
+}
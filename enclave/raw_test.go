@@ -0,0 +1,86 @@
+package enclave
+
+import (
+	"bytes"
+	"github.com/blk-io/crux/api"
+	"github.com/blk-io/crux/storage"
+	"github.com/kevinburke/nacl"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestStoreRawAndSendSignedTx(t *testing.T) {
+	dbPath, err := ioutil.TempDir("", "TestStoreRawAndSendSignedTx")
+	if err != nil {
+		t.Fatal(err)
+	} else {
+		defer os.RemoveAll(dbPath)
+	}
+
+	enc, rcpt1 := initIndexedEnclave(t, dbPath)
+	mockClient := enc.client.(*MockClient)
+
+	// A second enclave, hosting rcpt1
+	db2, err := storage.InitLevelDb(path.Join(dbPath, "db2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pi := api.CreatePartyInfo(
+		"http://localhost:8001", []string{"http://localhost:8000"}, []nacl.Key{enc.PubKeys[0]},
+		&MockClient{})
+	enc2 := Init(db2, []string{"testdata/rcpt1.pub"}, []string{"testdata/rcpt1"}, pi,
+		&MockClient{}, false)
+
+	if _, err = enc.StoreRaw(&message, rcpt1); api.CodeOf(err) != api.Unauthorized {
+		t.Errorf("Storing a raw payload for a key not hosted should be unauthorized, actual: %v",
+			err)
+	}
+
+	digest, err := enc.StoreRaw(&message, []byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Raw payloads are neither distributed nor retrievable
+	if mockClient.reqCount() != 0 {
+		t.Errorf("Raw payload should not be pushed, %d requests made", mockClient.reqCount())
+	}
+	if _, err = enc.RetrieveDefault(&digest); api.CodeOf(err) != api.NotFound {
+		t.Errorf("Raw payload should not be retrievable, actual: %v", err)
+	}
+
+	sent, err := enc.SendSignedTx(digest, [][]byte{rcpt1}, api.PrivacyMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(sent, digest) {
+		t.Errorf("Expected payload to be sent under digest %x, actual: %x", digest, sent)
+	}
+	returned, err := enc.RetrieveDefault(&digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(returned, message) {
+		t.Errorf("Sender retrieved %v, expected %v", returned, message)
+	}
+
+	if mockClient.reqCount() != 1 {
+		t.Fatalf("Expected payload to be pushed to rcpt1, %d requests made", mockClient.reqCount())
+	}
+	if _, err = enc2.StorePayload(mockClient.requests[0]); err != nil {
+		t.Fatal(err)
+	}
+	if returned, err = enc2.Retrieve(&digest, &rcpt1); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(returned, message) {
+		t.Errorf("Recipient retrieved %v, expected %v", returned, message)
+	}
+
+	// A raw payload is only sent once
+	_, err = enc.SendSignedTx(digest, [][]byte{rcpt1}, api.PrivacyMetadata{})
+	if api.CodeOf(err) != api.NotFound {
+		t.Errorf("Sending a raw payload twice should not find it, actual: %v", err)
+	}
+}
@@ -0,0 +1,252 @@
+package enclave
+
+import (
+	"encoding/base64"
+	"expvar"
+	"fmt"
+	"github.com/blk-io/crux/storage"
+	"github.com/blk-io/crux/utils"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RetentionRule limits how long payloads are kept. A rule with a Key applies to the payloads
+// sent by or to that public key, otherwise it applies to all payloads.
+type RetentionRule struct {
+	Key      []byte
+	MaxAge   time.Duration // Payloads received longer ago expire, unless zero
+	MaxCount int           // Payloads beyond the most recently received MaxCount expire, unless zero
+}
+
+// CollectReport is the result of collecting expired payloads.
+type CollectReport struct {
+	Expired int   // The number of payloads which expired
+	Deleted int   // The number of expired payloads deleted
+	Bytes   int64 // The size of the deleted payloads, or of the expired payloads in a dry run
+}
+
+// collectBatchSize is the number of expired payloads deleted in each batch by Collect.
+const collectBatchSize = 100
+
+// retentionMetrics are published via expvar under crux.retention.
+var retentionMetrics = expvar.NewMap("crux.retention")
+
+// ParseRetentionRules parses comma separated retention rules of the form
+// [<base64 public key>:]<limit>, where the limit is either a maximum age such as 720h, or a
+// maximum number of payloads.
+func ParseRetentionRules(spec string) ([]RetentionRule, error) {
+	var rules []RetentionRule
+	for _, field := range strings.Split(spec, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		var rule RetentionRule
+		limit := field
+		if i := strings.LastIndex(field, ":"); i >= 0 {
+			key, err := base64.StdEncoding.DecodeString(field[:i])
+			if err == nil {
+				_, err = utils.ToKey(key)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid public key in retention rule %s: %v", field, err)
+			}
+			rule.Key, limit = key, field[i+1:]
+		}
+
+		if count, err := strconv.Atoi(limit); err == nil && count > 0 {
+			rule.MaxCount = count
+		} else if age, err := time.ParseDuration(limit); err == nil && age > 0 {
+			rule.MaxAge = age
+		} else {
+			return nil, fmt.Errorf(
+				"invalid limit in retention rule %s, expected a positive age or count", field)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// Collect deletes the payloads in db which have expired under any of the rules at now, in
+// batches, along with their metadata and index entries. If dryRun is true, the expired payloads
+// are only reported.
+func Collect(
+	ctx context.Context, db storage.DataStore, rules []RetentionRule, now time.Time,
+	dryRun bool) (CollectReport, error) {
+
+	var report CollectReport
+	expired, err := expiredDigests(ctx, db, rules, now)
+	if err != nil {
+		return report, err
+	}
+	report.Expired = len(expired)
+
+	batch := new(storage.Batch)
+	var batchBytes int64
+	var batchDigests int
+	for i, digest := range expired {
+		if dryRun {
+			encoded, err := db.Read(ctx, digest)
+			if err == nil {
+				report.Bytes += int64(len(encoded))
+			} else if err != storage.ErrNotFound {
+				return report, err
+			}
+			log.WithField("digest", base64.StdEncoding.EncodeToString(digest)).Debug(
+				"Payload has expired")
+			continue
+		}
+
+		size, err := deletePayload(ctx, db, batch, digest)
+		if err != nil {
+			return report, err
+		}
+		if size >= 0 {
+			batchBytes += int64(size)
+			batchDigests++
+		}
+		if batch.Len() > 0 && (batchDigests == collectBatchSize || i == len(expired)-1) {
+			if err = db.WriteBatch(ctx, batch); err != nil {
+				return report, err
+			}
+			report.Deleted += batchDigests
+			report.Bytes += batchBytes
+			batch, batchBytes, batchDigests = new(storage.Batch), 0, 0
+		}
+	}
+	return report, nil
+}
+
+// expiredDigests returns the digests of the payloads in db which have expired under any of the
+// rules at now.
+func expiredDigests(
+	ctx context.Context, db storage.DataStore, rules []RetentionRule, now time.Time) (
+	[][]byte, error) {
+
+	var expired [][]byte
+	seen := make(map[string]bool)
+	add := func(digests [][]byte) {
+		for _, digest := range digests {
+			if !seen[string(digest)] {
+				seen[string(digest)] = true
+				expired = append(expired, digest)
+			}
+		}
+	}
+
+	for _, rule := range rules {
+		var digests [][]byte
+		var err error
+		if rule.Key == nil {
+			digests, err = expiredReceived(ctx, db, rule, now)
+		} else {
+			digests, err = expiredForKey(ctx, db, rule, now)
+		}
+		if err != nil {
+			return nil, err
+		}
+		add(digests)
+	}
+	return expired, nil
+}
+
+// expiredReceived returns the digests of all payloads which have expired under rule, using the
+// received time index.
+func expiredReceived(
+	ctx context.Context, db storage.DataStore, rule RetentionRule, now time.Time) (
+	[][]byte, error) {
+
+	if rule.MaxAge > 0 {
+		return digestsReceived(ctx, db, time.Unix(0, 0), now.Add(-rule.MaxAge))
+	}
+
+	digests, err := timeIndexed(ctx, db, storage.PrefixRange(timeIndexPrefix))
+	if err != nil || len(digests) <= rule.MaxCount {
+		return nil, err
+	}
+	return digests[:len(digests)-rule.MaxCount], nil
+}
+
+// expiredForKey returns the digests of the payloads sent by or to the key of rule which have
+// expired under it.
+func expiredForKey(
+	ctx context.Context, db storage.DataStore, rule RetentionRule, now time.Time) (
+	[][]byte, error) {
+
+	type receivedPayload struct {
+		digest   []byte
+		received int64
+	}
+	var payloads []receivedPayload
+	seen := make(map[string]bool)
+	for _, prefix := range [][]byte{senderIndexPrefix, recipientIndexPrefix} {
+		digests, err := indexedDigests(ctx, db, indexKey(prefix, rule.Key, nil))
+		if err != nil {
+			return nil, err
+		}
+		for _, digest := range digests {
+			if seen[string(digest)] {
+				continue
+			}
+			seen[string(digest)] = true
+
+			// Payloads without a received time are never expired by age
+			received := now.UnixNano()
+			receivedAt, err := readReceived(ctx, db, digest)
+			if err == nil {
+				received = receivedAt.UnixNano()
+			} else if err != storage.ErrNotFound {
+				return nil, err
+			}
+			payloads = append(payloads, receivedPayload{digest, received})
+		}
+	}
+	sort.Slice(payloads, func(i, j int) bool { return payloads[i].received < payloads[j].received })
+
+	var expired [][]byte
+	cutoff := now.Add(-rule.MaxAge).UnixNano()
+	for i, payload := range payloads {
+		if (rule.MaxAge > 0 && payload.received < cutoff) ||
+			(rule.MaxCount > 0 && i < len(payloads)-rule.MaxCount) {
+			expired = append(expired, payload.digest)
+		}
+	}
+	return expired, nil
+}
+
+// StartCollector collects the SecureEnclave's expired payloads under rules in the background,
+// now and every interval. If dryRun is true, expired payloads are only reported.
+func (s *SecureEnclave) StartCollector(rules []RetentionRule, interval time.Duration, dryRun bool) {
+	go func() {
+		for {
+			s.collect(rules, dryRun)
+			time.Sleep(interval)
+		}
+	}()
+}
+
+func (s *SecureEnclave) collect(rules []RetentionRule, dryRun bool) {
+	start := time.Now()
+	report, err := Collect(context.Background(), s.Db, rules, start, dryRun)
+	retentionMetrics.Add("runs", 1)
+	if err != nil {
+		retentionMetrics.Add("errors", 1)
+		log.Errorf("Unable to collect expired payloads after deleting %d: %v", report.Deleted, err)
+	}
+	retentionMetrics.Add("deleted", int64(report.Deleted))
+	if !dryRun {
+		retentionMetrics.Add("bytesReclaimed", report.Bytes)
+	}
+
+	if dryRun {
+		log.Infof("%d payloads of %d bytes have expired, not deleted as this is a dry run",
+			report.Expired, report.Bytes)
+	} else if report.Deleted > 0 {
+		log.Infof("Deleted %d expired payloads of %d bytes in %v",
+			report.Deleted, report.Bytes, time.Since(start))
+	}
+}
@@ -0,0 +1,167 @@
+package enclave
+
+import (
+	"encoding/base64"
+	"github.com/blk-io/crux/api"
+	"github.com/blk-io/crux/storage"
+	"golang.org/x/net/context"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseRetentionRules(t *testing.T) {
+	encodedKey, err := ioutil.ReadFile("testdata/rcpt1.pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b64Key := string(encodedKey)
+	key, err := base64.StdEncoding.DecodeString(b64Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules, err := ParseRetentionRules(" 720h, 1000," + b64Key + ":24h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []RetentionRule{
+		{MaxAge: 720 * time.Hour},
+		{MaxCount: 1000},
+		{Key: key, MaxAge: 24 * time.Hour},
+	}
+	if !reflect.DeepEqual(rules, expected) {
+		t.Errorf("Parsed %+v, expected %+v", rules, expected)
+	}
+
+	invalidRules := []string{"forever", "0", "-1h", "notakey:1h", b64Key + ":", "c2hvcnQ=:1h"}
+	for _, invalid := range invalidRules {
+		if _, err = ParseRetentionRules(invalid); err == nil {
+			t.Errorf("Invalid retention rule %q should not be parsed", invalid)
+		}
+	}
+}
+
+func TestCollect(t *testing.T) {
+	dbPath, err := ioutil.TempDir("", "TestCollect")
+	if err != nil {
+		t.Fatal(err)
+	} else {
+		defer os.RemoveAll(dbPath)
+	}
+	ctx := context.Background()
+
+	enc, rcpt1 := initIndexedEnclave(t, dbPath)
+	var digests [][]byte
+	for _, recipients := range [][][]byte{{rcpt1}, {rcpt1}, {}} {
+		digest, err := enc.Store(&message, []byte{}, recipients)
+		if err != nil {
+			t.Fatal(err)
+		}
+		digests = append(digests, digest)
+	}
+
+	collect := func(rules []RetentionRule, now time.Time, dryRun bool, expected CollectReport) {
+		report, err := Collect(ctx, enc.Db, rules, now, dryRun)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.Expired != expected.Expired || report.Deleted != expected.Deleted ||
+			(report.Expired > 0) != (report.Bytes > 0) {
+			t.Errorf("Expected %+v, actual: %+v", expected, report)
+		}
+	}
+	checkExists := func(digest []byte, expected bool) {
+		_, err := enc.Db.Read(ctx, digest)
+		if (err == nil) != expected {
+			t.Errorf("Payload %x should exist %t, read returned %v", digest, expected, err)
+		}
+		_, err = enc.Db.Read(ctx, metadataKey(digest))
+		if (err == nil) != expected {
+			t.Errorf("Metadata of %x should exist %t, read returned %v", digest, expected, err)
+		}
+	}
+
+	// Only the most recent payload sent to rcpt1 is kept
+	keyRules := []RetentionRule{{Key: rcpt1, MaxCount: 1}}
+	collect(keyRules, time.Now(), true, CollectReport{Expired: 1})
+	checkExists(digests[0], true)
+	collect(keyRules, time.Now(), false, CollectReport{Expired: 1, Deleted: 1})
+	checkExists(digests[0], false)
+	checkIndexed(t, enc.Db, indexKey(recipientIndexPrefix, rcpt1, nil), digests[0], false)
+	checkIndexed(t, enc.Db, indexKey(recipientIndexPrefix, rcpt1, nil), digests[1], true)
+
+	collect([]RetentionRule{{MaxCount: 1}}, time.Now(), false, CollectReport{Expired: 1, Deleted: 1})
+	checkExists(digests[1], false)
+	checkExists(digests[2], true)
+
+	ageRules := []RetentionRule{{MaxAge: time.Hour}}
+	collect(ageRules, time.Now(), false, CollectReport{})
+	collect(ageRules, time.Now().Add(2*time.Hour), false, CollectReport{Expired: 1, Deleted: 1})
+	checkExists(digests[2], false)
+	checkReceived(t, enc.Db, time.Unix(0, 0), nil)
+
+	keys := iterateKeys(t, enc.Db)
+	if len(keys) != 0 {
+		t.Errorf("Expected the store to be empty, actual: %q", keys)
+	}
+}
+
+// The dir backend does not iterate in key order, so the time index has to be sorted.
+func TestCollectDir(t *testing.T) {
+	dbPath, err := ioutil.TempDir("", "TestCollectDir")
+	if err != nil {
+		t.Fatal(err)
+	} else {
+		defer os.RemoveAll(dbPath)
+	}
+	ctx := context.Background()
+
+	db, err := storage.InitDirDb(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now().Add(-time.Hour)
+	var digests [][]byte
+	batch := new(storage.Batch)
+	for i := 0; i < 20; i++ {
+		digest := []byte{byte(255 - i*13), byte(i)}
+		batch.Put(digest, message)
+		indexPayload(batch, digest, api.EncryptedPayload{}, nil,
+			start.Add(time.Duration(i)*time.Minute))
+		digests = append(digests, digest)
+	}
+	if err = db.WriteBatch(ctx, batch); err != nil {
+		t.Fatal(err)
+	}
+	checkReceived(t, db, start, digests)
+
+	report, err := Collect(ctx, db, []RetentionRule{{MaxCount: 5}}, time.Now(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Deleted != 15 {
+		t.Errorf("Expected 15 payloads to be deleted, actual: %+v", report)
+	}
+	checkReceived(t, db, start, digests[15:])
+	for i, digest := range digests {
+		_, err = db.Read(ctx, digest)
+		if (err == nil) != (i >= 15) {
+			t.Errorf("Payload %d should exist %t, read returned %v", i, i >= 15, err)
+		}
+	}
+}
+
+// iterateKeys returns all keys in db.
+func iterateKeys(t *testing.T, db storage.DataStore) []string {
+	var keys []string
+	err := db.Iterate(context.Background(), storage.All, func(key, value []byte) error {
+		keys = append(keys, string(key))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
@@ -0,0 +1,158 @@
+package enclave
+
+import (
+	"bytes"
+	"encoding/base64"
+	"github.com/blk-io/crux/api"
+	"github.com/blk-io/crux/storage"
+	"github.com/blk-io/crux/utils"
+	"github.com/kevinburke/nacl"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"time"
+)
+
+// Share gives additional recipients access to a payload sent by from, which must be its sender
+// and hosted by this node, defaulting to its first key. The master key of the payload is sealed
+// for each recipient which does not already have access, the stored payload is updated with their
+// boxes, and their copies are pushed to them. The delivery status of each added recipient is
+// returned.
+func (s *SecureEnclave) Share(
+	digestHash, from []byte, recipients [][]byte) ([]api.RecipientStatus, error) {
+
+	for _, recipient := range recipients {
+		if _, err := utils.ToKey(recipient); err != nil {
+			return nil, api.FieldError("to", err, "invalid recipient public key")
+		}
+	}
+	senderPubKey, senderPrivKey, err := s.resolveSender(from)
+	if err != nil {
+		return nil, err
+	}
+	epl, privacy, added, err := s.addRecipients(digestHash, senderPubKey, senderPrivKey, recipients)
+	if err != nil {
+		return nil, err
+	}
+
+	b64Digest := base64.StdEncoding.EncodeToString(digestHash)
+	statuses := make([]api.RecipientStatus, len(added))
+	// The boxes of the added recipients follow those of the existing ones
+	boxes := epl.RecipientBoxes[len(epl.RecipientBoxes)-len(added):]
+	for i, recipient := range added {
+		recipientEpl := api.EncryptedPayload{
+			Sender:         senderPubKey,
+			CipherText:     epl.CipherText,
+			Nonce:          epl.Nonce,
+			RecipientBoxes: [][]byte{boxes[i]},
+			RecipientNonce: epl.RecipientNonce,
+		}
+		err = s.publishPayload(recipientEpl, recipient, privacy)
+		s.recordDelivery(digestHash, recipient, err)
+
+		statuses[i] = api.RecipientStatus{
+			PublicKey: base64.StdEncoding.EncodeToString(recipient),
+			Status:    api.Delivered,
+			Updated:   time.Now(),
+		}
+		if err != nil {
+			statuses[i].Status = api.Failed
+			statuses[i].Error = err.Error()
+		}
+		log.WithFields(log.Fields{
+			"digest": b64Digest, "recipient": statuses[i].PublicKey, "status": statuses[i].Status,
+		}).Info("Shared payload")
+	}
+	return statuses, nil
+}
+
+// addRecipients seals the master key of the stored payload with digest for each of recipients
+// which does not already have access, and stores it with their boxes, indexing it by them and
+// adding them to its metadata. The updated payload is returned with the added recipients.
+//
+// The payload is read and written under metadataMu, so that concurrent shares of it are not lost.
+func (s *SecureEnclave) addRecipients(
+	digest []byte, senderPubKey, senderPrivKey nacl.Key, recipients [][]byte) (
+	api.EncryptedPayload, api.PrivacyMetadata, [][]byte, error) {
+
+	var epl api.EncryptedPayload
+	var privacy api.PrivacyMetadata
+
+	s.metadataMu.Lock()
+	defer s.metadataMu.Unlock()
+
+	encoded, err := s.readPayload(&digest)
+	if err != nil {
+		return epl, privacy, nil, err
+	}
+	epl, existing, privacy, err := api.ParsePayloadWithPrivacy(*encoded)
+	if err != nil {
+		return epl, privacy, nil, api.WrapError(api.Internal, err, "unable to decode payload")
+	}
+	if len(existing) == 0 {
+		return epl, privacy, nil, api.NewError(
+			api.Unauthorized, "payload was not sent by this node")
+	}
+	if !bytes.Equal((*senderPubKey)[:], (*epl.Sender)[:]) {
+		return epl, privacy, nil, api.NewError(
+			api.Unauthorized, "only the sender of a payload can share it")
+	}
+	if privacy.Mode == api.PrivateStateValidation {
+		// Its participants are bound to the contracts it affects
+		return epl, privacy, nil, api.NewError(
+			api.Unauthorized, "payloads with private state validation cannot be shared")
+	}
+
+	var added [][]byte
+	for _, recipient := range recipients {
+		if !isParticipant(existing, recipient) && !isParticipant(added, recipient) &&
+			!bytes.Equal(recipient, (*senderPubKey)[:]) {
+			added = append(added, recipient)
+		}
+	}
+	if len(added) == 0 {
+		return epl, privacy, nil, nil
+	}
+
+	masterKey, ok := s.openMasterKey(epl, existing)
+	if !ok {
+		return epl, privacy, nil, api.NewError(
+			api.Internal, "unable to open master key of payload")
+	}
+	for _, recipient := range added {
+		recipientKey, _ := utils.ToKey(recipient)
+		sharedKey := s.resolveSharedKey(senderPrivKey, senderPubKey, recipientKey)
+		epl.RecipientBoxes = append(
+			epl.RecipientBoxes, sealPayload(epl.RecipientNonce, masterKey, sharedKey))
+	}
+
+	ctx := context.Background()
+	batch := new(storage.Batch)
+	batch.Put(digest, api.EncodePayloadWithPrivacy(epl, append(existing, added...), privacy))
+	for _, recipient := range added {
+		batch.Put(indexKey(recipientIndexPrefix, recipient, digest), []byte{})
+	}
+
+	meta, err := readMetadata(ctx, s.Db, digest)
+	if err == nil {
+		now := time.Now()
+		for _, recipient := range added {
+			meta.Recipients = append(meta.Recipients, api.RecipientStatus{
+				PublicKey: base64.StdEncoding.EncodeToString(recipient),
+				Status:    api.Pending,
+				Updated:   now,
+			})
+		}
+		err = putMetadata(batch, digest, meta)
+	} else if err == storage.ErrNotFound {
+		// Stored before metadata was recorded
+		err = nil
+	}
+
+	if err == nil {
+		err = s.Db.WriteBatch(ctx, batch)
+	}
+	if err != nil {
+		return epl, privacy, nil, api.WrapError(api.Internal, err, "unable to store shared payload")
+	}
+	return epl, privacy, added, nil
+}
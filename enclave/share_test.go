@@ -0,0 +1,169 @@
+package enclave
+
+import (
+	"bytes"
+	"github.com/blk-io/crux/api"
+	"github.com/blk-io/crux/storage"
+	"github.com/kevinburke/nacl"
+	"golang.org/x/net/context"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"testing"
+)
+
+func TestShare(t *testing.T) {
+	dbPath, err := ioutil.TempDir("", "TestShare")
+	if err != nil {
+		t.Fatal(err)
+	} else {
+		defer os.RemoveAll(dbPath)
+	}
+
+	enc, rcpt1 := initIndexedEnclave(t, dbPath)
+	mockClient := enc.client.(*MockClient)
+	sender := (*enc.PubKeys[0])[:]
+
+	// A second enclave, hosting rcpt1
+	db2, err := storage.InitLevelDb(path.Join(dbPath, "db2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pi := api.CreatePartyInfo(
+		"http://localhost:8001", []string{"http://localhost:8000"}, []nacl.Key{enc.PubKeys[0]},
+		&MockClient{})
+	enc2 := Init(db2, []string{"testdata/rcpt1.pub"}, []string{"testdata/rcpt1"}, pi,
+		&MockClient{}, false)
+
+	digest, err := enc.Store(&message, sender, [][]byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = enc.Share(digest, rcpt1, [][]byte{rcpt1}); api.CodeOf(err) != api.Unauthorized {
+		t.Errorf("Sharing by a key not hosted should be unauthorized, actual: %v", err)
+	}
+	_, err = enc.Share(digest, sender, [][]byte{{1, 2, 3}})
+	if api.CodeOf(err) != api.InvalidArgument {
+		t.Errorf("Sharing with an invalid key should be rejected, actual: %v", err)
+	}
+
+	statuses, err := enc.Share(digest, sender, [][]byte{rcpt1, sender})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != 1 || statuses[0].Status != api.Delivered {
+		t.Errorf("Expected the payload to be delivered to rcpt1 only, actual: %+v", statuses)
+	}
+	checkIndexed(t, enc.Db, indexKey(recipientIndexPrefix, rcpt1, nil), digest, true)
+
+	meta, err := enc.Metadata(digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(meta.Recipients) != 1 || meta.Recipients[0].Status != api.Delivered {
+		t.Errorf("Expected metadata to record delivery to rcpt1, actual: %+v", meta.Recipients)
+	}
+
+	// The sender can still retrieve the payload, and rcpt1 receives its own copy
+	returned, err := enc.RetrieveDefault(&digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(returned, message) {
+		t.Errorf("Sender retrieved %v, expected %v", returned, message)
+	}
+	if mockClient.reqCount() != 1 {
+		t.Fatalf("Expected payload to be pushed to rcpt1, %d requests made", mockClient.reqCount())
+	}
+	if _, err = enc2.StorePayload(mockClient.requests[0]); err != nil {
+		t.Fatal(err)
+	}
+	if returned, err = enc2.Retrieve(&digest, &rcpt1); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(returned, message) {
+		t.Errorf("Recipient retrieved %v, expected %v", returned, message)
+	}
+
+	// Only the sender may share a payload, and existing recipients are not added again
+	if _, err = enc2.Share(digest, rcpt1, [][]byte{sender}); api.CodeOf(err) != api.Unauthorized {
+		t.Errorf("Sharing a received payload should be unauthorized, actual: %v", err)
+	}
+	statuses, err = enc.Share(digest, nil, [][]byte{rcpt1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != 0 || mockClient.reqCount() != 1 {
+		t.Errorf("Expected sharing with an existing recipient to do nothing, actual: %+v", statuses)
+	}
+}
+
+func TestSharePrivateStateValidation(t *testing.T) {
+	dbPath, err := ioutil.TempDir("", "TestSharePrivateStateValidation")
+	if err != nil {
+		t.Fatal(err)
+	} else {
+		defer os.RemoveAll(dbPath)
+	}
+
+	enc, rcpt1 := initIndexedEnclave(t, dbPath)
+	rcpt2, err := loadPubKeys([]string{"testdata/rcpt2.pub"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	privacy := api.PrivacyMetadata{Mode: api.PrivateStateValidation, ExecHash: []byte("3x3c")}
+	digest, err := enc.StoreWithPrivacy(&message, []byte{}, [][]byte{rcpt1}, privacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = enc.Share(digest, nil, [][]byte{(*rcpt2[0])[:]})
+	if api.CodeOf(err) != api.Unauthorized {
+		t.Errorf("Sharing a payload with private state validation should be rejected, actual: %v",
+			err)
+	}
+}
+
+func TestShareConcurrently(t *testing.T) {
+	dbPath, err := ioutil.TempDir("", "TestShareConcurrently")
+	if err != nil {
+		t.Fatal(err)
+	} else {
+		defer os.RemoveAll(dbPath)
+	}
+
+	enc, rcpt1 := initIndexedEnclave(t, dbPath)
+	digest, err := enc.Store(&message, nil, [][]byte{rcpt1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const shares = 10
+	var wg sync.WaitGroup
+	for i := 0; i < shares; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			recipient := bytes.Repeat([]byte{byte(i + 1)}, nacl.KeySize)
+			if _, err := enc.Share(digest, nil, [][]byte{recipient}); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// Every share is kept, with a box for each recipient
+	encoded, err := enc.Db.Read(context.Background(), digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	epl, recipients, err := api.ParsePayloadWithRecipients(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recipients) != shares+1 || len(epl.RecipientBoxes) != shares+1 {
+		t.Errorf("Expected %d recipients and boxes, actual: %d and %d",
+			shares+1, len(recipients), len(epl.RecipientBoxes))
+	}
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"expvar"
+	"github.com/blk-io/crux/api"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strings"
+)
+
+// Administrative endpoints, which are only served over IPC.
+const (
+	backup   = "/backup"
+	metadata = "/metadata"
+	erase    = "/erase"
+	share    = "/share"
+	metrics  = "/metrics"
+)
+
+// newAdminApi creates the handler for the administrative endpoints.
+func (tm *TransactionManager) newAdminApi() *http.ServeMux {
+	adminServer := http.NewServeMux()
+	adminServer.HandleFunc(backup, tm.backup)
+	adminServer.HandleFunc(metadata, tm.metadata)
+	adminServer.HandleFunc(erase, tm.erase)
+	adminServer.HandleFunc(share, tm.share)
+	// expvar includes the command line, which may contain storage credentials
+	adminServer.Handle(metrics, expvar.Handler())
+	adminServer.HandleFunc(createPrivacyGroup, tm.createPrivacyGroup)
+	adminServer.HandleFunc(findPrivacyGroup, tm.findPrivacyGroup)
+	adminServer.HandleFunc(retrievePrivacyGroup, tm.retrievePrivacyGroup)
+	adminServer.HandleFunc(deletePrivacyGroup, tm.deletePrivacyGroup)
+	return adminServer
+}
+
+// ipcHandler routes requests arriving on the IPC socket when gRPC is enabled. gRPC requests go
+// to the gRPC server and everything else to the administrative endpoints.
+func ipcHandler(grpcServer, adminServer http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+			grpcServer.ServeHTTP(w, r)
+		} else {
+			adminServer.ServeHTTP(w, r)
+		}
+	})
+}
+
+// writeTracker records whether anything has been written to the response.
+type writeTracker struct {
+	http.ResponseWriter
+	written bool
+}
+
+func (w *writeTracker) Write(p []byte) (int, error) {
+	w.written = true
+	return w.ResponseWriter.Write(p)
+}
+
+// backup streams a snapshot of the payload store in the backup format of the storage package.
+func (s *TransactionManager) backup(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	tw := &writeTracker{ResponseWriter: w}
+	count, err := s.Enclave.Backup(req.Context(), tw)
+	if err != nil {
+		if !tw.written {
+			writeError(w, err)
+			return
+		}
+		// The status has already been sent, so abort the response to ensure the client sees
+		// the backup is incomplete
+		log.Errorf("Backup failed after %d records: %v", count, err)
+		panic(http.ErrAbortHandler)
+	}
+	log.Infof("Backed up %d records", count)
+}
+
+// metadata returns the metadata of the payload whose base64 encoded key is given by the key
+// query parameter.
+func (s *TransactionManager) metadata(w http.ResponseWriter, req *http.Request) {
+	key, err := decodeBase64("key", req.URL.Query().Get("key"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	meta, err := s.Enclave.Metadata(key)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(meta)
+}
+
+// erase deletes a payload sent by this node from every node holding a copy, reporting which
+// recipients acknowledged the deletion.
+func (s *TransactionManager) erase(w http.ResponseWriter, req *http.Request) {
+	var eraseReq api.EraseRequest
+	err := json.NewDecoder(req.Body).Decode(&eraseReq)
+	req.Body.Close()
+	if err != nil {
+		invalidBody(w, req, err)
+		return
+	}
+	key, err := decodeBase64("key", eraseReq.Key)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	recipients, err := s.Enclave.Erase(key)
+	var keys [][]byte
+	for _, recipient := range recipients {
+		decoded, _ := base64.StdEncoding.DecodeString(recipient.PublicKey)
+		keys = append(keys, decoded)
+	}
+	audit(s.Enclave, httpCaller(req), api.AuditErase, key, keys, err)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(api.EraseResponse{Key: eraseReq.Key, Recipients: recipients})
+}
+
+// share gives additional recipients access to a payload sent by this node, reporting whether it
+// was delivered to each of them.
+func (s *TransactionManager) share(w http.ResponseWriter, req *http.Request) {
+	var shareReq api.ShareRequest
+	err := json.NewDecoder(req.Body).Decode(&shareReq)
+	req.Body.Close()
+	if err != nil {
+		invalidBody(w, req, err)
+		return
+	}
+	key, err := decodeBase64("key", shareReq.Key)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	from, err := decodeBase64("from", shareReq.From)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	recipients, err := decodeKeys("to", shareReq.To)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	statuses, err := s.Enclave.Share(key, from, recipients)
+	audit(s.Enclave, httpCaller(req), api.AuditShare, key, append([][]byte{from}, recipients...),
+		err)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(api.ShareResponse{Key: shareReq.Key, Recipients: statuses})
+}
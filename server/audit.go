@@ -0,0 +1,92 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"github.com/blk-io/crux/api"
+	"github.com/kevinburke/nacl"
+	"golang.org/x/net/context"
+	grpcmetadata "google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// ipcCaller is the caller of requests made via the IPC socket.
+const ipcCaller = "ipc"
+
+// audit records an operation on the enclave in its audit log, along with the fingerprints of the
+// given public keys and the outcome of the operation.
+func audit(enc Enclave, caller, operation string, digest []byte, keys [][]byte, err error) {
+	entry := &api.AuditEntry{Operation: operation, Caller: caller}
+	if len(digest) > 0 {
+		entry.Digest = base64.StdEncoding.EncodeToString(digest)
+	}
+	for _, key := range keys {
+		if len(key) > 0 {
+			entry.Keys = append(entry.Keys, api.KeyFingerprint(key))
+		}
+	}
+	if err != nil {
+		entry.Error = api.CodeOf(err)
+	}
+	enc.Audit(entry)
+}
+
+// auditPartyInfo applies a party info update, recording the public keys and nodes it adds in the
+// audit log.
+func auditPartyInfo(enc Enclave, caller string, update func()) {
+	_, recipients, parties := enc.GetPartyInfo()
+	known := make(map[[nacl.KeySize]byte]bool, len(recipients))
+	for key := range recipients {
+		known[key] = true
+	}
+	knownParties := len(parties)
+
+	update()
+
+	_, recipients, parties = enc.GetPartyInfo()
+	var added [][]byte
+	for key := range recipients {
+		if !known[key] {
+			added = append(added, append([]byte{}, key[:]...))
+		}
+	}
+	if len(added) > 0 || len(parties) != knownParties {
+		sort.Slice(added, func(i, j int) bool { return bytes.Compare(added[i], added[j]) < 0 })
+		audit(enc, caller, api.AuditPartyInfo, nil, added, nil)
+	}
+}
+
+// httpCaller identifies the caller of an HTTP request by its remote address, and the common name
+// of its client certificate if it has one.
+func httpCaller(req *http.Request) string {
+	if req.RemoteAddr == "" || req.RemoteAddr == "@" {
+		return ipcCaller
+	}
+	if req.TLS != nil && len(req.TLS.PeerCertificates) > 0 {
+		return req.TLS.PeerCertificates[0].Subject.CommonName + "@" + req.RemoteAddr
+	}
+	return req.RemoteAddr
+}
+
+// grpcCaller identifies the caller of a gRPC request, or of a JSON request via the gateway, by its
+// remote address.
+func grpcCaller(ctx context.Context) string {
+	// The gateway appends the remote address of the request to any it was forwarded for
+	if md, ok := grpcmetadata.FromOutgoingContext(ctx); ok {
+		if forwarded := md["x-forwarded-for"]; len(forwarded) > 0 {
+			addrs := strings.Split(forwarded[len(forwarded)-1], ",")
+			return strings.TrimSpace(addrs[len(addrs)-1])
+		}
+	}
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return "unknown"
+	}
+	if addr := p.Addr.String(); addr != "" && addr != "@" {
+		return addr
+	}
+	return ipcCaller
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"github.com/blk-io/crux/api"
+	"github.com/grpc-ecosystem/grpc-gateway/runtime"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"net/http"
+)
+
+var httpStatusCodes = map[api.ErrorCode]int{
+	api.NotFound:        http.StatusNotFound,
+	api.InvalidArgument: http.StatusBadRequest,
+	api.Unauthorized:    http.StatusForbidden,
+	api.Deleted:         http.StatusGone,
+	api.Unavailable:     http.StatusServiceUnavailable,
+	api.Internal:        http.StatusInternalServerError,
+}
+
+var grpcCodes = map[api.ErrorCode]codes.Code{
+	api.NotFound:        codes.NotFound,
+	api.InvalidArgument: codes.InvalidArgument,
+	api.Unauthorized:    codes.PermissionDenied,
+	api.Deleted:         codes.FailedPrecondition,
+	api.Unavailable:     codes.Unavailable,
+	api.Internal:        codes.Internal,
+}
+
+// toApiError converts err into an *api.Error, errors without a code are treated as internal.
+func toApiError(err error) *api.Error {
+	if e, ok := err.(*api.Error); ok {
+		return e
+	}
+	return api.WrapError(api.Internal, err, "internal error")
+}
+
+// writeError writes err to the response as a JSON api.ErrorResponse, with the HTTP status code
+// corresponding to its api.ErrorCode.
+func writeError(w http.ResponseWriter, err error) {
+	apiErr := toApiError(err)
+	log.WithField("code", apiErr.Code).Error(apiErr.Error())
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(httpStatusCodes[apiErr.Code])
+	json.NewEncoder(w).Encode(api.ErrorResponse{
+		Code:    apiErr.Code,
+		Message: apiErr.Error(),
+		Field:   apiErr.Field,
+	})
+}
+
+// grpcError converts err into a gRPC status error with the code corresponding to its
+// api.ErrorCode. Invalid request fields are described with a BadRequest detail.
+func grpcError(err error) error {
+	if err == nil {
+		return nil
+	}
+	apiErr := toApiError(err)
+	log.WithField("code", apiErr.Code).Error(apiErr.Error())
+
+	st := status.New(grpcCodes[apiErr.Code], apiErr.Error())
+	if apiErr.Field != "" {
+		detailed, detailsErr := st.WithDetails(&errdetails.BadRequest{
+			FieldViolations: []*errdetails.BadRequest_FieldViolation{
+				{Field: apiErr.Field, Description: apiErr.Message},
+			},
+		})
+		if detailsErr == nil {
+			st = detailed
+		}
+	}
+	return st.Err()
+}
+
+// gatewayError writes errors returned via the grpc-gateway in the same format as the HTTP API.
+func gatewayError(ctx context.Context, mux *runtime.ServeMux, marshaler runtime.Marshaler,
+	w http.ResponseWriter, req *http.Request, err error) {
+
+	st, ok := status.FromError(err)
+	if !ok {
+		writeError(w, err)
+		return
+	}
+
+	apiErr := api.NewError(api.Internal, "%s", st.Message())
+	for code, grpcCode := range grpcCodes {
+		if grpcCode == st.Code() {
+			apiErr.Code = code
+		}
+	}
+	// The gateway reports requests to paths it does not serve as unimplemented
+	if st.Code() == codes.Unimplemented {
+		apiErr.Code = api.NotFound
+	}
+	for _, detail := range st.Details() {
+		if badRequest, ok := detail.(*errdetails.BadRequest); ok {
+			for _, violation := range badRequest.FieldViolations {
+				apiErr.Field = violation.Field
+			}
+		}
+	}
+	writeError(w, apiErr)
+}
+
+// decodeBase64 decodes the named base64 request field.
+func decodeBase64(field, value string) ([]byte, error) {
+	decoded, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, api.FieldError(field, err, "unable to decode %s: %s", field, value)
+	}
+	return decoded, nil
+}
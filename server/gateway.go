@@ -0,0 +1,45 @@
+package server
+
+import (
+	"github.com/blk-io/chimera-api/chimera"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+// inProcessClient exposes a server as a chimera.ClientClient, allowing the grpc-gateway to invoke
+// it directly rather than dialling back into our own gRPC port.
+type inProcessClient struct {
+	server chimera.ClientServer
+}
+
+func (c *inProcessClient) Version(ctx context.Context, in *chimera.ApiVersion, opts ...grpc.CallOption) (*chimera.ApiVersion, error) {
+	return c.server.Version(ctx, in)
+}
+
+func (c *inProcessClient) Upcheck(ctx context.Context, in *chimera.UpCheckResponse, opts ...grpc.CallOption) (*chimera.UpCheckResponse, error) {
+	return c.server.Upcheck(ctx, in)
+}
+
+func (c *inProcessClient) Send(ctx context.Context, in *chimera.SendRequest, opts ...grpc.CallOption) (*chimera.SendResponse, error) {
+	return c.server.Send(ctx, in)
+}
+
+func (c *inProcessClient) Receive(ctx context.Context, in *chimera.ReceiveRequest, opts ...grpc.CallOption) (*chimera.ReceiveResponse, error) {
+	return c.server.Receive(ctx, in)
+}
+
+func (c *inProcessClient) UpdatePartyInfo(ctx context.Context, in *chimera.PartyInfo, opts ...grpc.CallOption) (*chimera.PartyInfoResponse, error) {
+	return c.server.UpdatePartyInfo(ctx, in)
+}
+
+func (c *inProcessClient) Push(ctx context.Context, in *chimera.PushPayload, opts ...grpc.CallOption) (*chimera.PartyInfoResponse, error) {
+	return c.server.Push(ctx, in)
+}
+
+func (c *inProcessClient) Delete(ctx context.Context, in *chimera.DeleteRequest, opts ...grpc.CallOption) (*chimera.DeleteRequest, error) {
+	return c.server.Delete(ctx, in)
+}
+
+func (c *inProcessClient) Resend(ctx context.Context, in *chimera.ResendRequest, opts ...grpc.CallOption) (*chimera.ResendResponse, error) {
+	return c.server.Resend(ctx, in)
+}
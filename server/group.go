@@ -0,0 +1,174 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/blk-io/crux/api"
+	"net/http"
+)
+
+// Privacy group endpoints, named as Besu expects, which are only served over IPC.
+const (
+	createPrivacyGroup   = "/createPrivacyGroup"
+	findPrivacyGroup     = "/findPrivacyGroup"
+	retrievePrivacyGroup = "/retrievePrivacyGroup"
+	deletePrivacyGroup   = "/deletePrivacyGroup"
+)
+
+// pushPrivacyGroup is the endpoint other nodes distribute privacy groups to.
+const pushPrivacyGroup = "/pushprivacygroup"
+
+// decodeKeys decodes a list of base64 encoded public keys.
+func decodeKeys(field string, b64Keys []string) ([][]byte, error) {
+	keys := make([][]byte, len(b64Keys))
+	for i, b64Key := range b64Keys {
+		key, err := decodeBase64(field, b64Key)
+		if err != nil {
+			return nil, err
+		}
+		keys[i] = key
+	}
+	return keys, nil
+}
+
+// writePrivacyGroup writes a privacy group response, or err if the request failed.
+func writePrivacyGroup(w http.ResponseWriter, group *api.PrivacyGroup, err error) {
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(group)
+}
+
+func (s *TransactionManager) createPrivacyGroup(w http.ResponseWriter, req *http.Request) {
+	var createReq api.CreatePrivacyGroupRequest
+	err := json.NewDecoder(req.Body).Decode(&createReq)
+	req.Body.Close()
+	if err != nil {
+		invalidBody(w, req, err)
+		return
+	}
+	from, err := decodeBase64("from", createReq.From)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	members, err := decodeKeys("members", createReq.Members)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	group, err := s.Enclave.CreatePrivacyGroup(
+		from, createReq.Name, createReq.Description, members)
+	audit(s.Enclave, httpCaller(req), api.AuditCreatePrivacyGroup, groupId(group), members, err)
+	writePrivacyGroup(w, group, err)
+}
+
+func (s *TransactionManager) findPrivacyGroup(w http.ResponseWriter, req *http.Request) {
+	var findReq api.FindPrivacyGroupRequest
+	err := json.NewDecoder(req.Body).Decode(&findReq)
+	req.Body.Close()
+	if err != nil {
+		invalidBody(w, req, err)
+		return
+	}
+	members, err := decodeKeys("addresses", findReq.Addresses)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	groups, err := s.Enclave.FindPrivacyGroups(members)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(groups)
+}
+
+func (s *TransactionManager) retrievePrivacyGroup(w http.ResponseWriter, req *http.Request) {
+	var groupReq api.PrivacyGroupRequest
+	err := json.NewDecoder(req.Body).Decode(&groupReq)
+	req.Body.Close()
+	if err != nil {
+		invalidBody(w, req, err)
+		return
+	}
+	id, err := decodeBase64("privacyGroupId", groupReq.PrivacyGroupId)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	group, err := s.Enclave.PrivacyGroup(id)
+	writePrivacyGroup(w, group, err)
+}
+
+// deletePrivacyGroup responds with the id of the deleted privacy group, as Besu expects.
+func (s *TransactionManager) deletePrivacyGroup(w http.ResponseWriter, req *http.Request) {
+	var groupReq api.PrivacyGroupRequest
+	err := json.NewDecoder(req.Body).Decode(&groupReq)
+	req.Body.Close()
+	if err != nil {
+		invalidBody(w, req, err)
+		return
+	}
+	id, err := decodeBase64("privacyGroupId", groupReq.PrivacyGroupId)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	from, err := decodeBase64("from", groupReq.From)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	_, err = s.Enclave.DeletePrivacyGroup(id, from)
+	audit(s.Enclave, httpCaller(req), api.AuditDeletePrivacyGroup, id, [][]byte{from}, err)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(groupReq.PrivacyGroupId)
+}
+
+func (s *TransactionManager) pushPrivacyGroup(w http.ResponseWriter, req *http.Request) {
+	var groupReq api.PushPrivacyGroupRequest
+	err := json.NewDecoder(req.Body).Decode(&groupReq)
+	req.Body.Close()
+	if err != nil {
+		invalidBody(w, req, err)
+		return
+	}
+
+	fields := []string{"group", "sender", "recipient", "nonce", "proof"}
+	values := []string{
+		groupReq.Group, groupReq.Sender, groupReq.Recipient, groupReq.Nonce, groupReq.Proof}
+	decoded := make([][]byte, len(fields))
+	for i, field := range fields {
+		decoded[i], err = decodeBase64(field, values[i])
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+
+	err = s.Enclave.PushPrivacyGroup(decoded[0], decoded[1], decoded[2], decoded[3], decoded[4])
+	audit(s.Enclave, httpCaller(req), api.AuditPushPrivacyGroup, nil, decoded[1:3], err)
+	if err != nil {
+		writeError(w, err)
+	}
+}
+
+// groupId returns the id of group, or nil if it was not created.
+func groupId(group *api.PrivacyGroup) []byte {
+	if group == nil {
+		return nil
+	}
+	id, _ := decodeBase64("privacyGroupId", group.PrivacyGroupId)
+	return id
+}
@@ -1,126 +1,180 @@
 package server
 
 import (
+	"crypto/tls"
 	"fmt"
 	"github.com/blk-io/chimera-api/chimera"
+	"github.com/blk-io/crux/api"
 	"github.com/blk-io/crux/utils"
 	"github.com/grpc-ecosystem/grpc-gateway/runtime"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/net/context"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
 	"net"
 	"net/http"
+	"strings"
 )
 
-func (tm *TransactionManager) startRpcServer(networkInterface string, port int, grpcJsonPort int, ipcPath string, tls bool, certFile, keyFile string) error {
+func (tm *TransactionManager) startRpcServer(networkInterface string, port int, ipcPath string, tls bool, certFile, keyFile string) error {
 	lis, err := utils.CreateIpcSocket(ipcPath)
 	if err != nil {
 		log.Fatalf("failed to listen: %v", err)
 	}
 	s := Server{Enclave: tm.Enclave}
-	grpcServer := grpc.NewServer()
+	grpcServer := newGrpcServer()
 	chimera.RegisterClientServer(grpcServer, &s)
+	RegisterRawTransactionServer(grpcServer, &s)
+	// gRPC clients connect to the IPC socket with h2c, while the administrative endpoints are
+	// plain HTTP requests
+	ipcServer := ipcHandler(grpcServer, tm.newAdminApi())
 	go func() {
-		log.Fatal(grpcServer.Serve(lis))
+		log.Fatal(http.Serve(lis, h2c.NewHandler(requestLogger(ipcServer), &http2.Server{})))
 	}()
 
-	go func() error {
-		var err error
-		if tls {
-			err = tm.startRestServerTLS(networkInterface, port, certFile, keyFile, certFile)
-		} else {
-			err = tm.startRestServer(networkInterface, port)
-		}
-		if grpcJsonPort != -1 {
-			if tls {
-				err = tm.startJsonServerTLS(networkInterface, port, grpcJsonPort, certFile, keyFile, certFile)
-			} else {
-				err = tm.startJsonServer(networkInterface, port, grpcJsonPort)
-			}
-		}
-		if err != nil {
-			log.Fatalf("failed to start gRPC REST server: %s", err)
-		}
-		return err
-	}()
-
-	return err
-}
-
-func (tm *TransactionManager) startJsonServer(networkInterface string, port int, grpcJsonPort int) error {
-	address := fmt.Sprintf("%s:%d", networkInterface, grpcJsonPort)
-	ctx := context.Background()
-	ctx, cancel := context.WithCancel(ctx)
-	defer cancel()
-	mux := runtime.NewServeMux()
-	opts := []grpc.DialOption{grpc.WithInsecure()}
-	err := chimera.RegisterClientHandlerFromEndpoint(ctx, mux, fmt.Sprintf("%s:%d", networkInterface, port), opts)
-	if err != nil {
-		return fmt.Errorf("could not register service: %s", err)
+	if tls {
+		err = tm.startMuxServerTLS(networkInterface, port, certFile, keyFile)
+	} else {
+		err = tm.startMuxServer(networkInterface, port)
 	}
-	log.Printf("starting HTTP/1.1 REST server on %s", address)
-	err = http.ListenAndServe(address, mux)
 	if err != nil {
-		return fmt.Errorf("could not listen on %s due to: %s", address, err)
+		return fmt.Errorf("failed to start gRPC server: %s", err)
 	}
 	return nil
 }
 
-func (tm *TransactionManager) startRestServer(networkInterface string, port int) error {
-	grpcAddress := fmt.Sprintf("%s:%d", networkInterface, port)
-	lis, err := net.Listen("tcp", grpcAddress)
+// startMuxServer serves gRPC, the grpc-gateway JSON API and the legacy HTTP endpoints from a
+// single cleartext port, using h2c for gRPC requests.
+func (tm *TransactionManager) startMuxServer(networkInterface string, port int) error {
+	address := fmt.Sprintf("%s:%d", networkInterface, port)
+	handler, err := tm.newMuxHandler()
 	if err != nil {
-		panic(err)
+		return err
+	}
+
+	lis, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
 	}
-	s := Server{Enclave: tm.Enclave}
-	grpcServer := grpc.NewServer()
-	chimera.RegisterClientServer(grpcServer, &s)
 	go func() {
-		log.Fatal(grpcServer.Serve(lis))
+		log.Fatal(http.Serve(lis, h2c.NewHandler(requestLogger(handler), &http2.Server{})))
 	}()
+	log.Infof("gRPC and HTTP server is running at: %s", address)
 	return nil
 }
 
-func (tm *TransactionManager) startJsonServerTLS(networkInterface string, port int, grpcJsonPort int, certFile, keyFile, ca string) error {
-	address := fmt.Sprintf("%s:%d", networkInterface, grpcJsonPort)
-	ctx := context.Background()
-	ctx, cancel := context.WithCancel(ctx)
-	defer cancel()
-	mux := runtime.NewServeMux()
-	creds, err := credentials.NewServerTLSFromFile(certFile, keyFile)
-	err = chimera.RegisterClientHandlerFromEndpoint(ctx, mux, fmt.Sprintf("%s:%d", networkInterface, port), []grpc.DialOption{grpc.WithTransportCredentials(creds)})
+// startMuxServerTLS serves gRPC, the grpc-gateway JSON API and the legacy HTTP endpoints from a
+// single TLS port. HTTP/2 is negotiated via ALPN for gRPC clients.
+func (tm *TransactionManager) startMuxServerTLS(networkInterface string, port int, certFile, keyFile string) error {
+	err := CheckCertFiles(certFile, keyFile)
 	if err != nil {
-		log.Fatalf("could not register service Ping: %s", err)
 		return err
 	}
-	http.ListenAndServe(address, mux)
-	log.Printf("started HTTPS REST server on %s", address)
-	return nil
-}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate %s and key %s: %s", certFile, keyFile, err)
+	}
 
-func (tm *TransactionManager) startRestServerTLS(networkInterface string, port int, certFile, keyFile, ca string) error {
-	grpcAddress := fmt.Sprintf("%s:%d", networkInterface, port)
-	lis, err := net.Listen("tcp", grpcAddress)
+	address := fmt.Sprintf("%s:%d", networkInterface, port)
+	handler, err := tm.newMuxHandler()
 	if err != nil {
-		log.Fatalf("failed to start gRPC REST server: %s", err)
+		return err
 	}
-	s := Server{Enclave: tm.Enclave}
-	creds, err := credentials.NewServerTLSFromFile(certFile, keyFile)
-	opts := []grpc.ServerOption{grpc.Creds(creds)}
+
+	lis, err := net.Listen("tcp", address)
 	if err != nil {
-		log.Fatalf("failed to load credentials : %v", err)
+		return err
+	}
+	httpServer := &http.Server{
+		Handler: requestLogger(handler),
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			NextProtos:   []string{http2.NextProtoTLS, "http/1.1"},
+		},
 	}
-	grpcServer := grpc.NewServer(opts...)
-	chimera.RegisterClientServer(grpcServer, &s)
 	go func() {
-		log.Fatal(grpcServer.Serve(lis))
+		log.Fatal(httpServer.ServeTLS(lis, "", ""))
 	}()
+	log.Infof("gRPC and HTTPS server is running at: %s", address)
 	return nil
 }
 
+// newGrpcServer creates a gRPC server which permits the keepalive pings sent by the connection
+// pools of other nodes.
+func newGrpcServer() *grpc.Server {
+	return grpc.NewServer(
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             api.KeepaliveTime,
+			PermitWithoutStream: true,
+		}))
+}
+
+// publicServer is the Server registered on the public port. As in HTTP mode, where /delete is
+// only served over IPC, it refuses to delete payloads.
+type publicServer struct {
+	*Server
+}
+
+func (s publicServer) Delete(
+	ctx context.Context, in *chimera.DeleteRequest) (*chimera.DeleteRequest, error) {
+
+	return nil, grpcError(api.NewError(api.Unauthorized, "delete is only served over IPC"))
+}
+
+func (tm *TransactionManager) newMuxHandler() (http.Handler, error) {
+	s := publicServer{&Server{Enclave: tm.Enclave}}
+	grpcServer := newGrpcServer()
+	chimera.RegisterClientServer(grpcServer, s)
+
+	// The gateway invokes the server in-process, so it needs neither a loopback connection nor
+	// client credentials for our own certificate
+	jsonServer := runtime.NewServeMux(runtime.WithProtoErrorHandler(gatewayError))
+	err := chimera.RegisterClientHandlerClient(
+		context.Background(), jsonServer, &inProcessClient{server: s})
+	if err != nil {
+		return nil, fmt.Errorf("could not register JSON gateway: %s", err)
+	}
+
+	// JSON sends and receives, which the gateway would otherwise serve, carry privacy metadata
+	jsonApi := http.NewServeMux()
+	jsonApi.HandleFunc(send, tm.send)
+	jsonApi.HandleFunc(receive, tm.receive)
+	jsonApi.HandleFunc(receiveDetails, tm.receiveDetails)
+
+	return muxHandler(grpcServer, jsonServer, jsonApi, tm.newPublicApi()), nil
+}
+
+// muxHandler routes requests arriving on the public port by their content type. gRPC requests
+// go to the gRPC server, JSON requests go to the grpc-gateway and everything else, such as the
+// binary /push and /partyinfo requests of HTTP peers, goes to the legacy public HTTP API.
+//
+// The gateway has no /resend, /pushdelete or /pushprivacygroup endpoints, so JSON requests to
+// them are handled by the legacy public API. It has no /v2/receive endpoint, and its /send and
+// /receive cannot carry privacy metadata, so JSON requests to them are handled by jsonApi. The
+// other forms of these private endpoints are only served over IPC, as in HTTP mode.
+func muxHandler(grpcServer, jsonServer, jsonApi, httpServer http.Handler) http.Handler {
+	legacyJson := map[string]bool{resend: true, pushDelete: true, pushPrivacyGroup: true}
+	jsonApiPaths := map[string]bool{send: true, receive: true, receiveDetails: true}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType := r.Header.Get("Content-Type")
+		json := strings.HasPrefix(contentType, "application/json")
+		switch {
+		case r.ProtoMajor == 2 && strings.HasPrefix(contentType, "application/grpc"):
+			grpcServer.ServeHTTP(w, r)
+		case json && jsonApiPaths[r.URL.Path]:
+			jsonApi.ServeHTTP(w, r)
+		case json && !legacyJson[r.URL.Path]:
+			jsonServer.ServeHTTP(w, r)
+		default:
+			httpServer.ServeHTTP(w, r)
+		}
+	})
+}
+
 func GetFreePort(networkInterface string) (int, error) {
-	addr, err := net.ResolveTCPAddr("tcp", networkInterface + ":0")
+	addr, err := net.ResolveTCPAddr("tcp", networkInterface+":0")
 	if err != nil {
 		return 0, err
 	}
@@ -0,0 +1,243 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/blk-io/chimera-api/chimera"
+	"github.com/blk-io/crux/api"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"io/ioutil"
+	"net/http"
+	"net/textproto"
+	"strings"
+)
+
+// Endpoints of Quorum's raw private transaction flow, which are only served over IPC.
+const (
+	storeRaw     = "/storeraw"
+	sendSignedTx = "/sendsignedtx"
+)
+
+// processStoreRaw stores a payload encrypted for its sender only.
+func processStoreRaw(enc Enclave, payload []byte, b64from, caller string) ([]byte, error) {
+	var sender []byte
+	var err error
+	if b64from != "" {
+		sender, err = decodeBase64("from", b64from)
+		if err != nil {
+			return nil, err
+		}
+	}
+	key, err := enc.StoreRaw(&payload, sender)
+	audit(enc, caller, api.AuditStoreRaw, key, [][]byte{sender}, err)
+	return key, err
+}
+
+// processSendSignedTx sends the raw payload with key to its recipients.
+func processSendSignedTx(enc Enclave, key []byte, b64recipients []string,
+	privacy api.PrivacyMetadata, caller string) ([]byte, error) {
+
+	if len(key) == 0 {
+		return nil, api.FieldError("hash", nil, "hash not specified")
+	}
+	recipients, err := decodeKeys("to", b64recipients)
+	if err != nil {
+		return nil, err
+	}
+	key, err = enc.SendSignedTx(key, recipients, privacy)
+	audit(enc, caller, api.AuditSendSigned, key, recipients, err)
+	return key, err
+}
+
+func (s *TransactionManager) storeRaw(w http.ResponseWriter, req *http.Request) {
+	var storeReq api.StoreRawRequest
+	err := json.NewDecoder(req.Body).Decode(&storeReq)
+	req.Body.Close()
+	if err != nil {
+		invalidBody(w, req, err)
+		return
+	}
+	payload, err := decodeBase64("payload", storeReq.Payload)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	key, err := processStoreRaw(s.Enclave, payload, storeReq.From, httpCaller(req))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(api.SendResponse{Key: base64.StdEncoding.EncodeToString(key)})
+}
+
+// sendSignedTx accepts either a JSON SendSignedTxRequest, or like sendraw, the hash as the
+// request body and its recipients in the c11n-to header, as Quorum sends it.
+func (s *TransactionManager) sendSignedTx(w http.ResponseWriter, req *http.Request) {
+	if strings.HasPrefix(req.Header.Get("Content-Type"), "application/json") {
+		s.sendSignedTxJson(w, req)
+		return
+	}
+
+	to, ok := req.Header[hTo]
+	if !ok {
+		to = req.Header[textproto.CanonicalMIMEHeaderKey(hTo)]
+	}
+	key, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		invalidBody(w, req, err)
+		return
+	}
+
+	key, err = processSendSignedTx(s.Enclave, key, to, api.PrivacyMetadata{}, httpCaller(req))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	fmt.Fprint(w, base64.StdEncoding.EncodeToString(key))
+}
+
+func (s *TransactionManager) sendSignedTxJson(w http.ResponseWriter, req *http.Request) {
+	var sendReq api.SendSignedTxRequest
+	err := json.NewDecoder(req.Body).Decode(&sendReq)
+	req.Body.Close()
+	if err != nil {
+		invalidBody(w, req, err)
+		return
+	}
+	key, err := decodeBase64("hash", sendReq.Hash)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	privacy, err := decodePrivacy(sendReq.PrivacyFlag, sendReq.AffectedContractTransactions,
+		sendReq.ExecHash, sendReq.PrivacyGroupId)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	key, err = processSendSignedTx(s.Enclave, key, sendReq.To, privacy, httpCaller(req))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(api.SendResponse{Key: base64.StdEncoding.EncodeToString(key)})
+}
+
+// StoreRaw stores the payload of a chimera.SendRequest encrypted for its sender only. The To list
+// is ignored.
+func (s *Server) StoreRaw(
+	ctx context.Context, in *chimera.SendRequest) (*chimera.SendResponse, error) {
+
+	key, err := processStoreRaw(s.Enclave, in.GetPayload(), in.GetFrom(), grpcCaller(ctx))
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &chimera.SendResponse{Key: key}, nil
+}
+
+// SendSignedTx sends the raw payload whose key is the payload of a chimera.SendRequest to its To
+// list, or a privacy group given as for Send. The From field is ignored.
+func (s *Server) SendSignedTx(
+	ctx context.Context, in *chimera.SendRequest) (*chimera.SendResponse, error) {
+
+	privacy, err := grpcPrivacy(ctx)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	key, err := processSendSignedTx(
+		s.Enclave, in.GetPayload(), in.GetTo(), privacy, grpcCaller(ctx))
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &chimera.SendResponse{Key: key}, nil
+}
+
+// RawTransactionServer is the gRPC service of Quorum's raw private transaction flow. The chimera
+// API has no such calls, so it is served alongside chimera.ClientServer, reusing its messages.
+type RawTransactionServer interface {
+	StoreRaw(context.Context, *chimera.SendRequest) (*chimera.SendResponse, error)
+	SendSignedTx(context.Context, *chimera.SendRequest) (*chimera.SendResponse, error)
+}
+
+const rawTransactionService = "crux.RawTransaction"
+
+func RegisterRawTransactionServer(s *grpc.Server, srv RawTransactionServer) {
+	s.RegisterService(&rawTransactionServiceDesc, srv)
+}
+
+// rawTransactionHandler returns the handler of a RawTransactionServer method, as generated by
+// protoc-gen-go.
+func rawTransactionHandler(method string,
+	call func(RawTransactionServer, context.Context, *chimera.SendRequest) (
+		*chimera.SendResponse, error)) func(interface{}, context.Context,
+	func(interface{}) error, grpc.UnaryServerInterceptor) (interface{}, error) {
+
+	return func(srv interface{}, ctx context.Context, dec func(interface{}) error,
+		interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+
+		in := new(chimera.SendRequest)
+		if err := dec(in); err != nil {
+			return nil, err
+		}
+		if interceptor == nil {
+			return call(srv.(RawTransactionServer), ctx, in)
+		}
+		info := &grpc.UnaryServerInfo{
+			Server:     srv,
+			FullMethod: "/" + rawTransactionService + "/" + method,
+		}
+		handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+			return call(srv.(RawTransactionServer), ctx, req.(*chimera.SendRequest))
+		}
+		return interceptor(ctx, in, info, handler)
+	}
+}
+
+var rawTransactionServiceDesc = grpc.ServiceDesc{
+	ServiceName: rawTransactionService,
+	HandlerType: (*RawTransactionServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "StoreRaw",
+			Handler:    rawTransactionHandler("StoreRaw", RawTransactionServer.StoreRaw),
+		},
+		{
+			MethodName: "SendSignedTx",
+			Handler:    rawTransactionHandler("SendSignedTx", RawTransactionServer.SendSignedTx),
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "raw.go",
+}
+
+// RawTransactionClient is a client of a RawTransactionServer.
+type RawTransactionClient struct {
+	cc *grpc.ClientConn
+}
+
+func NewRawTransactionClient(cc *grpc.ClientConn) *RawTransactionClient {
+	return &RawTransactionClient{cc}
+}
+
+func (c *RawTransactionClient) StoreRaw(ctx context.Context, in *chimera.SendRequest,
+	opts ...grpc.CallOption) (*chimera.SendResponse, error) {
+
+	out := new(chimera.SendResponse)
+	err := c.cc.Invoke(ctx, "/"+rawTransactionService+"/StoreRaw", in, out, opts...)
+	return out, err
+}
+
+func (c *RawTransactionClient) SendSignedTx(ctx context.Context, in *chimera.SendRequest,
+	opts ...grpc.CallOption) (*chimera.SendResponse, error) {
+
+	out := new(chimera.SendResponse)
+	err := c.cc.Invoke(ctx, "/"+rawTransactionService+"/SendSignedTx", in, out, opts...)
+	return out, err
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"github.com/blk-io/chimera-api/chimera"
+	"github.com/blk-io/crux/api"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	grpcmetadata "google.golang.org/grpc/metadata"
+	"net/http"
+	"strconv"
+)
+
+// receiveDetails is the versioned receive endpoint, whose response includes the keys involved in
+// the payload. Quorum's /receive and /receiveraw are unchanged.
+const receiveDetails = "/v2/receive"
+
+// receiveDetailsMetadata is the gRPC metadata key with which a Receive request asks for the
+// details of the payload, which are returned in the response header.
+const receiveDetailsMetadata = "receive-details"
+
+// processReceiveDetails retrieves the payload with key and its details.
+func processReceiveDetails(
+	enc Enclave, key []byte, b64To, caller string) (*api.PayloadDetails, error) {
+
+	var to []byte
+	var err error
+	if b64To != "" {
+		to, err = decodeBase64("to", b64To)
+		if err != nil {
+			return nil, err
+		}
+	}
+	details, err := enc.RetrieveDetails(key, to)
+	audit(enc, caller, api.AuditRetrieve, key, [][]byte{to}, err)
+	return details, err
+}
+
+// detailsResponse creates the response to a /v2/receive request.
+func detailsResponse(details *api.PayloadDetails) api.ReceiveDetailsResponse {
+	resp := api.ReceiveDetailsResponse{
+		ReceiveResponse: receiveResponse(details.Payload, details.Privacy),
+		DecryptedBy:     base64.StdEncoding.EncodeToString(details.DecryptedBy),
+		Sender:          base64.StdEncoding.EncodeToString(details.Sender),
+	}
+	for _, recipient := range details.Recipients {
+		resp.Recipients = append(resp.Recipients, base64.StdEncoding.EncodeToString(recipient))
+	}
+	return resp
+}
+
+func (s *TransactionManager) receiveDetails(w http.ResponseWriter, req *http.Request) {
+	var receiveReq api.ReceiveRequest
+	err := json.NewDecoder(req.Body).Decode(&receiveReq)
+	req.Body.Close()
+	if err != nil {
+		invalidBody(w, req, err)
+		return
+	}
+	key, err := decodeBase64("key", receiveReq.Key)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	details, err := processReceiveDetails(s.Enclave, key, receiveReq.To, httpCaller(req))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(detailsResponse(details))
+}
+
+// wantsDetails returns true if a gRPC Receive request asks for the details of the payload.
+func wantsDetails(ctx context.Context) bool {
+	md, ok := grpcmetadata.FromIncomingContext(ctx)
+	if !ok {
+		return false
+	}
+	values := md.Get(receiveDetailsMetadata)
+	return len(values) > 0 && values[0] == "true"
+}
+
+// receiveWithDetails retrieves the payload of a gRPC Receive request, sending its details as
+// metadata in the response header, named as the fields of a /v2/receive response.
+func (s *Server) receiveWithDetails(
+	ctx context.Context, in *chimera.ReceiveRequest) (*chimera.ReceiveResponse, error) {
+
+	details, err := processReceiveDetails(s.Enclave, in.Key, in.To, grpcCaller(ctx))
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	resp := detailsResponse(details)
+	header := grpcmetadata.Pairs("decrypted-by", resp.DecryptedBy, "sender", resp.Sender)
+	add := func(key string, values ...string) {
+		if len(values) > 0 && values[0] != "" {
+			header[key] = values
+		}
+	}
+	add("recipients", resp.Recipients...)
+	if resp.PrivacyFlag != api.StandardPrivate {
+		add("privacy-flag", strconv.Itoa(int(resp.PrivacyFlag)))
+	}
+	add("affected-contract-transactions", resp.AffectedContractTransactions...)
+	add("exec-hash", resp.ExecHash)
+	add(privacyGroupMetadata, resp.PrivacyGroupId)
+	// Headers set rather than sent are dropped when gRPC is served by our HTTP handler
+	if err = grpc.SendHeader(ctx, header); err != nil {
+		return nil, err
+	}
+	return &chimera.ReceiveResponse{Payload: details.Payload}, nil
+}
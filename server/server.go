@@ -10,6 +10,8 @@ import (
 	"github.com/blk-io/crux/utils"
 	"github.com/kevinburke/nacl"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httputil"
@@ -21,6 +23,9 @@ import (
 // Enclave is the interface used by the transaction enclaves.
 type Enclave interface {
 	Store(message *[]byte, sender []byte, recipients [][]byte) ([]byte, error)
+	StoreWithPrivacy(
+		message *[]byte, sender []byte, recipients [][]byte,
+		privacy api.PrivacyMetadata) ([]byte, error)
 	StorePayloadGrpc(epl api.EncryptedPayload, encoded []byte) ([]byte, error)
 	StorePayload(encoded []byte) ([]byte, error)
 	Retrieve(digestHash *[]byte, to *[]byte) ([]byte, error)
@@ -28,6 +33,23 @@ type Enclave interface {
 	RetrieveFor(digestHash *[]byte, reqRecipient *[]byte) (*[]byte, error)
 	RetrieveAllFor(reqRecipient *[]byte) error
 	Delete(digestHash *[]byte) error
+	Backup(ctx context.Context, w io.Writer) (int, error)
+	Metadata(digestHash []byte) (*api.PayloadMetadata, error)
+	Privacy(digestHash []byte) (api.PrivacyMetadata, error)
+	RetrieveDetails(digestHash, to []byte) (*api.PayloadDetails, error)
+	StoreRaw(message *[]byte, sender []byte) ([]byte, error)
+	SendSignedTx(
+		digestHash []byte, recipients [][]byte, privacy api.PrivacyMetadata) ([]byte, error)
+	CreatePrivacyGroup(
+		from []byte, name, description string, members [][]byte) (*api.PrivacyGroup, error)
+	FindPrivacyGroups(members [][]byte) ([]api.PrivacyGroup, error)
+	PrivacyGroup(id []byte) (*api.PrivacyGroup, error)
+	DeletePrivacyGroup(id, from []byte) (*api.PrivacyGroup, error)
+	PushPrivacyGroup(encoded, sender, recipient, nonce, proof []byte) error
+	Erase(digestHash []byte) ([]api.RecipientStatus, error)
+	Share(digestHash, from []byte, recipients [][]byte) ([]api.RecipientStatus, error)
+	Audit(entry *api.AuditEntry)
+	PushDelete(digestHash, sender, recipient, nonce, proof []byte) error
 	UpdatePartyInfo(encoded []byte)
 	UpdatePartyInfoGrpc(url string, recipients map[[nacl.KeySize]byte]string, parties map[string]bool)
 	GetEncodedPartyInfo() []byte
@@ -53,6 +75,7 @@ const sendRaw = "/sendraw"
 const receive = "/receive"
 const receiveRaw = "/receiveraw"
 const delete = "/delete"
+const pushDelete = "/pushdelete"
 
 const hFrom = "c11n-from"
 const hTo = "c11n-to"
@@ -75,11 +98,12 @@ func requestLogger(handler http.Handler) http.Handler {
 }
 
 // Init initializes a new TransactionManager instance.
-func Init(enc Enclave, networkInterface string, port int, ipcPath string, grpc bool, grpcJsonPort int, tls bool, certFile, keyFile string) (TransactionManager, error) {
+// When gRPC is enabled, gRPC, the JSON gateway and the legacy HTTP endpoints share the given port.
+func Init(enc Enclave, networkInterface string, port int, ipcPath string, grpc bool, tls bool, certFile, keyFile string) (TransactionManager, error) {
 	tm := TransactionManager{Enclave: enc}
 	var err error
 	if grpc == true {
-		err = tm.startRpcServer(networkInterface, port, grpcJsonPort, ipcPath, tls, certFile, keyFile)
+		err = tm.startRpcServer(networkInterface, port, ipcPath, tls, certFile, keyFile)
 
 	} else {
 		err = tm.startHttpserver(networkInterface, port, ipcPath, tls, certFile, keyFile)
@@ -88,13 +112,21 @@ func Init(enc Enclave, networkInterface string, port int, ipcPath string, grpc b
 	return tm, err
 }
 
-func (tm *TransactionManager) startHttpserver(networkInterface string, port int, ipcPath string, tls bool, certFile, keyFile string) error {
+// newPublicApi creates the handler for the HTTP endpoints exposed to other nodes.
+func (tm *TransactionManager) newPublicApi() *http.ServeMux {
 	httpServer := http.NewServeMux()
 	httpServer.HandleFunc(upCheck, tm.upcheck)
 	httpServer.HandleFunc(version, tm.version)
 	httpServer.HandleFunc(push, tm.push)
+	httpServer.HandleFunc(pushDelete, tm.pushDelete)
+	httpServer.HandleFunc(pushPrivacyGroup, tm.pushPrivacyGroup)
 	httpServer.HandleFunc(resend, tm.resend)
 	httpServer.HandleFunc(partyInfo, tm.partyInfo)
+	return httpServer
+}
+
+func (tm *TransactionManager) startHttpserver(networkInterface string, port int, ipcPath string, tls bool, certFile, keyFile string) error {
+	httpServer := tm.newPublicApi()
 
 	serverUrl := networkInterface + ":" + strconv.Itoa(port)
 	if tls {
@@ -114,12 +146,15 @@ func (tm *TransactionManager) startHttpserver(networkInterface string, port int,
 	}
 
 	// Restricted to IPC
-	ipcServer := http.NewServeMux()
+	ipcServer := tm.newAdminApi()
 	ipcServer.HandleFunc(upCheck, tm.upcheck)
 	ipcServer.HandleFunc(version, tm.version)
 	ipcServer.HandleFunc(send, tm.send)
 	ipcServer.HandleFunc(sendRaw, tm.sendRaw)
+	ipcServer.HandleFunc(storeRaw, tm.storeRaw)
+	ipcServer.HandleFunc(sendSignedTx, tm.sendSignedTx)
 	ipcServer.HandleFunc(receive, tm.receive)
+	ipcServer.HandleFunc(receiveDetails, tm.receiveDetails)
 	ipcServer.HandleFunc(receiveRaw, tm.receiveRaw)
 	ipcServer.HandleFunc(delete, tm.delete)
 
@@ -161,25 +196,29 @@ func (s *TransactionManager) send(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	payload, err := base64.StdEncoding.DecodeString(sendReq.Payload)
+	payload, err := decodeBase64("payload", sendReq.Payload)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	privacy, err := decodePrivacy(sendReq.PrivacyFlag, sendReq.AffectedContractTransactions,
+		sendReq.ExecHash, sendReq.PrivacyGroupId)
 	if err != nil {
-		decodeError(w, req, "payload", sendReq.Payload, err)
+		writeError(w, err)
 		return
 	}
 
 	var key []byte
-	key, err = s.processSend(w, req, sendReq.From, sendReq.To, &payload)
+	key, err = s.processSend(sendReq.From, sendReq.To, &payload, privacy, httpCaller(req))
 
 	if err != nil {
-		log.Error(err)
-		badRequest(w,
-			fmt.Sprintf("Unable to store key: %s, with payload: %s, error: %s\n",
-				key, payload, err))
+		writeError(w, err)
 	} else {
 		encodedKey := base64.StdEncoding.EncodeToString(key)
 		sendResp := api.SendResponse{Key: encodedKey}
-		json.NewEncoder(w).Encode(sendResp)
 		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(sendResp)
 	}
 }
 
@@ -203,9 +242,9 @@ func (s *TransactionManager) sendRaw(w http.ResponseWriter, req *http.Request) {
 	}
 
 	var key []byte
-	key, err = s.processSend(w, req, from, to, &payload)
+	key, err = s.processSend(from, to, &payload, api.PrivacyMetadata{}, httpCaller(req))
 	if err != nil {
-		internalServerError(w, "Unable to process request")
+		writeError(w, err)
 		return
 	}
 
@@ -218,10 +257,11 @@ func (s *TransactionManager) sendRaw(w http.ResponseWriter, req *http.Request) {
 }
 
 func (s *TransactionManager) processSend(
-	w http.ResponseWriter, req *http.Request,
 	b64from string,
 	b64recipients []string,
-	payload *[]byte) ([]byte, error) {
+	payload *[]byte,
+	privacy api.PrivacyMetadata,
+	caller string) ([]byte, error) {
 
 	log.WithFields(log.Fields{
 		"b64From":       b64from,
@@ -229,24 +269,50 @@ func (s *TransactionManager) processSend(
 		"payload":       hex.EncodeToString(*payload)}).Debugf(
 		"Processing send request")
 
-	sender, err := base64.StdEncoding.DecodeString(b64from)
+	sender, err := decodeBase64("from", b64from)
 	if err != nil {
-		decodeError(w, req, "sender", b64from, err)
 		return nil, err
 	}
 
 	recipients := make([][]byte, len(b64recipients))
 	for i, value := range b64recipients {
-		recipient, err := base64.StdEncoding.DecodeString(value)
+		recipient, err := decodeBase64("to", value)
 		if err != nil {
-			decodeError(w, req, "recipient", value, err)
 			return nil, err
 		} else {
 			recipients[i] = recipient
 		}
 	}
 
-	return s.Enclave.Store(payload, sender, recipients)
+	key, err := s.Enclave.StoreWithPrivacy(payload, sender, recipients, privacy)
+	audit(s.Enclave, caller, api.AuditStore, key, append([][]byte{sender}, recipients...), err)
+	return key, err
+}
+
+// decodePrivacy decodes the privacy metadata of a send request.
+func decodePrivacy(mode api.PrivacyMode, b64Affected []string,
+	b64ExecHash, b64GroupId string) (api.PrivacyMetadata, error) {
+
+	privacy := api.PrivacyMetadata{Mode: mode}
+	for _, b64Digest := range b64Affected {
+		digest, err := decodeBase64("affectedContractTransactions", b64Digest)
+		if err != nil {
+			return privacy, err
+		}
+		privacy.AffectedContracts = append(
+			privacy.AffectedContracts, api.AffectedContract{Digest: digest})
+	}
+	var err error
+	if b64ExecHash != "" {
+		privacy.ExecHash, err = decodeBase64("execHash", b64ExecHash)
+		if err != nil {
+			return privacy, err
+		}
+	}
+	if b64GroupId != "" {
+		privacy.PrivacyGroupId, err = decodeBase64("privacyGroupId", b64GroupId)
+	}
+	return privacy, err
 }
 
 func (s *TransactionManager) receive(w http.ResponseWriter, req *http.Request) {
@@ -259,58 +325,84 @@ func (s *TransactionManager) receive(w http.ResponseWriter, req *http.Request) {
 	}
 
 	var payload []byte
-	payload, err = s.processReceive(w, req, receiveReq.Key, receiveReq.To)
+	payload, err = s.processReceive(receiveReq.Key, receiveReq.To, httpCaller(req))
 
 	if err != nil {
-		badRequest(w,
-			fmt.Sprintf("Unable to retrieve payload for key: %s, error: %s\n",
-				receiveReq.Key, err))
-	} else {
-		encodedPayload := base64.StdEncoding.EncodeToString(payload)
-		sendResp := api.ReceiveResponse{Payload: encodedPayload}
-		json.NewEncoder(w).Encode(sendResp)
-		w.Header().Set("Content-Type", "application/json")
+		writeError(w, err)
+		return
+	}
+
+	key, _ := base64.StdEncoding.DecodeString(receiveReq.Key)
+	privacy, err := s.Enclave.Privacy(key)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(receiveResponse(payload, privacy))
+}
+
+// receiveResponse creates the response to a receive request, with the privacy metadata of the
+// payload.
+func receiveResponse(payload []byte, privacy api.PrivacyMetadata) api.ReceiveResponse {
+	receiveResp := api.ReceiveResponse{Payload: base64.StdEncoding.EncodeToString(payload)}
+	if privacy.Mode != api.StandardPrivate {
+		receiveResp.PrivacyFlag = privacy.Mode
+		for _, affected := range privacy.AffectedContracts {
+			receiveResp.AffectedContractTransactions = append(
+				receiveResp.AffectedContractTransactions,
+				base64.StdEncoding.EncodeToString(affected.Digest))
+		}
+		if len(privacy.ExecHash) > 0 {
+			receiveResp.ExecHash = base64.StdEncoding.EncodeToString(privacy.ExecHash)
+		}
+	}
+	if len(privacy.PrivacyGroupId) > 0 {
+		receiveResp.PrivacyGroupId = base64.StdEncoding.EncodeToString(privacy.PrivacyGroupId)
 	}
+	return receiveResp
 }
 
 func (s *TransactionManager) receiveRaw(w http.ResponseWriter, req *http.Request) {
 
 	key := req.Header.Get(hKey)
 	if key == "" {
-		badRequest(w, "key not specified")
+		writeError(w, api.FieldError(hKey, nil, "key not specified"))
 		return
 	}
 
 	to := req.Header.Get(hTo)
 
-	payload, err := s.processReceive(w, req, key, to)
+	payload, err := s.processReceive(key, to, httpCaller(req))
 
 	if err != nil {
-		badRequest(w, fmt.Sprintln(err))
+		writeError(w, err)
 		return
 	}
 
 	w.Write(payload)
 }
 
-func (s *TransactionManager) processReceive(
-	w http.ResponseWriter, req *http.Request, b64Key, b64To string) ([]byte, error) {
+func (s *TransactionManager) processReceive(b64Key, b64To, caller string) ([]byte, error) {
 
-	key, err := base64.StdEncoding.DecodeString(b64Key)
+	key, err := decodeBase64("key", b64Key)
 	if err != nil {
-		return nil, fmt.Errorf("unable to decode key: %s", b64Key)
+		return nil, err
 	}
 
+	var to, payload []byte
 	if b64To != "" {
-		to, err := base64.StdEncoding.DecodeString(b64To)
+		to, err = decodeBase64("to", b64To)
 		if err != nil {
-			return nil, fmt.Errorf("unable to decode to: %s", b64Key)
+			return nil, err
 		}
 
-		return s.Enclave.Retrieve(&key, &to)
+		payload, err = s.Enclave.Retrieve(&key, &to)
 	} else {
-		return s.Enclave.RetrieveDefault(&key)
+		payload, err = s.Enclave.RetrieveDefault(&key)
 	}
+	audit(s.Enclave, caller, api.AuditRetrieve, key, [][]byte{to}, err)
+	return payload, err
 }
 
 func (s *TransactionManager) delete(w http.ResponseWriter, req *http.Request) {
@@ -321,13 +413,14 @@ func (s *TransactionManager) delete(w http.ResponseWriter, req *http.Request) {
 		invalidBody(w, req, err)
 		return
 	}
-	key, err := base64.StdEncoding.DecodeString(deleteReq.Key)
+	key, err := decodeBase64("key", deleteReq.Key)
 	if err != nil {
-		decodeError(w, req, "key", deleteReq.Key, err)
+		writeError(w, err)
 	} else {
 		err = s.Enclave.Delete(&key)
+		audit(s.Enclave, httpCaller(req), api.AuditDelete, key, nil, err)
 		if err != nil {
-			badRequest(w, fmt.Sprintf("Unable to delete key: %s, error: %s\n", key, err))
+			writeError(w, err)
 		}
 	}
 }
@@ -336,19 +429,49 @@ func (s *TransactionManager) push(w http.ResponseWriter, req *http.Request) {
 	payload, err := ioutil.ReadAll(req.Body)
 	req.Body.Close()
 	if err != nil {
-		internalServerError(w, fmt.Sprintf("Unable to read request body, error: %s\n", err))
+		invalidBody(w, req, err)
 		return
 	}
 
 	digestHash, err := s.Enclave.StorePayload(payload)
+	audit(s.Enclave, httpCaller(req), api.AuditPush, digestHash, nil, err)
 	if err != nil {
-		badRequest(w, fmt.Sprintf("Unable to store payload, error: %s\n", err))
+		writeError(w, err)
 		return
 	}
 
 	w.Write(digestHash)
 }
 
+// pushDelete deletes a payload at the request of its sender, which has erased it.
+func (s *TransactionManager) pushDelete(w http.ResponseWriter, req *http.Request) {
+	var deleteReq api.PushDeleteRequest
+	err := json.NewDecoder(req.Body).Decode(&deleteReq)
+	req.Body.Close()
+	if err != nil {
+		invalidBody(w, req, err)
+		return
+	}
+
+	fields := []string{"key", "sender", "recipient", "nonce", "proof"}
+	values := []string{
+		deleteReq.Key, deleteReq.Sender, deleteReq.Recipient, deleteReq.Nonce, deleteReq.Proof}
+	decoded := make([][]byte, len(fields))
+	for i, field := range fields {
+		decoded[i], err = decodeBase64(field, values[i])
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+
+	err = s.Enclave.PushDelete(decoded[0], decoded[1], decoded[2], decoded[3], decoded[4])
+	audit(s.Enclave, httpCaller(req), api.AuditPushDelete, decoded[0], decoded[1:3], err)
+	if err != nil {
+		writeError(w, err)
+	}
+}
+
 func (s *TransactionManager) resend(w http.ResponseWriter, req *http.Request) {
 	var resendReq api.ResendRequest
 	err := json.NewDecoder(req.Body).Decode(&resendReq)
@@ -359,32 +482,37 @@ func (s *TransactionManager) resend(w http.ResponseWriter, req *http.Request) {
 	}
 
 	var publicKey []byte
-	publicKey, err = base64.StdEncoding.DecodeString(resendReq.PublicKey)
+	publicKey, err = decodeBase64("publicKey", resendReq.PublicKey)
 	if err != nil {
-		decodeError(w, req, "publicKey", resendReq.PublicKey, err)
+		writeError(w, err)
 		return
 	}
 
 	if resendReq.Type == "all" {
 		err = s.Enclave.RetrieveAllFor(&publicKey)
+		audit(s.Enclave, httpCaller(req), api.AuditResendAll, nil, [][]byte{publicKey}, err)
 		if err != nil {
-			invalidBody(w, req, err)
+			writeError(w, err)
 		}
 	} else if resendReq.Type == "individual" {
 		var key []byte
-		key, err = base64.StdEncoding.DecodeString(resendReq.Key)
+		key, err = decodeBase64("key", resendReq.Key)
 		if err != nil {
-			decodeError(w, req, "key", resendReq.Key, err)
+			writeError(w, err)
 			return
 		}
 
 		var encodedPl *[]byte
 		encodedPl, err = s.Enclave.RetrieveFor(&key, &publicKey)
+		audit(s.Enclave, httpCaller(req), api.AuditResend, key, [][]byte{publicKey}, err)
 		if err != nil {
-			invalidBody(w, req, err)
+			writeError(w, err)
 			return
 		}
 		w.Write(*encodedPl)
+	} else {
+		writeError(w, api.FieldError("type", nil,
+			"invalid resend type: %s, expected all or individual", resendReq.Type))
 	}
 }
 
@@ -392,32 +520,14 @@ func (s *TransactionManager) partyInfo(w http.ResponseWriter, req *http.Request)
 	payload, err := ioutil.ReadAll(req.Body)
 	req.Body.Close()
 	if err != nil {
-		internalServerError(w, fmt.Sprintf("Unable to read request body, error: %s\n", err))
+		invalidBody(w, req, err)
 		return
 	} else {
-		s.Enclave.UpdatePartyInfo(payload)
+		auditPartyInfo(s.Enclave, httpCaller(req), func() { s.Enclave.UpdatePartyInfo(payload) })
 		w.Write(s.Enclave.GetEncodedPartyInfo())
 	}
 }
 
 func invalidBody(w http.ResponseWriter, req *http.Request, err error) {
-	badRequest(w, fmt.Sprintf("Invalid request: %s, error: %s\n", req.URL, err))
-}
-
-func decodeError(w http.ResponseWriter, req *http.Request, name string, value string, err error) {
-	badRequest(w,
-		fmt.Sprintf("Invalid request: %s, unable to decode %s: %s, error: %s\n",
-			req.URL, name, value, err))
-}
-
-func badRequest(w http.ResponseWriter, message string) {
-	log.Error(message)
-	w.WriteHeader(http.StatusBadRequest)
-	fmt.Fprintf(w, message)
-}
-
-func internalServerError(w http.ResponseWriter, message string) {
-	log.Error(message)
-	w.WriteHeader(http.StatusInternalServerError)
-	fmt.Fprintf(w, message)
+	writeError(w, api.WrapError(api.InvalidArgument, err, "invalid request: %s", req.URL))
 }
@@ -1,15 +1,14 @@
 package server
 
 import (
-	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
-	"fmt"
 	"github.com/blk-io/chimera-api/chimera"
 	"github.com/blk-io/crux/api"
 	"github.com/kevinburke/nacl"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/net/context"
+	grpcmetadata "google.golang.org/grpc/metadata"
 )
 
 type Server struct {
@@ -24,65 +23,89 @@ func (s *Server) Upcheck(ctx context.Context, in *chimera.UpCheckResponse) (*chi
 	return &chimera.UpCheckResponse{Message: upCheckResponse}, nil
 }
 func (s *Server) Send(ctx context.Context, in *chimera.SendRequest) (*chimera.SendResponse, error) {
-	key, err := s.processSend(in.GetFrom(), in.GetTo(), &in.Payload)
-	var sendResp chimera.SendResponse
+	privacy, err := grpcPrivacy(ctx)
 	if err != nil {
-		log.Error(err)
-	} else {
-		sendResp = chimera.SendResponse{Key: key}
+		return nil, grpcError(err)
+	}
+	key, err := s.processSend(in.GetFrom(), in.GetTo(), &in.Payload, privacy, grpcCaller(ctx))
+	if err != nil {
+		return nil, grpcError(err)
 	}
-	return &sendResp, err
+	return &chimera.SendResponse{Key: key}, nil
 }
 
-func (s *Server) processSend(b64from string, b64recipients []string, payload *[]byte) ([]byte, error) {
+// privacyGroupMetadata is the gRPC metadata key a privacy group id can be sent to in place of
+// the To list, as the SendRequest message has no field for it.
+const privacyGroupMetadata = "privacy-group-id"
+
+// grpcPrivacy returns the privacy metadata of a gRPC send request.
+func grpcPrivacy(ctx context.Context) (api.PrivacyMetadata, error) {
+	var privacy api.PrivacyMetadata
+	md, ok := grpcmetadata.FromIncomingContext(ctx)
+	if !ok || len(md.Get(privacyGroupMetadata)) == 0 {
+		return privacy, nil
+	}
+	var err error
+	privacy.PrivacyGroupId, err = decodeBase64(
+		"privacyGroupId", md.Get(privacyGroupMetadata)[0])
+	return privacy, err
+}
+
+func (s *Server) processSend(b64from string, b64recipients []string, payload *[]byte,
+	privacy api.PrivacyMetadata, caller string) ([]byte, error) {
+
 	log.WithFields(log.Fields{
 		"b64From":       b64from,
 		"b64Recipients": b64recipients,
 		"payload":       hex.EncodeToString(*payload)}).Debugf(
 		"Processing send request")
 
-	sender, err := base64.StdEncoding.DecodeString(b64from)
+	sender, err := decodeBase64("from", b64from)
 	if err != nil {
-		decodeErrorGRPC("sender", b64from, err)
 		return nil, err
 	}
 
 	recipients := make([][]byte, len(b64recipients))
 	for i, value := range b64recipients {
-		recipient, err := base64.StdEncoding.DecodeString(value)
+		recipient, err := decodeBase64("to", value)
 		if err != nil {
-			decodeErrorGRPC("recipients", value, err)
 			return nil, err
 		} else {
 			recipients[i] = recipient
 		}
 	}
 
-	return s.Enclave.Store(payload, sender, recipients)
+	key, err := s.Enclave.StoreWithPrivacy(payload, sender, recipients, privacy)
+	audit(s.Enclave, caller, api.AuditStore, key, append([][]byte{sender}, recipients...), err)
+	return key, err
 }
 
 func (s *Server) Receive(ctx context.Context, in *chimera.ReceiveRequest) (*chimera.ReceiveResponse, error) {
-	payload, err := s.processReceive(in.Key, in.To)
-	var receiveResp chimera.ReceiveResponse
+	if wantsDetails(ctx) {
+		return s.receiveWithDetails(ctx, in)
+	}
+	payload, err := s.processReceive(in.Key, in.To, grpcCaller(ctx))
 	if err != nil {
-		log.Error(err)
-	} else {
-		receiveResp = chimera.ReceiveResponse{Payload: payload}
+		return nil, grpcError(err)
 	}
-	return &receiveResp, err
+	return &chimera.ReceiveResponse{Payload: payload}, nil
 }
 
-func (s *Server) processReceive(b64Key []byte, b64To string) ([]byte, error) {
+func (s *Server) processReceive(b64Key []byte, b64To, caller string) ([]byte, error) {
+	var to, payload []byte
+	var err error
 	if b64To != "" {
-		to, err := base64.StdEncoding.DecodeString(b64To)
+		to, err = decodeBase64("to", b64To)
 		if err != nil {
-			return nil, fmt.Errorf("unable to decode to: %s", b64Key)
+			return nil, err
 		}
 
-		return s.Enclave.Retrieve(&b64Key, &to)
+		payload, err = s.Enclave.Retrieve(&b64Key, &to)
 	} else {
-		return s.Enclave.RetrieveDefault(&b64Key)
+		payload, err = s.Enclave.RetrieveDefault(&b64Key)
 	}
+	audit(s.Enclave, caller, api.AuditRetrieve, b64Key, [][]byte{to}, err)
+	return payload, err
 }
 
 func (s *Server) UpdatePartyInfo(ctx context.Context, in *chimera.PartyInfo) (*chimera.PartyInfoResponse, error) {
@@ -92,7 +115,9 @@ func (s *Server) UpdatePartyInfo(ctx context.Context, in *chimera.PartyInfo) (*c
 		copy(as[:], key)
 		recipients[as] = url
 	}
-	s.Enclave.UpdatePartyInfoGrpc(in.Url, recipients, in.Parties)
+	auditPartyInfo(s.Enclave, grpcCaller(ctx), func() {
+		s.Enclave.UpdatePartyInfoGrpc(in.Url, recipients, in.Parties)
+	})
 	encoded := s.Enclave.GetEncodedPartyInfoGrpc()
 	var decodedPartyInfo chimera.PartyInfoResponse
 	err := json.Unmarshal(encoded, &decodedPartyInfo)
@@ -103,6 +128,14 @@ func (s *Server) UpdatePartyInfo(ctx context.Context, in *chimera.PartyInfo) (*c
 }
 
 func (s *Server) Push(ctx context.Context, in *chimera.PushPayload) (*chimera.PartyInfoResponse, error) {
+	if in.Ep == nil {
+		return nil, grpcError(api.FieldError("ep", nil, "payload not specified"))
+	}
+	// Nonces are sent padded to the size of a key
+	if len(in.Ep.Sender) != nacl.KeySize || len(in.Ep.Nonce) < nacl.NonceSize ||
+		len(in.Ep.ReciepientNonce) < nacl.NonceSize {
+		return nil, grpcError(api.FieldError("ep", nil, "malformed payload"))
+	}
 	sender := new([nacl.KeySize]byte)
 	nonce := new([nacl.NonceSize]byte)
 	recipientNonce := new([nacl.NonceSize]byte)
@@ -119,45 +152,51 @@ func (s *Server) Push(ctx context.Context, in *chimera.PushPayload) (*chimera.Pa
 	}
 
 	digestHash, err := s.Enclave.StorePayloadGrpc(encyptedPayload, in.Encoded)
+	audit(s.Enclave, grpcCaller(ctx), api.AuditPush, digestHash, [][]byte{in.Ep.Sender}, err)
 	if err != nil {
-		log.Fatalf("Unable to store payload, error: %s\n", err)
+		return nil, grpcError(err)
 	}
 
 	return &chimera.PartyInfoResponse{Payload: digestHash}, nil
 }
 
 func (s *Server) Delete(ctx context.Context, in *chimera.DeleteRequest) (*chimera.DeleteRequest, error) {
-	var deleteReq chimera.DeleteRequest
-	err := s.Enclave.Delete(&deleteReq.Key)
+	if len(in.Key) == 0 {
+		return nil, grpcError(api.FieldError("key", nil, "key not specified"))
+	}
+	err := s.Enclave.Delete(&in.Key)
+	audit(s.Enclave, grpcCaller(ctx), api.AuditDelete, in.Key, nil, err)
 	if err != nil {
-		log.Fatalf("Unable to delete payload, error: %s\n", err)
+		return nil, grpcError(err)
 	}
-	return &chimera.DeleteRequest{Key: deleteReq.Key}, nil
+	return &chimera.DeleteRequest{Key: in.Key}, nil
 }
 
+// Resend re-sends payloads to one of their original recipients. Individual resends return the
+// encoded payload in the response, whereas resends of all payloads are pushed to the node hosting
+// the recipient, and an empty response is returned.
 func (s *Server) Resend(ctx context.Context, in *chimera.ResendRequest) (*chimera.ResendResponse, error) {
-	var resendReq chimera.ResendRequest
-	var err error
+	if len(in.PublicKey) == 0 {
+		return nil, grpcError(api.FieldError("publicKey", nil, "public key not specified"))
+	}
 
-	if resendReq.Type == "all" {
-		err = s.Enclave.RetrieveAllFor(&resendReq.PublicKey)
+	switch in.Type {
+	case "all":
+		err := s.Enclave.RetrieveAllFor(&in.PublicKey)
+		audit(s.Enclave, grpcCaller(ctx), api.AuditResendAll, nil, [][]byte{in.PublicKey}, err)
 		if err != nil {
-			log.Fatalf("Invalid body, exited with %s", err)
+			return nil, grpcError(err)
 		}
-		return nil, err
-	} else if resendReq.Type == "individual" {
-		var encodedPl *[]byte
-		encodedPl, err = s.Enclave.RetrieveFor(&resendReq.Key, &resendReq.PublicKey)
+		return &chimera.ResendResponse{}, nil
+	case "individual":
+		encodedPl, err := s.Enclave.RetrieveFor(&in.Key, &in.PublicKey)
+		audit(s.Enclave, grpcCaller(ctx), api.AuditResend, in.Key, [][]byte{in.PublicKey}, err)
 		if err != nil {
-			log.Fatalf("Invalid body, exited with %s", err)
-			return nil, err
+			return nil, grpcError(err)
 		}
 		return &chimera.ResendResponse{Encoded: *encodedPl}, nil
+	default:
+		return nil, grpcError(api.FieldError("type", nil,
+			"invalid resend type: %s, expected all or individual", in.Type))
 	}
-	return nil, err
-}
-
-func decodeErrorGRPC(name string, value string, err error) {
-	log.Error(fmt.Sprintf("Invalid request: unable to decode %s: %s, error: %s\n",
-		name, value, err))
 }
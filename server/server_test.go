@@ -2,6 +2,7 @@ package server
 
 import (
 	"bytes"
+	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -9,16 +10,27 @@ import (
 	"github.com/blk-io/crux/api"
 	"github.com/blk-io/crux/enclave"
 	"github.com/blk-io/crux/storage"
+	"github.com/blk-io/crux/utils"
 	"github.com/kevinburke/nacl"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	grpcmetadata "google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
 	"path"
 	"reflect"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 const sender = "BULeR8JyUWhiuuCMU/HLA0Q5pzkYT+cHII3ZKBey3Bo="
@@ -33,6 +45,29 @@ func (s *MockEnclave) Store(message *[]byte, sender []byte, recipients [][]byte)
 	return *message, nil
 }
 
+func (s *MockEnclave) StoreWithPrivacy(
+	message *[]byte, sender []byte, recipients [][]byte,
+	privacy api.PrivacyMetadata) ([]byte, error) {
+	return *message, nil
+}
+
+func (s *MockEnclave) Privacy(digestHash []byte) (api.PrivacyMetadata, error) {
+	return api.PrivacyMetadata{}, nil
+}
+
+func (s *MockEnclave) StoreRaw(message *[]byte, sender []byte) ([]byte, error) {
+	return *message, nil
+}
+
+func (s *MockEnclave) SendSignedTx(
+	digestHash []byte, recipients [][]byte, privacy api.PrivacyMetadata) ([]byte, error) {
+	return digestHash, nil
+}
+
+func (s *MockEnclave) RetrieveDetails(digestHash, to []byte) (*api.PayloadDetails, error) {
+	return &api.PayloadDetails{Payload: digestHash, DecryptedBy: to, Sender: to}, nil
+}
+
 func (s *MockEnclave) StorePayload(encoded []byte) ([]byte, error) {
 	return encoded, nil
 }
@@ -60,6 +95,51 @@ func (s *MockEnclave) Delete(digestHash *[]byte) error {
 	return nil
 }
 
+func (s *MockEnclave) Backup(ctx context.Context, w io.Writer) (int, error) {
+	_, err := w.Write(payload)
+	return 1, err
+}
+
+func (s *MockEnclave) Metadata(digestHash []byte) (*api.PayloadMetadata, error) {
+	return &api.PayloadMetadata{Key: base64.StdEncoding.EncodeToString(digestHash)}, nil
+}
+
+func (s *MockEnclave) Erase(digestHash []byte) ([]api.RecipientStatus, error) {
+	return nil, nil
+}
+
+func (s *MockEnclave) Share(
+	digestHash, from []byte, recipients [][]byte) ([]api.RecipientStatus, error) {
+	return nil, nil
+}
+
+func (s *MockEnclave) PushDelete(digestHash, sender, recipient, nonce, proof []byte) error {
+	return nil
+}
+
+func (s *MockEnclave) CreatePrivacyGroup(
+	from []byte, name, description string, members [][]byte) (*api.PrivacyGroup, error) {
+	return &api.PrivacyGroup{Name: name, Description: description}, nil
+}
+
+func (s *MockEnclave) FindPrivacyGroups(members [][]byte) ([]api.PrivacyGroup, error) {
+	return []api.PrivacyGroup{}, nil
+}
+
+func (s *MockEnclave) PrivacyGroup(id []byte) (*api.PrivacyGroup, error) {
+	return &api.PrivacyGroup{}, nil
+}
+
+func (s *MockEnclave) DeletePrivacyGroup(id, from []byte) (*api.PrivacyGroup, error) {
+	return &api.PrivacyGroup{State: api.DeletedGroup}, nil
+}
+
+func (s *MockEnclave) PushPrivacyGroup(encoded, sender, recipient, nonce, proof []byte) error {
+	return nil
+}
+
+func (s *MockEnclave) Audit(entry *api.AuditEntry) {}
+
 func (s *MockEnclave) UpdatePartyInfo(encoded []byte) {}
 
 func (s *MockEnclave) UpdatePartyInfoGrpc(string, map[[nacl.KeySize]byte]string, map[string]bool) {}
@@ -86,6 +166,20 @@ func TestVersion(t *testing.T) {
 	runSimpleGetRequest(t, version, apiVersion, tm.version)
 }
 
+func TestMetricsOnlyOverIPC(t *testing.T) {
+	tm := TransactionManager{}
+	for _, mux := range []struct {
+		handler  http.Handler
+		expected int
+	}{{tm.newPublicApi(), http.StatusNotFound}, {tm.newAdminApi(), http.StatusOK}} {
+		rr := httptest.NewRecorder()
+		mux.handler.ServeHTTP(rr, httptest.NewRequest("GET", metrics, nil))
+		if rr.Code != mux.expected {
+			t.Errorf("Expected %s to return status %d, actual: %d", metrics, mux.expected, rr.Code)
+		}
+	}
+}
+
 func runSimpleGetRequest(t *testing.T, url, response string, handlerFunc http.HandlerFunc) {
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
@@ -189,6 +283,44 @@ func TestSendRaw(t *testing.T) {
 	//runRawHandlerTest(t, headers, payload, payload, sendRaw, tm.sendRaw)
 }
 
+func TestStoreRaw(t *testing.T) {
+	storeReq := api.StoreRawRequest{Payload: encodedPayload, From: sender}
+	response := api.SendResponse{}
+	expected := api.SendResponse{Key: encodedPayload}
+
+	tm := TransactionManager{Enclave: &MockEnclave{}}
+	runJsonHandlerTest(t, &storeReq, &response, &expected, storeRaw, tm.storeRaw)
+}
+
+func TestSendSignedTx(t *testing.T) {
+	tm := TransactionManager{Enclave: &MockEnclave{}}
+
+	headers := make(http.Header)
+	headers[hTo] = []string{receiver}
+	runRawHandlerTest(t, headers, payload, []byte(encodedPayload), sendSignedTx, tm.sendSignedTx)
+
+	body, err := json.Marshal(api.SendSignedTxRequest{Hash: encodedPayload, To: []string{receiver}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("POST", sendSignedTx, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(tm.sendSignedTx).ServeHTTP(rr, req)
+
+	var response api.SendResponse
+	if err = json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if rr.Code != http.StatusOK || response.Key != encodedPayload {
+		t.Errorf("handler returned status %d and key %s, expected %s",
+			rr.Code, response.Key, encodedPayload)
+	}
+}
+
 func TestReceive(t *testing.T) {
 
 	receiveReqs := []api.ReceiveRequest{
@@ -510,7 +642,7 @@ func testRunPartyInfo(t *testing.T, pi api.PartyInfo) {
 
 func InitgRPCServer(t *testing.T, grpc bool, port int) string {
 	ipcPath, err := ioutil.TempDir("", "TestInitIpc")
-	tm, err := Init(&MockEnclave{}, "localhost", port, ipcPath, grpc, -1, false, "", "")
+	tm, err := Init(&MockEnclave{}, "localhost", port, ipcPath, grpc, false, "", "")
 
 	if err != nil {
 		t.Errorf("Error starting server: %v\n", err)
@@ -554,9 +686,970 @@ func TestInit(t *testing.T) {
 		t.Error(err)
 	}
 	certFile, keyFile := "../enclave/testdata/cert/server.crt", "../enclave/testdata/cert/server.key"
-	tm, err := Init(enc, "localhost", 9001, ipcPath, false, -1, true, certFile, keyFile)
+	tm, err := Init(enc, "localhost", 9001, ipcPath, false, true, certFile, keyFile)
 	if err != nil {
 		t.Errorf("Error starting server: %v\n", err)
 	}
 	runSimpleGetRequest(t, upCheck, upCheckResponse, tm.upcheck)
 }
+
+func TestMuxHandler(t *testing.T) {
+	var routed string
+	route := func(name string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			routed = name
+		})
+	}
+	handler := muxHandler(route("grpc"), route("json"), route("jsonapi"), route("http"))
+
+	requests := []struct {
+		path        string
+		contentType string
+		protoMajor  int
+		expected    string
+	}{
+		{"/chimera.Client/Send", "application/grpc", 2, "grpc"},
+		{"/chimera.Client/Send", "application/grpc+proto", 2, "grpc"},
+		{push, "application/json", 1, "json"},
+		{partyInfo, "application/json", 2, "json"},
+		{push, "application/octet-stream", 1, "http"},
+		{partyInfo, "application/octet-stream", 1, "http"},
+		{resend, "application/json", 1, "http"},
+		{send, "application/json", 1, "jsonapi"},
+		{receive, "application/json", 2, "jsonapi"},
+		{receiveDetails, "application/json; charset=utf-8", 1, "jsonapi"},
+		{send, "application/octet-stream", 1, "http"},
+		{receive, "", 1, "http"},
+		{upCheck, "", 1, "http"},
+	}
+
+	for _, r := range requests {
+		req, err := http.NewRequest("POST", r.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", r.contentType)
+		req.ProtoMajor = r.protoMajor
+
+		routed = ""
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		if routed != r.expected {
+			t.Errorf("request to %s with content type %s routed to %s, expected %s\n",
+				r.path, r.contentType, routed, r.expected)
+		}
+	}
+}
+
+func TestSinglePort(t *testing.T) {
+	freePort, err := GetFreePort("localhost")
+	if err != nil {
+		t.Fatalf("failed to find a free port to start gRPC server: %s", err)
+	}
+	InitgRPCServer(t, true, freePort)
+	address := fmt.Sprintf("localhost:%d", freePort)
+
+	conn, err := grpc.Dial(address, grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("Connection to gRPC server failed with error %s", err)
+	}
+	defer conn.Close()
+	c := chimera.NewClientClient(conn)
+
+	upCheckResp, err := c.Upcheck(context.Background(), &chimera.UpCheckResponse{})
+	if err != nil {
+		t.Fatalf("gRPC upcheck failed with %s", err)
+	}
+	if upCheckResp.Message != upCheckResponse {
+		t.Errorf("gRPC upcheck returned %s, expected %s\n", upCheckResp.Message, upCheckResponse)
+	}
+
+	resp, err := http.Get(fmt.Sprintf("http://%s%s", address, upCheck))
+	if err != nil {
+		t.Fatalf("HTTP upcheck failed with %s", err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != upCheckResponse {
+		t.Errorf("HTTP upcheck returned %s, expected %s\n", body, upCheckResponse)
+	}
+
+	// Only the JSON forms of the private send and receive endpoints are served publicly
+	requests := []struct {
+		path        string
+		contentType string
+		status      int
+	}{
+		{send, "application/json", http.StatusOK},
+		{send, "application/octet-stream", http.StatusNotFound},
+		{receive, "", http.StatusNotFound},
+		{receiveDetails, "text/plain", http.StatusNotFound},
+		{"/unknown", "application/json", http.StatusNotFound},
+	}
+	for _, r := range requests {
+		encoded, _ := json.Marshal(api.SendRequest{Payload: encodedPayload, From: sender})
+		resp, err = http.Post(fmt.Sprintf("http://%s%s", address, r.path), r.contentType,
+			bytes.NewReader(encoded))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != r.status {
+			t.Errorf("Request to %s with content type %q returned %d, expected %d",
+				r.path, r.contentType, resp.StatusCode, r.status)
+		}
+	}
+}
+
+func TestSinglePortTLS(t *testing.T) {
+	freePort, err := GetFreePort("localhost")
+	if err != nil {
+		t.Fatalf("failed to find a free port to start gRPC server: %s", err)
+	}
+	ipcPath, err := ioutil.TempDir("", "TestSinglePortTLS")
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := "../enclave/testdata/cert/server.crt", "../enclave/testdata/cert/server.key"
+	_, err = Init(&MockEnclave{}, "localhost", freePort, ipcPath, true, true, certFile, keyFile)
+	if err != nil {
+		t.Fatalf("Error starting server: %v\n", err)
+	}
+	address := fmt.Sprintf("localhost:%d", freePort)
+	tlsConfig := &tls.Config{InsecureSkipVerify: true}
+
+	conn, err := grpc.Dial(address, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+	if err != nil {
+		t.Fatalf("Connection to gRPC server failed with error %s", err)
+	}
+	defer conn.Close()
+	c := chimera.NewClientClient(conn)
+
+	upCheckResp, err := c.Upcheck(context.Background(), &chimera.UpCheckResponse{})
+	if err != nil {
+		t.Fatalf("gRPC upcheck failed with %s", err)
+	}
+	if upCheckResp.Message != upCheckResponse {
+		t.Errorf("gRPC upcheck returned %s, expected %s\n", upCheckResp.Message, upCheckResponse)
+	}
+
+	// The JSON gateway is served over HTTPS and calls the server in-process
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	resp, err := client.Post(fmt.Sprintf("https://%s%s", address, upCheck),
+		"application/json", bytes.NewBufferString("{}"))
+	if err != nil {
+		t.Fatalf("JSON upcheck failed with %s", err)
+	}
+	var jsonResp chimera.UpCheckResponse
+	err = json.NewDecoder(resp.Body).Decode(&jsonResp)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if jsonResp.Message != upCheckResponse {
+		t.Errorf("JSON upcheck returned %s, expected %s\n", jsonResp.Message, upCheckResponse)
+	}
+
+	// Connection pools call nodes with https:// URLs over TLS, verifying them by default
+	upcheck := func(ctx context.Context, cli chimera.ClientClient) error {
+		_, err := cli.Upcheck(ctx, &chimera.UpCheckResponse{})
+		return err
+	}
+	nodeUrl := fmt.Sprintf("https://%s/", address)
+	pool := api.NewGrpcPool(api.DefaultMaxConcurrentCalls, time.Second)
+	defer pool.Close()
+	if err = pool.Invoke(context.Background(), nodeUrl, upcheck); err == nil {
+		t.Errorf("Pool upcheck succeeded with an untrusted certificate")
+	}
+	trustingPool := api.NewGrpcPool(api.DefaultMaxConcurrentCalls, time.Second)
+	defer trustingPool.Close()
+	trustingPool.SetTlsConfig(tlsConfig)
+	if err = trustingPool.Invoke(context.Background(), nodeUrl, upcheck); err != nil {
+		t.Errorf("Pool upcheck failed with %s", err)
+	}
+}
+
+func TestSinglePortTLSInvalidCert(t *testing.T) {
+	freePort, err := GetFreePort("localhost")
+	if err != nil {
+		t.Fatalf("failed to find a free port to start gRPC server: %s", err)
+	}
+	ipcPath, err := ioutil.TempDir("", "TestSinglePortTLSInvalidCert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := "../enclave/testdata/cert/server.crt", "../enclave/testdata/key"
+	_, err = Init(&MockEnclave{}, "localhost", freePort, ipcPath, true, true, certFile, keyFile)
+	if err == nil {
+		t.Errorf("Server started with an invalid TLS key")
+	}
+}
+
+type FailingEnclave struct {
+	MockEnclave
+}
+
+func (s *FailingEnclave) Store(message *[]byte, sender []byte, recipients [][]byte) ([]byte, error) {
+	return nil, api.NewError(api.Unauthorized, "sender public key is not hosted by this node")
+}
+
+func (s *FailingEnclave) StoreWithPrivacy(
+	message *[]byte, sender []byte, recipients [][]byte,
+	privacy api.PrivacyMetadata) ([]byte, error) {
+	return s.Store(message, sender, recipients)
+}
+
+func (s *FailingEnclave) Retrieve(digestHash *[]byte, to *[]byte) ([]byte, error) {
+	return nil, api.NewError(api.NotFound, "payload not found")
+}
+
+func TestErrorResponses(t *testing.T) {
+	tm := TransactionManager{Enclave: &FailingEnclave{}}
+
+	requests := []struct {
+		request  interface{}
+		url      string
+		handler  http.HandlerFunc
+		status   int
+		expected api.ErrorResponse
+	}{
+		{
+			api.SendRequest{Payload: encodedPayload, From: sender},
+			send, tm.send, http.StatusForbidden,
+			api.ErrorResponse{
+				Code: api.Unauthorized, Message: "sender public key is not hosted by this node"},
+		},
+		{
+			api.SendRequest{Payload: "!"},
+			send, tm.send, http.StatusBadRequest,
+			api.ErrorResponse{Code: api.InvalidArgument, Field: "payload"},
+		},
+		{
+			api.ReceiveRequest{Key: encodedPayload, To: receiver},
+			receive, tm.receive, http.StatusNotFound,
+			api.ErrorResponse{Code: api.NotFound, Message: "payload not found"},
+		},
+		{
+			api.ResendRequest{Type: "some", PublicKey: sender},
+			resend, tm.resend, http.StatusBadRequest,
+			api.ErrorResponse{Code: api.InvalidArgument, Field: "type"},
+		},
+	}
+
+	for _, r := range requests {
+		encoded, err := json.Marshal(r.request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest("POST", r.url, bytes.NewBuffer(encoded))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		r.handler.ServeHTTP(rr, req)
+
+		if rr.Code != r.status {
+			t.Errorf("handler returned wrong status code: got %v want %v\n", rr.Code, r.status)
+		}
+		var response api.ErrorResponse
+		err = json.Unmarshal(rr.Body.Bytes(), &response)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response.Code != r.expected.Code || response.Field != r.expected.Field ||
+			(r.expected.Message != "" && response.Message != r.expected.Message) {
+			t.Errorf("handler returned unexpected error: %v, expected: %v\n", response, r.expected)
+		}
+	}
+}
+
+func TestGRPCErrors(t *testing.T) {
+	s := Server{Enclave: &FailingEnclave{}}
+
+	_, err := s.Receive(context.Background(), &chimera.ReceiveRequest{Key: payload, To: receiver})
+	if st, _ := status.FromError(err); st.Code() != codes.NotFound {
+		t.Errorf("gRPC receive returned %v, expected %v\n", st.Code(), codes.NotFound)
+	}
+
+	_, err = s.Send(context.Background(), &chimera.SendRequest{Payload: payload, From: "!"})
+	st, _ := status.FromError(err)
+	if st.Code() != codes.InvalidArgument {
+		t.Errorf("gRPC send returned %v, expected %v\n", st.Code(), codes.InvalidArgument)
+	}
+	if len(st.Details()) != 1 {
+		t.Errorf("gRPC send error should describe the invalid field, details: %v\n", st.Details())
+	}
+
+	for _, in := range []*chimera.PushPayload{{}, {Ep: &chimera.EncryptedPayload{}}} {
+		_, err = s.Push(context.Background(), in)
+		if st, _ := status.FromError(err); st.Code() != codes.InvalidArgument {
+			t.Errorf("gRPC push of %v returned %v, expected %v\n", in, err, codes.InvalidArgument)
+		}
+	}
+}
+
+// grpcNode is a node with a real enclave serving the gRPC API.
+type grpcNode struct {
+	url       string
+	pubKey    []byte
+	ipcPath   string
+	client    chimera.ClientClient
+	publicRaw *RawTransactionClient
+	ipc       chimera.ClientClient
+	raw       *RawTransactionClient
+	db        storage.DataStore
+}
+
+func initGrpcNodes(t *testing.T) (grpcNode, grpcNode, func()) {
+	var cleanup []func()
+	keyNames := []string{"key", "rcpt1"}
+	var nodes []grpcNode
+	var pubKeys []nacl.Key
+
+	for _, keyName := range keyNames {
+		pubKey, err := ioutil.ReadFile(path.Join("../enclave/testdata", keyName+".pub"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, err := utils.LoadBase64Key(string(pubKey))
+		if err != nil {
+			t.Fatal(err)
+		}
+		port, err := GetFreePort("localhost")
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes = append(nodes, grpcNode{
+			url:    fmt.Sprintf("http://localhost:%d", port),
+			pubKey: (*key)[:],
+		})
+		pubKeys = append(pubKeys, key)
+	}
+
+	for i, keyName := range keyNames {
+		other := (i + 1) % len(nodes)
+		dir, err := ioutil.TempDir("", "TestGRPCNode")
+		if err != nil {
+			t.Fatal(err)
+		}
+		cleanup = append(cleanup, func() { os.RemoveAll(dir) })
+
+		db, err := storage.InitLevelDb(path.Join(dir, "db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cleanup = append(cleanup, func() { db.Close() })
+
+		pi := api.CreatePartyInfo(
+			nodes[i].url, []string{nodes[other].url}, []nacl.Key{pubKeys[other]},
+			http.DefaultClient)
+		enc := enclave.Init(db,
+			[]string{path.Join("../enclave/testdata", keyName+".pub")},
+			[]string{path.Join("../enclave/testdata", keyName)},
+			pi, http.DefaultClient, true)
+		if err = enc.EnableAudit(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		nodes[i].db = db
+
+		port, _ := strconv.Atoi(strings.TrimPrefix(nodes[i].url, "http://localhost:"))
+		nodes[i].ipcPath = path.Join(dir, "crux.ipc")
+		_, err = Init(enc, "localhost", port, nodes[i].ipcPath, true, false, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		conn, err := grpc.Dial(fmt.Sprintf("localhost:%d", port), grpc.WithInsecure())
+		if err != nil {
+			t.Fatal(err)
+		}
+		cleanup = append(cleanup, func() { conn.Close() })
+		nodes[i].client = chimera.NewClientClient(conn)
+		nodes[i].publicRaw = NewRawTransactionClient(conn)
+
+		ipcConn, err := grpc.Dial(
+			fmt.Sprintf("passthrough:///unix://%s", nodes[i].ipcPath), grpc.WithInsecure())
+		if err != nil {
+			t.Fatal(err)
+		}
+		cleanup = append(cleanup, func() { ipcConn.Close() })
+		nodes[i].ipc = chimera.NewClientClient(ipcConn)
+		nodes[i].raw = NewRawTransactionClient(ipcConn)
+	}
+
+	return nodes[0], nodes[1], func() {
+		for i := len(cleanup) - 1; i >= 0; i-- {
+			cleanup[i]()
+		}
+	}
+}
+
+// awaitReceive polls node until the payload with the given key is available to it.
+func awaitReceive(t *testing.T, node grpcNode, key []byte) []byte {
+	req := chimera.ReceiveRequest{Key: key, To: base64.StdEncoding.EncodeToString(node.pubKey)}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		resp, err := node.client.Receive(context.Background(), &req)
+		if err == nil {
+			return resp.Payload
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("payload was not received: %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestGRPCAudit(t *testing.T) {
+	node1, node2, cleanup := initGrpcNodes(t)
+	defer cleanup()
+
+	sendResp, err := node1.client.Send(context.Background(), &chimera.SendRequest{
+		Payload: payload,
+		From:    base64.StdEncoding.EncodeToString(node1.pubKey),
+		To:      []string{base64.StdEncoding.EncodeToString(node2.pubKey)},
+	})
+	if err != nil {
+		t.Fatalf("gRPC send failed with %v", err)
+	}
+	awaitReceive(t, node2, sendResp.Key)
+
+	readAudit := func(node grpcNode) []api.AuditEntry {
+		if _, err := enclave.VerifyAudit(context.Background(), node.db, nil); err != nil {
+			t.Fatal(err)
+		}
+		var exported bytes.Buffer
+		if _, err := enclave.ExportAudit(context.Background(), node.db, &exported); err != nil {
+			t.Fatal(err)
+		}
+		var entries []api.AuditEntry
+		decoder := json.NewDecoder(&exported)
+		for decoder.More() {
+			var entry api.AuditEntry
+			if err := decoder.Decode(&entry); err != nil {
+				t.Fatal(err)
+			}
+			entries = append(entries, entry)
+		}
+		return entries
+	}
+
+	digest := base64.StdEncoding.EncodeToString(sendResp.Key)
+	var stored bool
+	for _, entry := range readAudit(node1) {
+		if entry.Operation == api.AuditStore && entry.Digest == digest {
+			stored = true
+			if !strings.HasPrefix(entry.Caller, "127.0.0.1:") || len(entry.Keys) != 2 ||
+				entry.Keys[1] != api.KeyFingerprint(node2.pubKey) {
+				t.Errorf("Unexpected store audit entry: %+v", entry)
+			}
+		}
+	}
+	if !stored {
+		t.Error("Expected the send to be recorded in the audit log of node1")
+	}
+
+	var pushed, retrieved bool
+	for _, entry := range readAudit(node2) {
+		pushed = pushed || entry.Operation == api.AuditPush && entry.Digest == digest
+		retrieved = retrieved || entry.Operation == api.AuditRetrieve &&
+			entry.Digest == digest && entry.Error == ""
+	}
+	if !pushed || !retrieved {
+		t.Errorf("Expected the push and receive to be recorded in the audit log of node2")
+	}
+}
+
+func TestEnhancedPrivacy(t *testing.T) {
+	node1, node2, cleanup := initGrpcNodes(t)
+	defer cleanup()
+
+	post := func(node grpcNode, path string, request, response interface{}) int {
+		body, err := json.Marshal(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.Post(node.url+path, "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			if err = json.NewDecoder(resp.Body).Decode(response); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp.StatusCode
+	}
+	sendReq := api.SendRequest{
+		Payload:     encodedPayload,
+		From:        base64.StdEncoding.EncodeToString(node1.pubKey),
+		To:          []string{base64.StdEncoding.EncodeToString(node2.pubKey)},
+		PrivacyFlag: api.PrivateStateValidation,
+		ExecHash:    base64.StdEncoding.EncodeToString([]byte("3x3c")),
+	}
+
+	var contract api.SendResponse
+	if status := post(node1, send, sendReq, &contract); status != http.StatusOK {
+		t.Fatalf("send returned status %d", status)
+	}
+	contractKey, _ := base64.StdEncoding.DecodeString(contract.Key)
+	awaitReceive(t, node2, contractKey)
+
+	sendReq.AffectedContractTransactions = []string{contract.Key}
+	var sendResp api.SendResponse
+	if status := post(node1, send, sendReq, &sendResp); status != http.StatusOK {
+		t.Fatalf("send returned status %d", status)
+	}
+	key, _ := base64.StdEncoding.DecodeString(sendResp.Key)
+	awaitReceive(t, node2, key)
+
+	var receiveResp api.ReceiveResponse
+	receiveReq := api.ReceiveRequest{
+		Key: sendResp.Key, To: base64.StdEncoding.EncodeToString(node2.pubKey)}
+	if status := post(node2, receive, receiveReq, &receiveResp); status != http.StatusOK {
+		t.Fatalf("receive returned status %d", status)
+	}
+	expected := api.ReceiveResponse{
+		Payload:                      encodedPayload,
+		PrivacyFlag:                  api.PrivateStateValidation,
+		AffectedContractTransactions: []string{contract.Key},
+		ExecHash:                     sendReq.ExecHash,
+	}
+	if !reflect.DeepEqual(receiveResp, expected) {
+		t.Errorf("Received %+v, expected %+v", receiveResp, expected)
+	}
+
+	// Standard transactions cannot affect contracts with enhanced privacy
+	sendReq.PrivacyFlag = api.StandardPrivate
+	if status := post(node1, send, sendReq, &sendResp); status != http.StatusForbidden {
+		t.Errorf("Standard transaction affecting a protected contract returned status %d", status)
+	}
+}
+
+func TestPrivacyGroups(t *testing.T) {
+	node1, node2, cleanup := initGrpcNodes(t)
+	defer cleanup()
+
+	ipcPost := func(node grpcNode, path string, request, response interface{}) int {
+		body, err := json.Marshal(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := utils.IpcClient(node.ipcPath).Post(
+			"http://localhost"+path, "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			if err = json.NewDecoder(resp.Body).Decode(response); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp.StatusCode
+	}
+	from := base64.StdEncoding.EncodeToString(node1.pubKey)
+	members := []string{from, base64.StdEncoding.EncodeToString(node2.pubKey)}
+
+	var group api.PrivacyGroup
+	createReq := api.CreatePrivacyGroupRequest{From: from, Name: "group", Members: members}
+	if status := ipcPost(node1, createPrivacyGroup, createReq, &group); status != http.StatusOK {
+		t.Fatalf("createPrivacyGroup returned status %d", status)
+	}
+
+	// The group has been distributed to node2
+	var found []api.PrivacyGroup
+	findReq := api.FindPrivacyGroupRequest{Addresses: members}
+	if status := ipcPost(node2, findPrivacyGroup, findReq, &found); status != http.StatusOK {
+		t.Fatalf("findPrivacyGroup returned status %d", status)
+	}
+	if len(found) != 1 || !reflect.DeepEqual(found[0], group) {
+		t.Errorf("Found %+v, expected %+v", found, group)
+	}
+
+	// gRPC clients send to a privacy group via metadata
+	ctx := grpcmetadata.AppendToOutgoingContext(
+		context.Background(), privacyGroupMetadata, group.PrivacyGroupId)
+	sendResp, err := node1.client.Send(ctx, &chimera.SendRequest{Payload: payload, From: from})
+	if err != nil {
+		t.Fatalf("gRPC send failed with %v", err)
+	}
+	awaitReceive(t, node2, sendResp.Key)
+
+	var receiveResp api.ReceiveResponse
+	resp, err := http.Post(node2.url+receive, "application/json", strings.NewReader(fmt.Sprintf(
+		`{"key": "%s", "to": "%s"}`,
+		base64.StdEncoding.EncodeToString(sendResp.Key), members[1])))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if err = json.NewDecoder(resp.Body).Decode(&receiveResp); err != nil {
+		t.Fatal(err)
+	}
+	if receiveResp.PrivacyGroupId != group.PrivacyGroupId {
+		t.Errorf("Received privacy group %s, expected %s",
+			receiveResp.PrivacyGroupId, group.PrivacyGroupId)
+	}
+
+	var deleted string
+	groupReq := api.PrivacyGroupRequest{PrivacyGroupId: group.PrivacyGroupId, From: from}
+	if status := ipcPost(node1, deletePrivacyGroup, groupReq, &deleted); status != http.StatusOK {
+		t.Fatalf("deletePrivacyGroup returned status %d", status)
+	}
+	var retrieved api.PrivacyGroup
+	groupReq.From = ""
+	code := ipcPost(node2, retrievePrivacyGroup, groupReq, &retrieved)
+	if code != http.StatusOK {
+		t.Fatalf("retrievePrivacyGroup returned status %d", code)
+	}
+	if deleted != group.PrivacyGroupId || retrieved.State != api.DeletedGroup {
+		t.Errorf("Expected privacy group %s to be deleted, actual: %+v", deleted, retrieved)
+	}
+
+	_, err = node1.client.Send(ctx, &chimera.SendRequest{Payload: payload, From: from})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("Sending to a deleted privacy group should fail, actual: %v", err)
+	}
+}
+
+func TestGRPCRawTransaction(t *testing.T) {
+	node1, node2, cleanup := initGrpcNodes(t)
+	defer cleanup()
+	ctx := context.Background()
+	from := base64.StdEncoding.EncodeToString(node1.pubKey)
+
+	// The raw transaction service is only served over IPC
+	_, err := node1.publicRaw.StoreRaw(ctx, &chimera.SendRequest{Payload: payload, From: from})
+	if status.Code(err) != codes.Unimplemented {
+		t.Errorf("Expected store raw on the public port to be unimplemented, actual: %v", err)
+	}
+
+	storeResp, err := node1.raw.StoreRaw(ctx, &chimera.SendRequest{Payload: payload, From: from})
+	if err != nil {
+		t.Fatalf("gRPC store raw failed with %v", err)
+	}
+
+	// Raw payloads are not sent until their transaction is signed
+	_, err = node1.client.Receive(ctx, &chimera.ReceiveRequest{Key: storeResp.Key, To: from})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("Expected the raw payload to be not found, actual: %v", err)
+	}
+
+	sendResp, err := node1.raw.SendSignedTx(ctx, &chimera.SendRequest{
+		Payload: storeResp.Key,
+		To:      []string{base64.StdEncoding.EncodeToString(node2.pubKey)},
+	})
+	if err != nil {
+		t.Fatalf("gRPC send signed transaction failed with %v", err)
+	}
+	if !bytes.Equal(sendResp.Key, storeResp.Key) {
+		t.Errorf("Sent under key %x, expected %x", sendResp.Key, storeResp.Key)
+	}
+	if received := awaitReceive(t, node2, sendResp.Key); !bytes.Equal(received, payload) {
+		t.Errorf("Received %v, expected %v", received, payload)
+	}
+
+	_, err = node1.raw.SendSignedTx(ctx, &chimera.SendRequest{Payload: []byte("unknown")})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("Expected an unknown raw payload to be not found, actual: %v", err)
+	}
+}
+
+func TestReceiveDetails(t *testing.T) {
+	node1, node2, cleanup := initGrpcNodes(t)
+	defer cleanup()
+	from := base64.StdEncoding.EncodeToString(node1.pubKey)
+	to := base64.StdEncoding.EncodeToString(node2.pubKey)
+
+	sendResp, err := node1.client.Send(context.Background(), &chimera.SendRequest{
+		Payload: payload, From: from, To: []string{to}})
+	if err != nil {
+		t.Fatalf("gRPC send failed with %v", err)
+	}
+	awaitReceive(t, node2, sendResp.Key)
+	key := base64.StdEncoding.EncodeToString(sendResp.Key)
+
+	tests := []struct {
+		node     grpcNode
+		expected api.ReceiveDetailsResponse
+	}{
+		{node1, api.ReceiveDetailsResponse{
+			DecryptedBy: from, Sender: from, Recipients: []string{to}}},
+		{node2, api.ReceiveDetailsResponse{DecryptedBy: to, Sender: from}},
+	}
+	for _, test := range tests {
+		body, err := json.Marshal(api.ReceiveRequest{Key: key, To: test.expected.DecryptedBy})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.Post(
+			test.node.url+receiveDetails, "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var detailsResp api.ReceiveDetailsResponse
+		err = json.NewDecoder(resp.Body).Decode(&detailsResp)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		test.expected.Payload = encodedPayload
+		if !reflect.DeepEqual(detailsResp, test.expected) {
+			t.Errorf("Received %+v, expected %+v", detailsResp, test.expected)
+		}
+	}
+
+	// gRPC clients ask for the details in metadata, and receive them in the response header
+	var header grpcmetadata.MD
+	ctx := grpcmetadata.AppendToOutgoingContext(
+		context.Background(), receiveDetailsMetadata, "true")
+	receiveResp, err := node2.client.Receive(
+		ctx, &chimera.ReceiveRequest{Key: sendResp.Key, To: to}, grpc.Header(&header))
+	if err != nil {
+		t.Fatalf("gRPC receive failed with %v", err)
+	}
+	if !bytes.Equal(receiveResp.Payload, payload) {
+		t.Errorf("Received %v, expected %v", receiveResp.Payload, payload)
+	}
+	expected := map[string][]string{"decrypted-by": {to}, "sender": {from}}
+	for name, values := range expected {
+		if !reflect.DeepEqual(header.Get(name), values) {
+			t.Errorf("Received %s header %v, expected %v", name, header.Get(name), values)
+		}
+	}
+	if len(header.Get("recipients")) != 0 {
+		t.Errorf("Received unexpected recipients %v", header.Get("recipients"))
+	}
+}
+
+func TestGRPCDeleteAndResend(t *testing.T) {
+	node1, node2, cleanup := initGrpcNodes(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	sendResp, err := node1.client.Send(ctx, &chimera.SendRequest{
+		Payload: payload,
+		From:    base64.StdEncoding.EncodeToString(node1.pubKey),
+		To:      []string{base64.StdEncoding.EncodeToString(node2.pubKey)},
+	})
+	if err != nil {
+		t.Fatalf("gRPC send failed with %v", err)
+	}
+	key := sendResp.Key
+
+	if received := awaitReceive(t, node2, key); !bytes.Equal(received, payload) {
+		t.Errorf("received payload %v, expected %v", received, payload)
+	}
+
+	_, err = node2.client.Delete(ctx, &chimera.DeleteRequest{Key: key})
+	if st, _ := status.FromError(err); st.Code() != codes.PermissionDenied {
+		t.Errorf("delete on the public port returned %v, expected %v", err, codes.PermissionDenied)
+	}
+	deleteResp, err := node2.ipc.Delete(ctx, &chimera.DeleteRequest{Key: key})
+	if err != nil {
+		t.Fatalf("gRPC delete failed with %v", err)
+	}
+	if !bytes.Equal(deleteResp.Key, key) {
+		t.Errorf("delete returned key %v, expected %v", deleteResp.Key, key)
+	}
+	_, err = node2.client.Receive(ctx, &chimera.ReceiveRequest{
+		Key: key, To: base64.StdEncoding.EncodeToString(node2.pubKey)})
+	if st, _ := status.FromError(err); st.Code() != codes.NotFound {
+		t.Errorf("receive of deleted payload returned %v, expected %v", err, codes.NotFound)
+	}
+
+	resendResp, err := node1.client.Resend(ctx, &chimera.ResendRequest{
+		Type: "individual", PublicKey: node2.pubKey, Key: key})
+	if err != nil {
+		t.Fatalf("gRPC individual resend failed with %v", err)
+	}
+	epl := api.DecodePayload(resendResp.Encoded)
+	if !bytes.Equal(utils.Sha3Hash(epl.CipherText), key) || len(epl.RecipientBoxes) != 1 {
+		t.Errorf("individual resend returned unexpected payload %v", epl)
+	}
+
+	resendResp, err = node1.client.Resend(ctx, &chimera.ResendRequest{
+		Type: "all", PublicKey: node2.pubKey})
+	if err != nil {
+		t.Fatalf("gRPC resend of all payloads failed with %v", err)
+	}
+	if resendResp == nil {
+		t.Error("resend of all payloads should return an empty response")
+	}
+	if received := awaitReceive(t, node2, key); !bytes.Equal(received, payload) {
+		t.Errorf("resent payload %v, expected %v", received, payload)
+	}
+
+	_, err = node1.client.Resend(ctx, &chimera.ResendRequest{
+		Type: "some", PublicKey: node2.pubKey})
+	if st, _ := status.FromError(err); st.Code() != codes.InvalidArgument {
+		t.Errorf("invalid resend type returned %v, expected %v", err, codes.InvalidArgument)
+	}
+}
+
+func TestIPCBackup(t *testing.T) {
+	node1, node2, cleanup := initGrpcNodes(t)
+	defer cleanup()
+
+	sendResp, err := node1.client.Send(context.Background(), &chimera.SendRequest{
+		Payload: payload,
+		From:    base64.StdEncoding.EncodeToString(node1.pubKey),
+		To:      []string{base64.StdEncoding.EncodeToString(node2.pubKey)},
+	})
+	if err != nil {
+		t.Fatalf("gRPC send failed with %v", err)
+	}
+
+	resp, err := utils.IpcClient(node1.ipcPath).Get("http://localhost" + backup)
+	if err != nil {
+		t.Fatalf("backup request failed with %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("backup returned status %d", resp.StatusCode)
+	}
+
+	found := false
+	_, err = storage.ReadBackup(resp.Body, nil, func(key, value []byte) error {
+		if bytes.Equal(key, sendResp.Key) {
+			found = true
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("invalid backup: %v", err)
+	}
+	if !found {
+		t.Errorf("backup does not contain the payload %v", sendResp.Key)
+	}
+}
+
+func TestIPCMetadata(t *testing.T) {
+	node1, node2, cleanup := initGrpcNodes(t)
+	defer cleanup()
+
+	sendResp, err := node1.client.Send(context.Background(), &chimera.SendRequest{
+		Payload: payload,
+		From:    base64.StdEncoding.EncodeToString(node1.pubKey),
+		To:      []string{base64.StdEncoding.EncodeToString(node2.pubKey)},
+	})
+	if err != nil {
+		t.Fatalf("gRPC send failed with %v", err)
+	}
+	awaitReceive(t, node2, sendResp.Key)
+
+	getMetadata := func(node grpcNode) api.PayloadMetadata {
+		query := url.Values{"key": {base64.StdEncoding.EncodeToString(sendResp.Key)}}
+		resp, err := utils.IpcClient(node.ipcPath).Get(
+			"http://localhost" + metadata + "?" + query.Encode())
+		if err != nil {
+			t.Fatalf("metadata request failed with %v", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("metadata returned status %d", resp.StatusCode)
+		}
+		var meta api.PayloadMetadata
+		if err = json.NewDecoder(resp.Body).Decode(&meta); err != nil {
+			t.Fatal(err)
+		}
+		return meta
+	}
+
+	sent := getMetadata(node1)
+	if sent.Origin != api.LocalOrigin || sent.Created == nil || len(sent.Recipients) != 1 ||
+		sent.Recipients[0].Status != api.Delivered {
+		t.Errorf("Unexpected metadata of the sent payload: %+v", sent)
+	}
+	received := getMetadata(node2)
+	if received.Origin != node1.url || received.Created != nil || len(received.Recipients) != 0 {
+		t.Errorf("Unexpected metadata of the received payload: %+v", received)
+	}
+}
+
+func TestIPCShare(t *testing.T) {
+	node1, node2, cleanup := initGrpcNodes(t)
+	defer cleanup()
+
+	sendResp, err := node1.client.Send(context.Background(), &chimera.SendRequest{
+		Payload: payload,
+		From:    base64.StdEncoding.EncodeToString(node1.pubKey),
+	})
+	if err != nil {
+		t.Fatalf("gRPC send failed with %v", err)
+	}
+
+	body, err := json.Marshal(api.ShareRequest{
+		Key:  base64.StdEncoding.EncodeToString(sendResp.Key),
+		From: base64.StdEncoding.EncodeToString(node1.pubKey),
+		To:   []string{base64.StdEncoding.EncodeToString(node2.pubKey)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := utils.IpcClient(node1.ipcPath).Post(
+		"http://localhost"+share, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("share request failed with %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("share returned status %d", resp.StatusCode)
+	}
+	var shareResp api.ShareResponse
+	if err = json.NewDecoder(resp.Body).Decode(&shareResp); err != nil {
+		t.Fatal(err)
+	}
+	if len(shareResp.Recipients) != 1 || shareResp.Recipients[0].Status != api.Delivered {
+		t.Errorf("Expected the payload to be delivered to node2, actual: %+v", shareResp.Recipients)
+	}
+	awaitReceive(t, node2, sendResp.Key)
+}
+
+func TestIPCErase(t *testing.T) {
+	node1, node2, cleanup := initGrpcNodes(t)
+	defer cleanup()
+
+	sendResp, err := node1.client.Send(context.Background(), &chimera.SendRequest{
+		Payload: payload,
+		From:    base64.StdEncoding.EncodeToString(node1.pubKey),
+		To:      []string{base64.StdEncoding.EncodeToString(node2.pubKey)},
+	})
+	if err != nil {
+		t.Fatalf("gRPC send failed with %v", err)
+	}
+	awaitReceive(t, node2, sendResp.Key)
+
+	body, err := json.Marshal(api.EraseRequest{Key: base64.StdEncoding.EncodeToString(sendResp.Key)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := utils.IpcClient(node1.ipcPath).Post(
+		"http://localhost"+erase, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("erase request failed with %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("erase returned status %d", resp.StatusCode)
+	}
+	var eraseResp api.EraseResponse
+	if err = json.NewDecoder(resp.Body).Decode(&eraseResp); err != nil {
+		t.Fatal(err)
+	}
+	if len(eraseResp.Recipients) != 1 || eraseResp.Recipients[0].Status != api.Acknowledged {
+		t.Errorf("Expected node2 to acknowledge the deletion, actual: %+v", eraseResp.Recipients)
+	}
+
+	for _, node := range []grpcNode{node1, node2} {
+		_, err = node.client.Receive(context.Background(), &chimera.ReceiveRequest{
+			Key: sendResp.Key, To: base64.StdEncoding.EncodeToString(node.pubKey)})
+		if status.Code(err) != codes.NotFound {
+			t.Errorf("Expected the erased payload to be not found, actual: %v", err)
+		}
+	}
+}
@@ -0,0 +1,411 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/kevinburke/nacl"
+	"github.com/kevinburke/nacl/secretbox"
+	"golang.org/x/crypto/sha3"
+	"golang.org/x/net/context"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"time"
+)
+
+// A backup consists of a header followed by a stream of length prefixed chunks. When the backup
+// is encrypted, each chunk is sealed with secretbox under the backup key, using the random nonce
+// prefix from the header followed by the chunk number as its nonce.
+//
+// The chunks contain the records, each a uvarint length prefixed key and value, terminated by an
+// empty key, the uvarint number of records and the SHA3-512 hash of the preceding records, so
+// that truncated backups are detected.
+var backupMagic = []byte("crux-backup\x00")
+
+const (
+	backupVersion   = 1
+	backupPlain     = 0
+	backupEncrypted = 1
+
+	backupChunkSize     = 64 * 1024
+	backupChunkOverhead = 16 // The secretbox authenticator
+	backupNoncePrefix   = nacl.NonceSize - 8
+	maxBackupRecordSize = 1 << 30
+)
+
+// invalidBackup returns the error for a backup which is truncated, corrupt or cannot be decrypted.
+func invalidBackup(format string, a ...interface{}) error {
+	return fmt.Errorf("storage: invalid backup: %s", fmt.Sprintf(format, a...))
+}
+
+// BackupWriter writes the records of a backup.
+type BackupWriter struct {
+	w           io.Writer
+	key         nacl.Key
+	noncePrefix []byte
+	chunk       uint64
+	buf         []byte
+	hash        hash.Hash
+	count       uint64
+}
+
+// NewBackupWriter writes the header of a backup to w. If key is not nil, the backup is
+// encrypted with it.
+func NewBackupWriter(w io.Writer, key nacl.Key) (*BackupWriter, error) {
+	bw := &BackupWriter{w: w, key: key, hash: sha3.New512()}
+
+	header := append([]byte{}, backupMagic...)
+	header = append(header, backupVersion)
+	if key == nil {
+		header = append(header, backupPlain)
+	} else {
+		bw.noncePrefix = nacl.NewNonce()[:backupNoncePrefix]
+		header = append(header, backupEncrypted)
+		header = append(header, bw.noncePrefix...)
+	}
+	_, err := w.Write(header)
+	if err != nil {
+		return nil, err
+	}
+	return bw, nil
+}
+
+// Write adds a record to the backup.
+func (bw *BackupWriter) Write(key, value []byte) error {
+	if len(key) == 0 {
+		return errors.New("storage: cannot back up an empty key")
+	}
+	record := appendBytes(appendBytes(nil, key), value)
+	bw.hash.Write(record)
+	bw.count++
+	return bw.write(record)
+}
+
+// Count returns the number of records written to the backup.
+func (bw *BackupWriter) Count() int {
+	return int(bw.count)
+}
+
+// Close terminates the backup, it does not close the underlying writer.
+func (bw *BackupWriter) Close() error {
+	end := appendUvarint(appendUvarint(nil, 0), bw.count)
+	end = bw.hash.Sum(end)
+	err := bw.write(end)
+	if err == nil && len(bw.buf) > 0 {
+		err = bw.flush()
+	}
+	return err
+}
+
+func (bw *BackupWriter) write(p []byte) error {
+	bw.buf = append(bw.buf, p...)
+	for len(bw.buf) >= backupChunkSize {
+		if err := bw.flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flush writes the next chunk from the buffered records.
+func (bw *BackupWriter) flush() error {
+	n := len(bw.buf)
+	if n > backupChunkSize {
+		n = backupChunkSize
+	}
+	chunk := bw.buf[:n]
+	if bw.key != nil {
+		chunk = secretbox.Seal(nil, chunk, chunkNonce(bw.noncePrefix, bw.chunk), bw.key)
+	}
+	bw.chunk++
+
+	length := make([]byte, 4)
+	binary.BigEndian.PutUint32(length, uint32(len(chunk)))
+	_, err := bw.w.Write(append(length, chunk...))
+	bw.buf = append(bw.buf[:0], bw.buf[n:]...)
+	return err
+}
+
+func chunkNonce(prefix []byte, chunk uint64) nacl.Nonce {
+	nonce := new([nacl.NonceSize]byte)
+	copy(nonce[:], prefix)
+	binary.BigEndian.PutUint64(nonce[backupNoncePrefix:], chunk)
+	return nonce
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	encoded := make([]byte, binary.MaxVarintLen64)
+	return append(b, encoded[:binary.PutUvarint(encoded, v)]...)
+}
+
+func appendBytes(b, value []byte) []byte {
+	return append(appendUvarint(b, uint64(len(value))), value...)
+}
+
+// WriteBackup writes every record in db to w, encrypting them if key is not nil, and returns the
+// number of records written. The records are read with a single call to Iterate, so the backup
+// is a consistent snapshot of the store, except for the bdb: and dir: backends.
+func WriteBackup(ctx context.Context, db DataStore, w io.Writer, key nacl.Key) (int, error) {
+	bw, err := NewBackupWriter(w, key)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	err = db.Iterate(ctx, All, func(key, value []byte) error {
+		count++
+		return bw.Write(key, value)
+	})
+	if err == nil {
+		err = bw.Close()
+	}
+	return count, err
+}
+
+// chunkReader returns the contents of the chunks of a backup.
+type chunkReader struct {
+	r           io.Reader
+	key         nacl.Key
+	noncePrefix []byte
+	chunk       uint64
+	buf         []byte
+}
+
+func (cr *chunkReader) Read(p []byte) (int, error) {
+	if len(cr.buf) == 0 {
+		if err := cr.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, cr.buf)
+	cr.buf = cr.buf[n:]
+	return n, nil
+}
+
+func (cr *chunkReader) next() error {
+	length := make([]byte, 4)
+	_, err := io.ReadFull(cr.r, length)
+	if err == io.EOF {
+		return err
+	} else if err != nil {
+		return invalidBackup("truncated chunk")
+	}
+	n := binary.BigEndian.Uint32(length)
+	if n > backupChunkSize+backupChunkOverhead {
+		return invalidBackup("chunk of %d bytes is too large", n)
+	}
+	chunk := make([]byte, n)
+	if _, err = io.ReadFull(cr.r, chunk); err != nil {
+		return invalidBackup("truncated chunk")
+	}
+
+	if cr.key != nil {
+		var ok bool
+		chunk, ok = secretbox.Open(nil, chunk, chunkNonce(cr.noncePrefix, cr.chunk), cr.key)
+		if !ok {
+			return invalidBackup("unable to decrypt chunk %d, is the backup key correct?", cr.chunk)
+		}
+	}
+	cr.chunk++
+	cr.buf = chunk
+	return nil
+}
+
+// ReadBackup reads the backup written to r, decrypting it with key if it is encrypted, and calls
+// f with each record. It returns the number of records read, or an error if the backup is
+// truncated or corrupt. As this is only detected at the end of the backup, the records
+// passed to f must not be relied upon until ReadBackup has returned successfully.
+func ReadBackup(r io.Reader, key nacl.Key, f func(key, value []byte) error) (int, error) {
+	header := make([]byte, len(backupMagic)+2)
+	if _, err := io.ReadFull(r, header); err != nil || !bytes.HasPrefix(header, backupMagic) {
+		return 0, invalidBackup("not a Crux backup")
+	}
+	if header[len(backupMagic)] != backupVersion {
+		return 0, invalidBackup("unsupported version %d", header[len(backupMagic)])
+	}
+
+	cr := &chunkReader{r: r}
+	switch header[len(backupMagic)+1] {
+	case backupPlain:
+	case backupEncrypted:
+		if key == nil {
+			return 0, errors.New("storage: the backup is encrypted, a backup key is required")
+		}
+		cr.key = key
+		cr.noncePrefix = make([]byte, backupNoncePrefix)
+		if _, err := io.ReadFull(r, cr.noncePrefix); err != nil {
+			return 0, invalidBackup("truncated header")
+		}
+	default:
+		return 0, invalidBackup("unknown encryption mode %d", header[len(backupMagic)+1])
+	}
+
+	br := bufio.NewReader(cr)
+	h := sha3.New512()
+	count := 0
+	for {
+		key, err := readBytes(br)
+		if err != nil {
+			return count, err
+		}
+		if len(key) == 0 {
+			break
+		}
+		value, err := readBytes(br)
+		if err != nil {
+			return count, err
+		}
+		h.Write(appendBytes(appendBytes(nil, key), value))
+		count++
+		if err = f(key, value); err != nil {
+			return count, err
+		}
+	}
+
+	expectedCount, err := binary.ReadUvarint(br)
+	if err != nil {
+		return count, readError(err)
+	}
+	sum := make([]byte, h.Size())
+	if _, err = io.ReadFull(br, sum); err != nil {
+		return count, readError(err)
+	}
+	if expectedCount != uint64(count) || !bytes.Equal(sum, h.Sum(nil)) {
+		return count, invalidBackup("checksum mismatch")
+	}
+	if _, err = br.ReadByte(); err != io.EOF {
+		return count, invalidBackup("unexpected data after the end of the backup")
+	}
+	return count, nil
+}
+
+func readBytes(br *bufio.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, readError(err)
+	}
+	if n > maxBackupRecordSize {
+		return nil, invalidBackup("record of %d bytes is too large", n)
+	}
+	b := make([]byte, n)
+	if _, err = io.ReadFull(br, b); err != nil {
+		return nil, readError(err)
+	}
+	return b, nil
+}
+
+// readError converts the end of the records of a backup being reached early to an error.
+func readError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return invalidBackup("truncated backup")
+	}
+	return err
+}
+
+// restoreBatchSize is the number of records written in each batch by Restore.
+const restoreBatchSize = 1000
+
+// Restore replaces the store described by the storage URL spec with the backup read from r,
+// which is decrypted with key if it is encrypted. Each record is checked with verify, if it is
+// not nil. The backup is restored into a new store alongside the existing one, which is wrapped
+// with wrap if it is not nil, and is only swapped in once every record has been read and
+// verified. The existing store is kept, and its new path is returned along with the number of
+// records restored.
+//
+// The store must not be in use, which is checked by taking its lock, and PostgreSQL databases
+// cannot be restored into.
+func Restore(
+	ctx context.Context, spec, workDir string, r io.Reader, key nacl.Key,
+	verify func(key, value []byte) error,
+	wrap func(DataStore) (DataStore, error)) (int, string, error) {
+
+	storageType, dbPath := ParseUrl(spec)
+	if storageType == "postgres" || storageType == "postgresql" {
+		return 0, "", errors.New(
+			"storage: cannot restore into PostgreSQL, restore into another backend and migrate it")
+	}
+	if !path.IsAbs(dbPath) {
+		dbPath = path.Join(workDir, dbPath)
+	}
+
+	lock, err := LockStore(spec, workDir)
+	if err != nil {
+		return 0, "", err
+	}
+	defer lock.Close()
+
+	_, err = os.Stat(dbPath)
+	exists := err == nil
+	if exists {
+		// Opening LevelDB and bbolt stores also fails if they are used by a node of an earlier
+		// version, which does not take the lock
+		db, err := Open(spec, workDir)
+		if err != nil {
+			return 0, "", fmt.Errorf("unable to open %s, is Crux still running? %v", spec, err)
+		}
+		db.Close()
+	}
+
+	restorePath := dbPath + ".restore"
+	if err = os.RemoveAll(restorePath); err != nil {
+		return 0, "", err
+	}
+	db, err := Open(storageType+":"+restorePath, "")
+	if err == nil && wrap != nil {
+		db, err = wrap(db)
+	}
+	if err != nil {
+		os.RemoveAll(restorePath)
+		return 0, "", err
+	}
+	count, err := restoreInto(ctx, db, r, key, verify)
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.RemoveAll(restorePath)
+		return count, "", err
+	}
+
+	var previousPath string
+	if exists {
+		previousPath = dbPath + ".pre-restore-" + time.Now().Format("20060102150405")
+		if err = os.Rename(dbPath, previousPath); err != nil {
+			return count, "", err
+		}
+		// Records files alongside standalone Berkeley DB files are kept with their database
+		err = os.Rename(dbPath+recordsSuffix, previousPath+recordsSuffix)
+		if err != nil && !os.IsNotExist(err) {
+			return count, "", err
+		}
+	}
+	return count, previousPath, os.Rename(restorePath, dbPath)
+}
+
+func restoreInto(
+	ctx context.Context, db DataStore, r io.Reader, key nacl.Key,
+	verify func(key, value []byte) error) (int, error) {
+
+	batch := new(Batch)
+	count, err := ReadBackup(r, key, func(key, value []byte) error {
+		if verify != nil {
+			if err := verify(key, value); err != nil {
+				return fmt.Errorf("record %x failed verification: %v", key, err)
+			}
+		}
+		batch.Put(key, value)
+		if batch.Len() < restoreBatchSize {
+			return nil
+		}
+		err := db.WriteBatch(ctx, batch)
+		batch = new(Batch)
+		return err
+	})
+	if err != nil {
+		return count, err
+	}
+	return count, db.WriteBatch(ctx, batch)
+}
@@ -0,0 +1,195 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/kevinburke/nacl"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// backupRecords returns enough records to span several backup chunks.
+func backupRecords() map[string][]byte {
+	records := make(map[string][]byte)
+	for i := 0; i < 100; i++ {
+		records[fmt.Sprintf("key%03d", i)] = bytes.Repeat([]byte{byte(i)}, 4096)
+	}
+	records["empty"] = []byte{}
+	return records
+}
+
+func writeTestBackup(t *testing.T, records map[string][]byte, key nacl.Key) []byte {
+	workDir, err := ioutil.TempDir("", "TestBackup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
+
+	db, err := Open("leveldb:db", workDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for k, v := range records {
+		if err := db.Write(ctx, []byte(k), v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	count, err := WriteBackup(ctx, db, &buf, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != len(records) {
+		t.Errorf("Backed up %d records, expected %d", count, len(records))
+	}
+	return buf.Bytes()
+}
+
+func readTestBackup(backup []byte, key nacl.Key) (map[string][]byte, error) {
+	records := make(map[string][]byte)
+	_, err := ReadBackup(bytes.NewReader(backup), key, func(key, value []byte) error {
+		records[string(key)] = value
+		return nil
+	})
+	return records, err
+}
+
+func TestBackupAndRestore(t *testing.T) {
+	records := backupRecords()
+	for _, key := range []nacl.Key{nil, nacl.NewKey()} {
+		backup := writeTestBackup(t, records, key)
+		if key != nil && bytes.Contains(backup, records["key001"]) {
+			t.Errorf("Encrypted backup contains plaintext records")
+		}
+
+		restored, err := readTestBackup(backup, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(restored) != len(records) {
+			t.Errorf("Restored %d records, expected %d", len(restored), len(records))
+		}
+		for k, v := range records {
+			if !bytes.Equal(restored[k], v) {
+				t.Errorf("Restored record %s does not match the original", k)
+			}
+		}
+	}
+}
+
+func TestReadInvalidBackup(t *testing.T) {
+	key := nacl.NewKey()
+	backup := writeTestBackup(t, backupRecords(), key)
+	tampered := append([]byte{}, backup...)
+	tampered[len(tampered)/2] ^= 1
+
+	tests := []struct {
+		name   string
+		backup []byte
+		key    nacl.Key
+		err    string
+	}{
+		{"wrong key", backup, nacl.NewKey(), "unable to decrypt"},
+		{"no key", backup, nil, "backup key is required"},
+		{"truncated", backup[:len(backup)-100], key, "truncated"},
+		{"truncated at chunk", backup[:len(backupMagic)+2+backupNoncePrefix], key, "truncated"},
+		{"tampered", tampered, key, "unable to decrypt"},
+		{"trailing data", append(append([]byte{}, backup...), 0), key, "after the end"},
+		{"not a backup", []byte("payload"), key, "not a Crux backup"},
+	}
+
+	for _, test := range tests {
+		_, err := readTestBackup(test.backup, test.key)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: reading backup returned %v, expected %s", test.name, err, test.err)
+		}
+	}
+
+	// Without encryption, the checksum detects modified records
+	plain := writeTestBackup(t, map[string][]byte{"key": []byte("value")}, nil)
+	plain[bytes.Index(plain, []byte("value"))] = 'V'
+	if _, err := readTestBackup(plain, nil); err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Errorf("Reading modified backup returned %v, expected checksum mismatch", err)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	workDir, err := ioutil.TempDir("", "TestRestore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
+
+	records := map[string][]byte{"key1": []byte("value1"), "key2": []byte("value2")}
+	key := nacl.NewKey()
+	backup := writeTestBackup(t, records, key)
+
+	db, err := Open("bolt:crux.bolt", workDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Write(ctx, []byte("key3"), []byte("value3")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The store cannot be restored while it is in use
+	_, _, err = Restore(ctx, "bolt:crux.bolt", workDir, bytes.NewReader(backup), key, nil, nil)
+	if err == nil {
+		t.Errorf("Restoring a store which is in use should fail")
+	}
+	db.Close()
+
+	// Nor while a node holds its lock, whether or not the backend locks the store itself
+	lock, err := LockStore("bolt:crux.bolt", workDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = Restore(ctx, "bolt:crux.bolt", workDir, bytes.NewReader(backup), key, nil, nil)
+	if err != ErrLocked {
+		t.Errorf("Restoring a locked store returned %v, expected %v", err, ErrLocked)
+	}
+	lock.Close()
+
+	// Nothing is restored if any record fails verification
+	_, _, err = Restore(ctx, "bolt:crux.bolt", workDir, bytes.NewReader(backup), key,
+		func(key, value []byte) error {
+			if string(key) == "key2" {
+				return fmt.Errorf("invalid record")
+			}
+			return nil
+		}, nil)
+	if err == nil || !strings.Contains(err.Error(), "invalid record") {
+		t.Errorf("Restore returned %v, expected verification failure", err)
+	}
+	if _, err := os.Stat(path.Join(workDir, "crux.bolt.restore")); !os.IsNotExist(err) {
+		t.Errorf("Failed restore should be removed, stat returned %v", err)
+	}
+
+	count, previous, err := Restore(
+		ctx, "bolt:crux.bolt", workDir, bytes.NewReader(backup), key, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != len(records) {
+		t.Errorf("Restored %d records, expected %d", count, len(records))
+	}
+
+	for spec, expected := range map[string][]string{
+		"bolt:crux.bolt":   {"key1", "key2"},
+		"bolt:" + previous: {"key3"},
+	} {
+		db, err := Open(spec, workDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if keys := iterateKeys(t, db, All); strings.Join(keys, ",") != strings.Join(expected, ",") {
+			t.Errorf("%s contains %v, expected %v", spec, keys, expected)
+		}
+		db.Close()
+	}
+}
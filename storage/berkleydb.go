@@ -1,87 +1,336 @@
+// +build bdb
+
 package storage
 
+// #cgo LDFLAGS: -ldb
+// #include <stdlib.h>
+// #include <string.h>
+// #include <db.h>
+//
+// // Berkeley DB methods are function pointers, which cannot be called from Go directly.
+//
+// static int crux_env_open(DB_ENV **envp, const char *home) {
+// 	int ret = db_env_create(envp, 0);
+// 	if (ret != 0) {
+// 		return ret;
+// 	}
+// 	// The same environment flags as Constellation, so that stores can be shared
+// 	ret = (*envp)->open(*envp, home,
+// 		DB_CREATE | DB_INIT_LOCK | DB_INIT_LOG | DB_INIT_MPOOL | DB_INIT_TXN | DB_RECOVER |
+// 		DB_THREAD, 0);
+// 	if (ret != 0) {
+// 		(*envp)->close(*envp, 0);
+// 		*envp = NULL;
+// 	}
+// 	return ret;
+// }
+//
+// static int crux_env_close(DB_ENV *env) {
+// 	return env->close(env, 0);
+// }
+//
+// static int crux_db_open(DB_ENV *env, DB **dbp, const char *file, int exists) {
+// 	int ret = db_create(dbp, env, 0);
+// 	if (ret != 0) {
+// 		return ret;
+// 	}
+// 	u_int32_t flags = DB_THREAD;
+// 	if (env != NULL) {
+// 		flags |= DB_AUTO_COMMIT;
+// 	}
+// 	DBTYPE type = DB_UNKNOWN;
+// 	if (!exists) {
+// 		type = DB_HASH;
+// 		flags |= DB_CREATE;
+// 	}
+// 	ret = (*dbp)->open(*dbp, NULL, file, NULL, type, flags, 0600);
+// 	if (ret != 0) {
+// 		(*dbp)->close(*dbp, 0);
+// 		*dbp = NULL;
+// 	}
+// 	return ret;
+// }
+//
+// static int crux_db_close(DB *db) {
+// 	return db->close(db, 0);
+// }
+//
+// static int crux_txn_begin(DB_ENV *env, DB_TXN **txn) {
+// 	return env->txn_begin(env, NULL, txn, 0);
+// }
+//
+// static int crux_txn_commit(DB_TXN *txn) {
+// 	return txn->commit(txn, 0);
+// }
+//
+// static int crux_txn_abort(DB_TXN *txn) {
+// 	return txn->abort(txn);
+// }
+//
+// static int crux_db_put(
+// 	DB *db, DB_TXN *txn, void *key, u_int32_t keyLen, void *value, u_int32_t valueLen) {
+// 	DBT k, v;
+// 	memset(&k, 0, sizeof(DBT));
+// 	memset(&v, 0, sizeof(DBT));
+// 	k.data = key;
+// 	k.size = keyLen;
+// 	v.data = value;
+// 	v.size = valueLen;
+// 	return db->put(db, txn, &k, &v, 0);
+// }
+//
+// static int crux_db_get(DB *db, void *key, u_int32_t keyLen, void **value, u_int32_t *valueLen) {
+// 	DBT k, v;
+// 	memset(&k, 0, sizeof(DBT));
+// 	memset(&v, 0, sizeof(DBT));
+// 	k.data = key;
+// 	k.size = keyLen;
+// 	v.flags = DB_DBT_MALLOC;
+// 	int ret = db->get(db, NULL, &k, &v, 0);
+// 	if (ret == 0) {
+// 		*value = v.data;
+// 		*valueLen = v.size;
+// 	}
+// 	return ret;
+// }
+//
+// static int crux_db_del(DB *db, DB_TXN *txn, void *key, u_int32_t keyLen) {
+// 	DBT k;
+// 	memset(&k, 0, sizeof(DBT));
+// 	k.data = key;
+// 	k.size = keyLen;
+// 	int ret = db->del(db, txn, &k, 0);
+// 	return ret == DB_NOTFOUND ? 0 : ret;
+// }
+//
+// static int crux_db_cursor(DB *db, DBC **cursor) {
+// 	return db->cursor(db, NULL, cursor, 0);
+// }
+//
+// static int crux_cursor_next(
+// 	DBC *cursor, void **key, u_int32_t *keyLen, void **value, u_int32_t *valueLen) {
+// 	DBT k, v;
+// 	memset(&k, 0, sizeof(DBT));
+// 	memset(&v, 0, sizeof(DBT));
+// 	k.flags = DB_DBT_MALLOC;
+// 	v.flags = DB_DBT_MALLOC;
+// 	int ret = cursor->get(cursor, &k, &v, DB_NEXT);
+// 	if (ret == 0) {
+// 		*key = k.data;
+// 		*keyLen = k.size;
+// 		*value = v.data;
+// 		*valueLen = v.size;
+// 	}
+// 	return ret;
+// }
+//
+// static int crux_cursor_close(DBC *cursor) {
+// 	return cursor->close(cursor);
+// }
+import "C"
+
 import (
-	"encoding/base64"
-	"github.com/jsimonetti/berkeleydb"
+	"fmt"
+	"golang.org/x/net/context"
+	"os"
+	"path"
+	"unsafe"
 )
 
-type berkleyDb struct {
+// constellationDbFile is the name of the payload database within a Constellation storage
+// directory.
+const constellationDbFile = "payload.db"
+
+// berkeleyDb stores payloads in Constellation's native Berkeley DB format, with the raw payload
+// digest as the key, and the binary encoded payload and its recipients as the value.
+type berkeleyDb struct {
 	dbPath string
-	conn   *berkeleydb.Db
+	env    *C.DB_ENV
+	conn   *C.DB
 }
 
-func InitBerkeleyDb(dbPath string) (*berkleyDb, error) {
-	bdb := &berkleyDb{dbPath: dbPath}
+// InitBerkeleyDb opens a Constellation Berkeley DB payload store. If dbPath is a directory, or
+// does not exist, it is treated as a Constellation storage directory containing the database
+// environment and payload.db. Otherwise dbPath is opened as a standalone database file.
+func InitBerkeleyDb(dbPath string) (*berkeleyDb, error) {
+	db := &berkeleyDb{dbPath: dbPath}
 
-	db, err := berkeleydb.NewDB()
-	if err != nil {
+	info, err := os.Stat(dbPath)
+	if err != nil && !os.IsNotExist(err) {
 		return nil, err
 	}
 
-	err = db.Open(
-		dbPath, berkeleydb.DbHash, berkeleydb.DbCreate)
+	dbFile := dbPath
+	if info == nil || info.IsDir() {
+		err = os.MkdirAll(dbPath, 0700)
+		if err != nil {
+			return nil, err
+		}
+		home := C.CString(dbPath)
+		defer C.free(unsafe.Pointer(home))
+		if ret := C.crux_env_open(&db.env, home); ret != 0 {
+			return nil, bdbError("unable to open environment "+dbPath, ret)
+		}
+		// Within an environment, database files are relative to its home directory
+		dbFile = constellationDbFile
+		info, _ = os.Stat(path.Join(dbPath, constellationDbFile))
+	}
 
-	return bdb, err
+	exists := C.int(0)
+	if info != nil {
+		exists = 1
+	}
+	file := C.CString(dbFile)
+	defer C.free(unsafe.Pointer(file))
+	if ret := C.crux_db_open(db.env, &db.conn, file, exists); ret != 0 {
+		if db.env != nil {
+			C.crux_env_close(db.env)
+		}
+		return nil, bdbError("unable to open database "+dbPath, ret)
+	}
+	return db, nil
 }
 
-func (db *berkleyDb) Write(key *[]byte, value *[]byte) error {
-
-	b64Key := base64.StdEncoding.EncodeToString(*key)
-	b64Value := base64.StdEncoding.EncodeToString(*value)
+func bdbError(message string, ret C.int) error {
+	return fmt.Errorf("%s: %s", message, C.GoString(C.db_strerror(ret)))
+}
 
-	err := db.conn.Put(b64Key, b64Value)
-	if err != nil {
-		return err
-	} else {
+// bytesPtr returns a pointer to the contents of b which can be passed to C, or nil if b is empty.
+func bytesPtr(b []byte) unsafe.Pointer {
+	if len(b) == 0 {
 		return nil
 	}
+	return unsafe.Pointer(&b[0])
+}
+
+// goBytes copies the memory allocated by Berkeley DB to a Go slice, and frees it.
+func goBytes(data unsafe.Pointer, size C.u_int32_t) []byte {
+	defer C.free(data)
+	return C.GoBytes(data, C.int(size))
 }
 
-func (db *berkleyDb) Read(key *[]byte) (*[]byte, error) {
+func (db *berkeleyDb) Write(ctx context.Context, key, value []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return db.put(nil, key, value)
+}
 
-	b64Key := base64.StdEncoding.EncodeToString(*key)
+func (db *berkeleyDb) put(txn *C.DB_TXN, key, value []byte) error {
+	ret := C.crux_db_put(db.conn, txn,
+		bytesPtr(key), C.u_int32_t(len(key)), bytesPtr(value), C.u_int32_t(len(value)))
+	if ret != 0 {
+		return bdbError("unable to write payload", ret)
+	}
+	return nil
+}
 
-	value, err := db.conn.Get(b64Key)
-	if err != nil {
+func (db *berkeleyDb) Read(ctx context.Context, key []byte) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
 		return nil, err
 	}
+	var data unsafe.Pointer
+	var size C.u_int32_t
+	ret := C.crux_db_get(db.conn, bytesPtr(key), C.u_int32_t(len(key)), &data, &size)
+	if ret == C.DB_NOTFOUND || ret == C.DB_KEYEMPTY {
+		return nil, ErrNotFound
+	} else if ret != 0 {
+		return nil, bdbError("unable to read payload", ret)
+	}
+	return goBytes(data, size), nil
+}
 
-	var decoded []byte
-	decoded, err = base64.StdEncoding.DecodeString(value)
-	return &decoded, err
+func (db *berkeleyDb) Delete(ctx context.Context, key []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return db.del(nil, key)
 }
 
-func (db *berkleyDb) ReadAll(f func(key, value *[]byte)) error {
-	iter, err := db.conn.Cursor()
-	if err != nil {
+func (db *berkeleyDb) del(txn *C.DB_TXN, key []byte) error {
+	ret := C.crux_db_del(db.conn, txn, bytesPtr(key), C.u_int32_t(len(key)))
+	if ret != 0 {
+		return bdbError("unable to delete payload", ret)
+	}
+	return nil
+}
+
+// WriteBatch applies the operations in batch within a transaction. Databases opened without an
+// environment do not support transactions, so the operations are applied individually.
+func (db *berkeleyDb) WriteBatch(ctx context.Context, batch *Batch) error {
+	if err := ctx.Err(); err != nil {
 		return err
 	}
 
-	var b64Key, b64Value string
-	for {
-		b64Key, b64Value, err = iter.GetNext()
-		if err != nil {
-			break
+	var txn *C.DB_TXN
+	if db.env != nil {
+		if ret := C.crux_txn_begin(db.env, &txn); ret != 0 {
+			return bdbError("unable to begin transaction", ret)
 		}
-		key, err := base64.StdEncoding.DecodeString(b64Key)
-		if err != nil {
-			break
+	}
+
+	for _, op := range batch.ops {
+		var err error
+		if op.delete {
+			err = db.del(txn, op.key)
+		} else {
+			err = db.put(txn, op.key, op.value)
 		}
-		value, err := base64.StdEncoding.DecodeString(b64Value)
 		if err != nil {
-			break
+			if txn != nil {
+				C.crux_txn_abort(txn)
+			}
+			return err
 		}
-		f(&key, &value)
 	}
 
-	return err
+	if txn != nil {
+		if ret := C.crux_txn_commit(txn); ret != 0 {
+			return bdbError("unable to commit transaction", ret)
+		}
+	}
+	return nil
 }
 
-func (db *berkleyDb) Delete(key *[]byte) error {
-	b64Key := base64.StdEncoding.EncodeToString(*key)
-	return db.conn.Delete(b64Key)
+// Iterate visits every record in the database, as Constellation's hash databases are unordered.
+func (db *berkeleyDb) Iterate(ctx context.Context, r Range, f func(key, value []byte) error) error {
+	var cursor *C.DBC
+	if ret := C.crux_db_cursor(db.conn, &cursor); ret != 0 {
+		return bdbError("unable to create cursor", ret)
+	}
+	defer C.crux_cursor_close(cursor)
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		var keyData, valueData unsafe.Pointer
+		var keySize, valueSize C.u_int32_t
+		ret := C.crux_cursor_next(cursor, &keyData, &keySize, &valueData, &valueSize)
+		if ret == C.DB_NOTFOUND {
+			return nil
+		} else if ret != 0 {
+			return bdbError("unable to read payloads", ret)
+		}
+		key, value := goBytes(keyData, keySize), goBytes(valueData, valueSize)
+		if !r.Contains(key) {
+			continue
+		}
+		if err := f(key, value); err != nil {
+			return iterateDone(err)
+		}
+	}
 }
 
-func (db *berkleyDb) Close() error {
-	return db.conn.Close()
+func (db *berkeleyDb) Close() error {
+	var err error
+	if ret := C.crux_db_close(db.conn); ret != 0 {
+		err = bdbError("unable to close database", ret)
+	}
+	if db.env != nil {
+		if ret := C.crux_env_close(db.env); ret != 0 && err == nil {
+			err = bdbError("unable to close environment", ret)
+		}
+	}
+	return err
 }
@@ -0,0 +1,14 @@
+// +build !bdb
+
+package storage
+
+import "errors"
+
+// errNoBerkeleyDb is returned when opening a Berkeley DB store, as the backend requires cgo and
+// libdb, so is only built with the bdb tag.
+var errNoBerkeleyDb = errors.New("built without Berkeley DB support, rebuild with -tags bdb")
+
+// InitBerkeleyDb fails, as Crux was built without Berkeley DB support.
+func InitBerkeleyDb(dbPath string) (DataStore, error) {
+	return nil, errNoBerkeleyDb
+}
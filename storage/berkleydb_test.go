@@ -0,0 +1,7 @@
+// +build bdb
+
+package storage
+
+func init() {
+	backends = append(backends, "bdb:storage")
+}
@@ -0,0 +1,122 @@
+package storage
+
+import (
+	"bytes"
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/net/context"
+	"time"
+)
+
+var payloadBucket = []byte("payloads")
+
+type boltDb struct {
+	dbPath string
+	conn   *bolt.DB
+}
+
+// InitBoltDb opens or creates the bbolt database file at dbPath. All payloads are stored in a
+// single file, which can be backed up by copying it while the node is stopped.
+func InitBoltDb(dbPath string) (*boltDb, error) {
+	// Fail rather than block indefinitely if another process holds the file lock
+	conn, err := bolt.Open(dbPath, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = conn.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(payloadBucket)
+		return err
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &boltDb{dbPath: dbPath, conn: conn}, nil
+}
+
+func (db *boltDb) Write(ctx context.Context, key, value []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return db.conn.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(payloadBucket).Put(key, value)
+	})
+}
+
+func (db *boltDb) Read(ctx context.Context, key []byte) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var value []byte
+	err := db.conn.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(payloadBucket).Get(key)
+		if v == nil {
+			return ErrNotFound
+		}
+		// Values are only valid for the lifetime of the transaction
+		value = append([]byte{}, v...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+func (db *boltDb) Delete(ctx context.Context, key []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return db.conn.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(payloadBucket).Delete(key)
+	})
+}
+
+func (db *boltDb) WriteBatch(ctx context.Context, batch *Batch) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return db.conn.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(payloadBucket)
+		for _, op := range batch.ops {
+			var err error
+			if op.delete {
+				err = bucket.Delete(op.key)
+			} else {
+				err = bucket.Put(op.key, op.value)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (db *boltDb) Iterate(ctx context.Context, r Range, f func(key, value []byte) error) error {
+	err := db.conn.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(payloadBucket).Cursor()
+		k, v := c.First()
+		if r.Start != nil {
+			k, v = c.Seek(r.Start)
+		}
+		for ; k != nil; k, v = c.Next() {
+			if r.Limit != nil && bytes.Compare(k, r.Limit) >= 0 {
+				break
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := f(k, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return iterateDone(err)
+}
+
+func (db *boltDb) Close() error {
+	return db.conn.Close()
+}
@@ -0,0 +1,66 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/base64"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+)
+
+// CopyStats summarises the records processed by Copy.
+type CopyStats struct {
+	Read      int // Records read from the source
+	Copied    int // Records written to the destination
+	Skipped   int // Records already present in the destination
+	Invalid   int // Records which failed verification, and were not copied
+	Conflicts int // Records present in the destination with a different value, which were kept
+}
+
+// progressInterval is the number of records between progress reports.
+const progressInterval = 1000
+
+// Copy writes every record in src to dst. Each record is first passed to verify, records which
+// fail verification are logged and skipped. Copying stops at the first write error.
+//
+// Records which are already present in dst are not written again, so an interrupted copy can be
+// resumed by running it again. Existing records with a different value are never overwritten, and
+// are reported as conflicts.
+func Copy(
+	ctx context.Context, src, dst DataStore, verify func(key, value []byte) error) (CopyStats, error) {
+
+	var stats CopyStats
+	err := src.Iterate(ctx, All, func(key, value []byte) error {
+		stats.Read++
+		if stats.Read%progressInterval == 0 {
+			log.Infof("Processed %d records", stats.Read)
+		}
+		b64Key := base64.StdEncoding.EncodeToString(key)
+
+		if err := verify(key, value); err != nil {
+			log.WithField("key", b64Key).Errorf("Skipping invalid record: %v", err)
+			stats.Invalid++
+			return nil
+		}
+
+		existing, err := dst.Read(ctx, key)
+		if err == nil {
+			if bytes.Equal(existing, value) {
+				stats.Skipped++
+			} else {
+				log.WithField("key", b64Key).Error(
+					"Record differs from the existing record in the destination, keeping existing")
+				stats.Conflicts++
+			}
+			return nil
+		} else if err != ErrNotFound {
+			return err
+		}
+
+		err = dst.Write(ctx, key, value)
+		if err == nil {
+			stats.Copied++
+		}
+		return err
+	})
+	return stats, err
+}
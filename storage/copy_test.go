@@ -0,0 +1,108 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestCopy(t *testing.T) {
+	workDir, err := ioutil.TempDir("", "TestCopy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
+
+	src, err := Open("bolt:src.bolt", workDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	dst, err := Open("leveldb:dst", workDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+
+	records := map[string]string{"key1": "value1", "key2": "value2", "invalid": "value3"}
+	for k, v := range records {
+		if err := src.Write(ctx, []byte(k), []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats, err := Copy(ctx, src, dst, func(key, value []byte) error {
+		if string(key) == "invalid" {
+			return errors.New("invalid record")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := CopyStats{Read: 3, Copied: 2, Invalid: 1}
+	if stats != expected {
+		t.Errorf("Copy returned %+v, expected %+v", stats, expected)
+	}
+
+	for _, k := range []string{"key1", "key2"} {
+		value, err := dst.Read(ctx, []byte(k))
+		if err != nil || !bytes.Equal(value, []byte(records[k])) {
+			t.Errorf("Copied record %s was %v, %v, expected %s", k, value, err, records[k])
+		}
+	}
+	if _, err := dst.Read(ctx, []byte("invalid")); err != ErrNotFound {
+		t.Errorf("Invalid record should not be copied, read returned %v", err)
+	}
+}
+
+func TestCopyResume(t *testing.T) {
+	workDir, err := ioutil.TempDir("", "TestCopyResume")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
+
+	src, err := Open("leveldb:src", workDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	dst, err := Open("sqlite:dst.sqlite", workDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+
+	for _, k := range []string{"key1", "key2", "key3"} {
+		if err := src.Write(ctx, []byte(k), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Simulate an interrupted copy, and a conflicting record
+	copied, conflicting := []byte("key1"), []byte("key2")
+	value, conflictingValue := []byte("value"), []byte("other")
+	if err := dst.Write(ctx, copied, value); err != nil {
+		t.Fatal(err)
+	}
+	if err := dst.Write(ctx, conflicting, conflictingValue); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := Copy(ctx, src, dst, func(key, value []byte) error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := CopyStats{Read: 3, Copied: 1, Skipped: 1, Conflicts: 1}
+	if stats != expected {
+		t.Errorf("Copy returned %+v, expected %+v", stats, expected)
+	}
+	read, err := dst.Read(ctx, conflicting)
+	if err != nil || !bytes.Equal(read, conflictingValue) {
+		t.Errorf("Conflicting record should be kept, read returned %v, %v", read, err)
+	}
+}
@@ -1,10 +1,110 @@
 package storage
 
+import (
+	"bytes"
+	"errors"
+	"golang.org/x/net/context"
+)
+
+// ErrNotFound is returned by a DataStore when the requested key does not exist.
+var ErrNotFound = errors.New("storage: key not found")
+
+// ReservedPrefix prefixes the keys of all records which are not payloads, such as indexes.
+// Payload keys are 64 byte digests, so the chance of one starting with ReservedPrefix is
+// negligible.
+var ReservedPrefix = []byte("\x00crux/")
+
+// IsReserved returns whether key is the key of a record which is not a payload.
+func IsReserved(key []byte) bool {
+	return bytes.HasPrefix(key, ReservedPrefix)
+}
+
+// StopIteration may be returned by the function passed to DataStore.Iterate to stop iterating
+// early. It is not returned by Iterate.
+var StopIteration = errors.New("storage: stop iteration")
+
 // DataStore is an interface that facilitates operations with an underlying persistent data store.
+//
+// Calls fail with the context's error if it is cancelled before they complete.
 type DataStore interface {
-	Write(key *[]byte, value *[]byte) error
-	Read(key *[]byte) (*[]byte, error)
-	ReadAll(f func(key, value *[]byte)) error
-	Delete(key *[]byte) error
+	// Write stores value under key, replacing any existing value.
+	Write(ctx context.Context, key, value []byte) error
+	// Read returns the value stored under key, or ErrNotFound.
+	Read(ctx context.Context, key []byte) ([]byte, error)
+	// Delete removes key, deleting a key which does not exist is not an error.
+	Delete(ctx context.Context, key []byte) error
+	// WriteBatch atomically applies all of the operations in batch. The dir: backend, and bdb:
+	// databases opened without an environment, apply the operations individually.
+	WriteBatch(ctx context.Context, batch *Batch) error
+	// Iterate calls f with each record with a key in r, until f returns an error. If the error is
+	// StopIteration, Iterate returns nil. The key and value may only be used until f returns,
+	// and f must not write to the DataStore.
+	//
+	// Records are visited in key order, except by the bdb: and dir: backends, and encrypted
+	// stores with hashed keys, whose iteration order is unspecified. The bdb: and dir: backends
+	// read every payload only when r contains keys which are not reserved.
+	Iterate(ctx context.Context, r Range, f func(key, value []byte) error) error
 	Close() error
 }
+
+// Range is a range of keys, from Start inclusive to Limit exclusive. A nil Start or Limit leaves
+// the range unbounded in that direction.
+type Range struct {
+	Start []byte
+	Limit []byte
+}
+
+// All is the Range containing every key.
+var All = Range{}
+
+// PrefixRange returns the Range of all keys starting with prefix.
+func PrefixRange(prefix []byte) Range {
+	var limit []byte
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] < 0xff {
+			limit = append(append([]byte{}, prefix[:i]...), prefix[i]+1)
+			break
+		}
+	}
+	return Range{Start: prefix, Limit: limit}
+}
+
+// Contains returns whether key is within r.
+func (r Range) Contains(key []byte) bool {
+	return bytes.Compare(key, r.Start) >= 0 && (r.Limit == nil || bytes.Compare(key, r.Limit) < 0)
+}
+
+// Batch is a set of writes and deletes which are applied atomically by DataStore.WriteBatch, in
+// the order they were added.
+type Batch struct {
+	ops []batchOp
+}
+
+type batchOp struct {
+	key    []byte
+	value  []byte
+	delete bool
+}
+
+// Put adds a write of value under key to the batch.
+func (b *Batch) Put(key, value []byte) {
+	b.ops = append(b.ops, batchOp{key: key, value: value})
+}
+
+// Delete adds a delete of key to the batch.
+func (b *Batch) Delete(key []byte) {
+	b.ops = append(b.ops, batchOp{key: key, delete: true})
+}
+
+// Len returns the number of operations in the batch.
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+// iterateDone converts the error returned by an iteration function to that returned by Iterate.
+func iterateDone(err error) error {
+	if err == StopIteration {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,349 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"golang.org/x/net/context"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"testing"
+)
+
+// backends lists the storage URLs of the backends every DataStore test is run against. Builds
+// with the bdb tag add the Berkeley DB backend.
+var backends = []string{
+	"leveldb:leveldb",
+	"bolt:crux.bolt",
+	"sqlite:crux.sqlite",
+	"dir:storage",
+	"encrypted:leveldb:leveldb",
+	"hashed:bolt:crux.bolt",
+}
+
+// postgresUrlEnv provides the URL of a PostgreSQL database to run the tests against. All payloads
+// in the database are deleted by the tests.
+const postgresUrlEnv = "CRUX_TEST_POSTGRES_URL"
+
+func init() {
+	if url := os.Getenv(postgresUrlEnv); url != "" {
+		backends = append(backends, url)
+	}
+}
+
+// openBackend opens the backend with the storage URL spec. Specs prefixed with encrypted: or
+// hashed: are wrapped in an encrypted store, with hashed keys for the latter.
+func openBackend(spec, workDir string) (DataStore, error) {
+	storageType, inner := ParseUrl(spec)
+	if storageType != "encrypted" && storageType != "hashed" {
+		return Open(spec, workDir)
+	}
+	db, err := Open(inner, workDir)
+	if err != nil {
+		return nil, err
+	}
+	return InitEncryptedDb(ctx, db, testPasswords, storageType == "hashed")
+}
+
+// runDataStoreTest runs test against a new, empty instance of each backend.
+func runDataStoreTest(t *testing.T, test func(t *testing.T, db DataStore)) {
+	for _, backend := range backends {
+		t.Run(backend, func(t *testing.T) {
+			workDir, err := ioutil.TempDir("", "TestDataStore")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(workDir)
+
+			db, err := openBackend(backend, workDir)
+			if err != nil {
+				t.Fatalf("Unable to open %s: %v", backend, err)
+			}
+			defer db.Close()
+			if sqlDb, ok := db.(*sqlDb); ok && sqlDb.dialect.driver == postgres.driver {
+				// Database servers persist beyond the test directory
+				for _, table := range []string{"payloads", "records"} {
+					if _, err := sqlDb.conn.Exec("DELETE FROM " + table); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+
+			test(t, db)
+		})
+	}
+}
+
+var ctx = context.Background()
+
+func TestWriteAndRead(t *testing.T) {
+	runDataStoreTest(t, func(t *testing.T, db DataStore) {
+		key, value := []byte("key"), []byte("value")
+		if err := db.Write(ctx, key, value); err != nil {
+			t.Fatal(err)
+		}
+
+		read, err := db.Read(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(read, value) {
+			t.Errorf("Read returned %v, expected %v", read, value)
+		}
+
+		value = []byte("updated")
+		if err := db.Write(ctx, key, value); err != nil {
+			t.Fatal(err)
+		}
+		read, err = db.Read(ctx, key)
+		if err != nil || !bytes.Equal(read, value) {
+			t.Errorf("Read of overwritten key returned %v, %v, expected %v", read, err, value)
+		}
+	})
+}
+
+func TestReadNotFound(t *testing.T) {
+	runDataStoreTest(t, func(t *testing.T, db DataStore) {
+		_, err := db.Read(ctx, []byte("missing"))
+		if err != ErrNotFound {
+			t.Errorf("Read of missing key returned %v, expected %v", err, ErrNotFound)
+		}
+	})
+}
+
+func TestDelete(t *testing.T) {
+	runDataStoreTest(t, func(t *testing.T, db DataStore) {
+		key, value := []byte("key"), []byte("value")
+		if err := db.Write(ctx, key, value); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Delete(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Read(ctx, key); err != ErrNotFound {
+			t.Errorf("Read of deleted key returned %v, expected %v", err, ErrNotFound)
+		}
+
+		if err := db.Delete(ctx, []byte("missing")); err != nil {
+			t.Errorf("Delete of missing key failed with %v", err)
+		}
+	})
+}
+
+func TestWriteBatch(t *testing.T) {
+	runDataStoreTest(t, func(t *testing.T, db DataStore) {
+		deleted := []byte("deleted")
+		if err := db.Write(ctx, deleted, []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+
+		batch := new(Batch)
+		batch.Put([]byte("key1"), []byte("value1"))
+		batch.Put([]byte("key2"), []byte("value2"))
+		batch.Delete(deleted)
+		batch.Put([]byte("key1"), []byte("updated"))
+		if batch.Len() != 4 {
+			t.Errorf("Batch has %d operations, expected 4", batch.Len())
+		}
+
+		if err := db.WriteBatch(ctx, batch); err != nil {
+			t.Fatal(err)
+		}
+
+		expected := map[string]string{"key1": "updated", "key2": "value2"}
+		for k, v := range expected {
+			read, err := db.Read(ctx, []byte(k))
+			if err != nil || string(read) != v {
+				t.Errorf("Read of %s returned %s, %v, expected %s", k, read, err, v)
+			}
+		}
+		if _, err := db.Read(ctx, deleted); err != ErrNotFound {
+			t.Errorf("Read of key deleted in batch returned %v, expected %v", err, ErrNotFound)
+		}
+	})
+}
+
+// writeRecords writes the records key0...key9 with values value0...value9, and the record other.
+func writeRecords(t *testing.T, db DataStore) {
+	batch := new(Batch)
+	for i := 0; i < 10; i++ {
+		batch.Put([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d", i)))
+	}
+	batch.Put([]byte("other"), []byte("value"))
+	if err := db.WriteBatch(ctx, batch); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// iterateKeys returns the sorted keys of the records in r.
+func iterateKeys(t *testing.T, db DataStore, r Range) []string {
+	var keys []string
+	err := db.Iterate(ctx, r, func(key, value []byte) error {
+		if expected := "value" + string(key[len(key)-1:]); string(key) != "other" &&
+			string(value) != expected {
+			t.Errorf("Iterate returned value %s for %s, expected %s", value, key, expected)
+		}
+		keys = append(keys, string(key))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestIterate(t *testing.T) {
+	runDataStoreTest(t, func(t *testing.T, db DataStore) {
+		writeRecords(t, db)
+
+		tests := []struct {
+			r        Range
+			expected string
+		}{
+			{All, "[key0 key1 key2 key3 key4 key5 key6 key7 key8 key9 other]"},
+			{PrefixRange([]byte("key")), "[key0 key1 key2 key3 key4 key5 key6 key7 key8 key9]"},
+			{Range{Start: []byte("key3"), Limit: []byte("key6")}, "[key3 key4 key5]"},
+			{Range{Start: []byte("key8")}, "[key8 key9 other]"},
+			{Range{Limit: []byte("key2")}, "[key0 key1]"},
+			{PrefixRange([]byte("missing")), "[]"},
+		}
+		for _, test := range tests {
+			if keys := fmt.Sprint(iterateKeys(t, db, test.r)); keys != test.expected {
+				t.Errorf("Iterate of %q-%q returned %s, expected %s",
+					test.r.Start, test.r.Limit, keys, test.expected)
+			}
+		}
+	})
+}
+
+func TestIterateStop(t *testing.T) {
+	runDataStoreTest(t, func(t *testing.T, db DataStore) {
+		writeRecords(t, db)
+
+		count := 0
+		err := db.Iterate(ctx, All, func(key, value []byte) error {
+			count++
+			if count == 3 {
+				return StopIteration
+			}
+			return nil
+		})
+		if err != nil || count != 3 {
+			t.Errorf("Stopped iteration returned %v after %d records, expected nil after 3",
+				err, count)
+		}
+
+		failure := fmt.Errorf("failure")
+		err = db.Iterate(ctx, All, func(key, value []byte) error {
+			return failure
+		})
+		if err != failure {
+			t.Errorf("Failed iteration returned %v, expected %v", err, failure)
+		}
+	})
+}
+
+func TestContextCancelled(t *testing.T) {
+	runDataStoreTest(t, func(t *testing.T, db DataStore) {
+		writeRecords(t, db)
+
+		cancelled, cancel := context.WithCancel(ctx)
+		cancel()
+
+		if err := db.Write(cancelled, []byte("key"), []byte("value")); err == nil {
+			t.Error("Write with a cancelled context should fail")
+		}
+		if _, err := db.Read(cancelled, []byte("key0")); err == nil {
+			t.Error("Read with a cancelled context should fail")
+		}
+
+		count := 0
+		err := db.Iterate(cancelled, All, func(key, value []byte) error {
+			count++
+			return nil
+		})
+		if err == nil || count != 0 {
+			t.Errorf("Iterate with a cancelled context returned %v after %d records", err, count)
+		}
+	})
+}
+
+func TestReopen(t *testing.T) {
+	for _, backend := range backends {
+		workDir, err := ioutil.TempDir("", "TestReopen")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(workDir)
+
+		key, value := []byte("key"), []byte("value")
+		db, err := openBackend(backend, workDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Write(ctx, key, value); err != nil {
+			t.Fatal(err)
+		}
+		db.Close()
+
+		db, err = openBackend(backend, workDir)
+		if err != nil {
+			t.Fatalf("Unable to reopen %s: %v", backend, err)
+		}
+		read, err := db.Read(ctx, key)
+		if err != nil || !bytes.Equal(read, value) {
+			t.Errorf("%s returned %v, %v after reopening, expected %v", backend, read, err, value)
+		}
+		db.Close()
+	}
+}
+
+func TestPrefixRange(t *testing.T) {
+	tests := []struct {
+		prefix []byte
+		limit  []byte
+	}{
+		{[]byte("key"), []byte("kez")},
+		{[]byte{0x01, 0xff}, []byte{0x02}},
+		{[]byte{0xff, 0xff}, nil},
+	}
+	for _, test := range tests {
+		r := PrefixRange(test.prefix)
+		if !bytes.Equal(r.Start, test.prefix) || !bytes.Equal(r.Limit, test.limit) {
+			t.Errorf("PrefixRange of %v returned %v, expected limit %v", test.prefix, r, test.limit)
+		}
+	}
+}
+
+func TestOpen(t *testing.T) {
+	workDir, err := ioutil.TempDir("", "TestOpen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
+
+	db, err := Open("crux.db", workDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	if _, ok := db.(*levelDb); !ok {
+		t.Errorf("Storage without a type should be LevelDB, got %T", db)
+	}
+
+	absolute := path.Join(workDir, "absolute.bolt")
+	db, err = Open("bolt:"+absolute, "/nonexistent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	if _, err := os.Stat(absolute); err != nil {
+		t.Errorf("Absolute storage path should not be relative to the workdir: %v", err)
+	}
+
+	if _, err := Open("unknown:crux.db", workDir); err == nil {
+		t.Error("Unknown storage types should be rejected")
+	}
+}
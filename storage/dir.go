@@ -0,0 +1,177 @@
+package storage
+
+import (
+	"encoding/base32"
+	"golang.org/x/net/context"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// tempFilePrefix is used for files which are being written, which are ignored by Iterate.
+const tempFilePrefix = ".tmp-"
+
+// dirDb stores each payload in its own file within a directory, which is named by the base32
+// encoded digest. This is the layout of Constellation's dir: storage.
+type dirDb struct {
+	dbPath   string
+	unpadded bool // Whether files are named without base32 padding, as Constellation names them
+}
+
+// InitDirDb opens the payload directory at dbPath, creating it if necessary.
+func InitDirDb(dbPath string) (*dirDb, error) {
+	err := os.MkdirAll(dbPath, 0700)
+	if err != nil {
+		return nil, err
+	}
+	files, err := ioutil.ReadDir(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	db := &dirDb{dbPath: dbPath}
+	for _, file := range files {
+		name := file.Name()
+		if _, err := decodeFilename(name); err == nil && len(name)%8 != 0 &&
+			!strings.HasPrefix(name, tempFilePrefix) {
+			db.unpadded = true
+			break
+		}
+	}
+	return db, nil
+}
+
+func (db *dirDb) filename(key []byte) string {
+	return path.Join(db.dbPath, base32.StdEncoding.EncodeToString(key))
+}
+
+// unpaddedFilename returns the name of key's file for stores written without base32 padding.
+func (db *dirDb) unpaddedFilename(key []byte) string {
+	return strings.TrimRight(db.filename(key), "=")
+}
+
+// writeFilename returns the name of the file to write key to, which is its existing file if it
+// has one, so that a key is never stored in two files.
+func (db *dirDb) writeFilename(key []byte) string {
+	padded, unpadded := db.filename(key), db.unpaddedFilename(key)
+	if _, err := os.Stat(padded); err == nil {
+		return padded
+	}
+	if _, err := os.Stat(unpadded); err == nil || db.unpadded {
+		return unpadded
+	}
+	return padded
+}
+
+// decodeFilename returns the key for the named file, tolerating missing padding.
+func decodeFilename(name string) ([]byte, error) {
+	if padding := len(name) % 8; padding != 0 {
+		name += strings.Repeat("=", 8-padding)
+	}
+	return base32.StdEncoding.DecodeString(name)
+}
+
+func (db *dirDb) Write(ctx context.Context, key, value []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	// Write to a temporary file first, so that readers never see partially written payloads
+	tmp, err := ioutil.TempFile(db.dbPath, tempFilePrefix)
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(value)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), db.writeFilename(key))
+}
+
+func (db *dirDb) Read(ctx context.Context, key []byte) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	value, err := ioutil.ReadFile(db.filename(key))
+	if os.IsNotExist(err) {
+		value, err = ioutil.ReadFile(db.unpaddedFilename(key))
+	}
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+func (db *dirDb) Delete(ctx context.Context, key []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	for _, filename := range []string{db.filename(key), db.unpaddedFilename(key)} {
+		err := os.Remove(filename)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteBatch applies the operations in batch in order. Each write is atomic, but the directory
+// layout provides no means of applying several atomically.
+func (db *dirDb) WriteBatch(ctx context.Context, batch *Batch) error {
+	for _, op := range batch.ops {
+		var err error
+		if op.delete {
+			err = db.Delete(ctx, op.key)
+		} else {
+			err = db.Write(ctx, op.key, op.value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *dirDb) Iterate(ctx context.Context, r Range, f func(key, value []byte) error) error {
+	files, err := ioutil.ReadDir(db.dbPath)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if file.IsDir() || strings.HasPrefix(file.Name(), tempFilePrefix) {
+			continue
+		}
+		key, err := decodeFilename(file.Name())
+		if err != nil || !r.Contains(key) {
+			// Not a payload, or outside of the range
+			continue
+		}
+		value, err := ioutil.ReadFile(path.Join(db.dbPath, file.Name()))
+		if os.IsNotExist(err) {
+			// Deleted since the directory was listed
+			continue
+		} else if err != nil {
+			return err
+		}
+		if err = f(key, value); err != nil {
+			return iterateDone(err)
+		}
+	}
+	return nil
+}
+
+func (db *dirDb) Close() error {
+	return nil
+}
@@ -0,0 +1,99 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/base32"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestDirDbUnpaddedFilenames(t *testing.T) {
+	dbPath, err := ioutil.TempDir("", "TestDirDb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dbPath)
+
+	db, err := InitDirDb(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 64 byte digests require padding when base32 encoded
+	key := bytes.Repeat([]byte{0xab}, 64)
+	value := []byte("payload")
+	filename := strings.TrimRight(base32.StdEncoding.EncodeToString(key), "=")
+	err = ioutil.WriteFile(path.Join(dbPath, filename), value, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Files which are not payloads are ignored
+	err = ioutil.WriteFile(path.Join(dbPath, "README"), value, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	read, err := db.Read(ctx, key)
+	if err != nil || !bytes.Equal(read, value) {
+		t.Errorf("Read returned %v, %v, expected %v", read, err, value)
+	}
+
+	var keys [][]byte
+	err = db.Iterate(ctx, All, func(k, v []byte) error {
+		keys = append(keys, append([]byte{}, k...))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || !bytes.Equal(keys[0], key) {
+		t.Errorf("Iterate returned keys %v, expected %v", keys, key)
+	}
+
+	// Keys are rewritten under their existing name, and once the store is reopened, new keys are
+	// named in the same way
+	if db, err = InitDirDb(dbPath); err != nil {
+		t.Fatal(err)
+	}
+	key2 := bytes.Repeat([]byte{0xcd}, 64)
+	value2 := []byte("payload2")
+	for _, k := range [][]byte{key, key2} {
+		if err = db.Write(ctx, k, value2); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files, err := ioutil.ReadDir(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), "=") {
+			t.Errorf("Expected only unpadded filenames, found %s", file.Name())
+		}
+	}
+	keys = nil
+	err = db.Iterate(ctx, All, func(k, v []byte) error {
+		keys = append(keys, append([]byte{}, k...))
+		if !bytes.Equal(v, value2) {
+			t.Errorf("Iterate returned %s for %x, expected %s", v, k, value2)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 {
+		t.Errorf("Iterate returned %d keys, expected 2", len(keys))
+	}
+
+	err = db.Delete(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.Read(ctx, key); err != ErrNotFound {
+		t.Errorf("Read of deleted key returned %v, expected %v", err, ErrNotFound)
+	}
+}
@@ -0,0 +1,388 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/kevinburke/nacl"
+	"github.com/kevinburke/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/net/context"
+)
+
+// keyringKey is the key of the record describing the storage keys of an encrypted store. It is
+// the only record which is not encrypted.
+var keyringKey = append(append([]byte{}, ReservedPrefix...), "keyring"...)
+
+// keyCheck is sealed with each storage key, so that passwords can be matched to keys.
+var keyCheck = []byte("crux storage key")
+
+const encryptedVersion = 1
+
+// rotateBatchSize is the number of records re-encrypted in each batch by Rotate.
+const rotateBatchSize = 1000
+
+// The scrypt parameters used to derive storage keys from passwords.
+var scryptN, scryptR, scryptP = 1 << 15, 8, 1
+
+// keyring is the stored description of the storage keys of an encrypted store.
+type keyring struct {
+	Version  int           `json:"version"`
+	HashKeys bool          `json:"hashKeys"`
+	Current  uint32        `json:"current"`
+	Keys     []keyringItem `json:"keys"`
+}
+
+type keyringItem struct {
+	Id    uint32 `json:"id"`
+	Salt  []byte `json:"salt"`
+	Check []byte `json:"check"`
+}
+
+// storageKey is a storage key which has been unlocked with its password.
+type storageKey struct {
+	id      uint32
+	key     nacl.Key
+	hmacKey []byte
+}
+
+// encryptedDb encrypts the values stored in an underlying DataStore with secretbox, under
+// storage keys derived from passwords. Each value records the id of the key it was encrypted
+// with, so that keys can be rotated. If the keys are also hashed, they are replaced by their
+// HMAC, and the original key is stored within the encrypted value.
+type encryptedDb struct {
+	db      DataStore
+	keyring keyring
+	keys    map[uint32]*storageKey
+	current *storageKey
+}
+
+// InitEncryptedDb opens the encrypted store within db with passwords. The first password
+// encrypts all new records, any others only decrypt records written with them. If the first
+// password is new, a storage key is created for it, provided one of the others unlocks the
+// current storage key.
+//
+// An empty db is initialised as an encrypted store, whose keys are hashed if hashKeys is true.
+// Stores which already contain unencrypted records are rejected.
+func InitEncryptedDb(
+	ctx context.Context, db DataStore, passwords []string, hashKeys bool) (*encryptedDb, error) {
+
+	if len(passwords) == 0 {
+		return nil, errors.New("storage: a storage password is required")
+	}
+
+	edb := &encryptedDb{db: db, keys: make(map[uint32]*storageKey)}
+	encoded, err := db.Read(ctx, keyringKey)
+	if err == ErrNotFound {
+		empty := true
+		err = db.Iterate(ctx, All, func(key, value []byte) error {
+			empty = false
+			return StopIteration
+		})
+		if err != nil {
+			return nil, err
+		}
+		if !empty {
+			return nil, errors.New("storage: the store contains unencrypted records, " +
+				"import them into a new encrypted store")
+		}
+		edb.keyring = keyring{Version: encryptedVersion, HashKeys: hashKeys}
+	} else if err != nil {
+		return nil, err
+	} else if err = json.Unmarshal(encoded, &edb.keyring); err != nil {
+		return nil, fmt.Errorf("storage: invalid keyring: %v", err)
+	}
+
+	for i, password := range passwords {
+		key, err := edb.unlock(password)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			edb.current = key
+		}
+	}
+
+	if edb.current == nil {
+		// A new key is only created while the existing key can still be unlocked, so that a
+		// mistyped password is not mistaken for a new one
+		if _, ok := edb.keys[edb.keyring.Current]; len(edb.keyring.Keys) > 0 && !ok {
+			return nil, errors.New("storage: the storage password does not unlock the storage key")
+		}
+		if edb.current, err = edb.addKey(passwords[0]); err != nil {
+			return nil, err
+		}
+	}
+
+	if edb.keyring.Current != edb.current.id {
+		edb.keyring.Current = edb.current.id
+		if err = edb.writeKeyring(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return edb, nil
+}
+
+// deriveKey derives the encryption and HMAC keys for password and salt.
+func deriveKey(password string, salt []byte, id uint32) (*storageKey, error) {
+	derived, err := scrypt.Key([]byte(password), salt, scryptN, scryptR, scryptP, 2*nacl.KeySize)
+	if err != nil {
+		return nil, err
+	}
+	key := new([nacl.KeySize]byte)
+	copy(key[:], derived)
+	return &storageKey{id: id, key: key, hmacKey: derived[nacl.KeySize:]}, nil
+}
+
+// unlock returns the key in the keyring which password unlocks, or nil if there is none.
+func (edb *encryptedDb) unlock(password string) (*storageKey, error) {
+	for _, item := range edb.keyring.Keys {
+		key, err := deriveKey(password, item.Salt, item.Id)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := openValue(item.Check, key.key); ok {
+			edb.keys[key.id] = key
+			return key, nil
+		}
+	}
+	return nil, nil
+}
+
+// addKey adds a new key to the keyring for password.
+func (edb *encryptedDb) addKey(password string) (*storageKey, error) {
+	item := keyringItem{Id: 1, Salt: (*nacl.NewKey())[:]}
+	for _, existing := range edb.keyring.Keys {
+		if existing.Id >= item.Id {
+			item.Id = existing.Id + 1
+		}
+	}
+	key, err := deriveKey(password, item.Salt, item.Id)
+	if err != nil {
+		return nil, err
+	}
+	item.Check = sealValue(keyCheck, key.key)
+	edb.keyring.Keys = append(edb.keyring.Keys, item)
+	edb.keys[key.id] = key
+	return key, nil
+}
+
+func (edb *encryptedDb) writeKeyring(ctx context.Context) error {
+	encoded, err := json.Marshal(edb.keyring)
+	if err != nil {
+		return err
+	}
+	return edb.db.Write(ctx, keyringKey, encoded)
+}
+
+func sealValue(plain []byte, key nacl.Key) []byte {
+	nonce := nacl.NewNonce()
+	return secretbox.Seal(append([]byte{}, nonce[:]...), plain, nonce, key)
+}
+
+func openValue(sealed []byte, key nacl.Key) ([]byte, bool) {
+	if len(sealed) < nacl.NonceSize {
+		return nil, false
+	}
+	nonce := new([nacl.NonceSize]byte)
+	copy(nonce[:], sealed)
+	return secretbox.Open(nil, sealed[nacl.NonceSize:], nonce, key)
+}
+
+// storedKey returns the key under which key is stored with the storage key k.
+func (edb *encryptedDb) storedKey(key []byte, k *storageKey) []byte {
+	if !edb.keyring.HashKeys {
+		return key
+	}
+	mac := hmac.New(sha256.New, k.hmacKey)
+	mac.Write(key)
+	return mac.Sum(nil)
+}
+
+// storedKeys returns the keys under which key may be stored, starting with the current key.
+func (edb *encryptedDb) storedKeys(key []byte) [][]byte {
+	keys := [][]byte{edb.storedKey(key, edb.current)}
+	if edb.keyring.HashKeys {
+		for _, k := range edb.keys {
+			if k != edb.current {
+				keys = append(keys, edb.storedKey(key, k))
+			}
+		}
+	}
+	return keys
+}
+
+// encrypt returns the stored form of a record with the current key.
+func (edb *encryptedDb) encrypt(key, value []byte) []byte {
+	plain := value
+	if edb.keyring.HashKeys {
+		plain = append(appendBytes(nil, key), value...)
+	}
+	header := make([]byte, 5)
+	header[0] = encryptedVersion
+	binary.BigEndian.PutUint32(header[1:], edb.current.id)
+	return append(header, sealValue(plain, edb.current.key)...)
+}
+
+// decrypt returns the original key and value of a stored record.
+func (edb *encryptedDb) decrypt(storedKey, stored []byte) ([]byte, []byte, error) {
+	if len(stored) < 5 || stored[0] != encryptedVersion {
+		return nil, nil, fmt.Errorf("storage: record %x is not encrypted", storedKey)
+	}
+	id := binary.BigEndian.Uint32(stored[1:])
+	k, ok := edb.keys[id]
+	if !ok {
+		return nil, nil, fmt.Errorf(
+			"storage: record %x is encrypted with key %d, which no password unlocks", storedKey, id)
+	}
+	plain, ok := openValue(stored[5:], k.key)
+	if !ok {
+		return nil, nil, fmt.Errorf("storage: unable to decrypt record %x", storedKey)
+	}
+	if !edb.keyring.HashKeys {
+		return storedKey, plain, nil
+	}
+
+	n, size := binary.Uvarint(plain)
+	if size <= 0 || n > uint64(len(plain)-size) {
+		return nil, nil, fmt.Errorf("storage: malformed record %x", storedKey)
+	}
+	return plain[size : size+int(n)], plain[size+int(n):], nil
+}
+
+func (edb *encryptedDb) Write(ctx context.Context, key, value []byte) error {
+	batch := new(Batch)
+	batch.Put(key, value)
+	return edb.WriteBatch(ctx, batch)
+}
+
+func (edb *encryptedDb) Read(ctx context.Context, key []byte) ([]byte, error) {
+	for _, storedKey := range edb.storedKeys(key) {
+		stored, err := edb.db.Read(ctx, storedKey)
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		originalKey, value, err := edb.decrypt(storedKey, stored)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(originalKey, key) {
+			return nil, fmt.Errorf("storage: record %x does not contain key %x", storedKey, key)
+		}
+		return value, nil
+	}
+	return nil, ErrNotFound
+}
+
+func (edb *encryptedDb) Delete(ctx context.Context, key []byte) error {
+	batch := new(Batch)
+	batch.Delete(key)
+	return edb.WriteBatch(ctx, batch)
+}
+
+// WriteBatch encrypts the records in batch with the current key. When keys are hashed, any
+// copies of the records stored with previous keys are deleted.
+func (edb *encryptedDb) WriteBatch(ctx context.Context, batch *Batch) error {
+	encrypted := new(Batch)
+	for _, op := range batch.ops {
+		storedKeys := edb.storedKeys(op.key)
+		if op.delete {
+			encrypted.Delete(storedKeys[0])
+		} else {
+			encrypted.Put(storedKeys[0], edb.encrypt(op.key, op.value))
+		}
+		for _, storedKey := range storedKeys[1:] {
+			encrypted.Delete(storedKey)
+		}
+	}
+	return edb.db.WriteBatch(ctx, encrypted)
+}
+
+// Iterate decrypts the records in r. When keys are hashed, every record in the store is read, and
+// the records are visited in an unspecified order.
+func (edb *encryptedDb) Iterate(ctx context.Context, r Range, f func(key, value []byte) error) error {
+	storedRange := r
+	if edb.keyring.HashKeys {
+		storedRange = All
+	}
+	return edb.db.Iterate(ctx, storedRange, func(storedKey, stored []byte) error {
+		if bytes.Equal(storedKey, keyringKey) {
+			return nil
+		}
+		key, value, err := edb.decrypt(storedKey, stored)
+		if err != nil {
+			return err
+		}
+		if !r.Contains(key) {
+			return nil
+		}
+		return f(key, value)
+	})
+}
+
+// Rotate re-encrypts every record which is not encrypted with the current key, then removes the
+// other keys from the keyring, so that their passwords are no longer required. It returns the
+// number of records re-encrypted.
+func (edb *encryptedDb) Rotate(ctx context.Context) (int, error) {
+	var rotate [][]byte
+	err := edb.db.Iterate(ctx, All, func(storedKey, stored []byte) error {
+		if bytes.Equal(storedKey, keyringKey) {
+			return nil
+		}
+		if len(stored) < 5 || binary.BigEndian.Uint32(stored[1:]) != edb.current.id {
+			rotate = append(rotate, append([]byte{}, storedKey...))
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	rotated := 0
+	batch := new(Batch)
+	for _, storedKey := range rotate {
+		stored, err := edb.db.Read(ctx, storedKey)
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return rotated, err
+		}
+		key, value, err := edb.decrypt(storedKey, stored)
+		if err != nil {
+			return rotated, err
+		}
+		// The record is deleted first, as its stored key is unchanged unless keys are hashed
+		batch.Delete(storedKey)
+		batch.Put(edb.storedKey(key, edb.current), edb.encrypt(key, value))
+		rotated++
+
+		if batch.Len() >= 2*rotateBatchSize {
+			if err = edb.db.WriteBatch(ctx, batch); err != nil {
+				return rotated, err
+			}
+			batch = new(Batch)
+		}
+	}
+	if err = edb.db.WriteBatch(ctx, batch); err != nil {
+		return rotated, err
+	}
+
+	for _, item := range edb.keyring.Keys {
+		if item.Id == edb.current.id {
+			edb.keyring.Keys = []keyringItem{item}
+			break
+		}
+	}
+	edb.keys = map[uint32]*storageKey{edb.current.id: edb.current}
+	return rotated, edb.writeKeyring(ctx)
+}
+
+func (edb *encryptedDb) Close() error {
+	return edb.db.Close()
+}
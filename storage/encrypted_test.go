@@ -0,0 +1,166 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+var testPasswords = []string{"password"}
+
+func init() {
+	// Derive keys quickly in tests
+	scryptN = 1 << 10
+}
+
+// rawRecords returns the records stored in the database underlying an encrypted store.
+func rawRecords(t *testing.T, db DataStore) map[string][]byte {
+	records := make(map[string][]byte)
+	err := db.(*encryptedDb).db.Iterate(ctx, All, func(key, value []byte) error {
+		records[string(key)] = append([]byte{}, value...)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+func TestEncryptedAtRest(t *testing.T) {
+	for _, hashKeys := range []bool{false, true} {
+		workDir, err := ioutil.TempDir("", "TestEncryptedAtRest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(workDir)
+
+		inner, err := Open("leveldb:leveldb", workDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		db, err := InitEncryptedDb(ctx, inner, testPasswords, hashKeys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		key, value := []byte("recipient key"), []byte("recipient list")
+		if err = db.Write(ctx, key, value); err != nil {
+			t.Fatal(err)
+		}
+
+		raw := rawRecords(t, db)
+		if len(raw) != 2 {
+			t.Errorf("Expected the record and the keyring to be stored, actual: %d records", len(raw))
+		}
+		for k, v := range raw {
+			if bytes.Contains(v, value) {
+				t.Errorf("Value is stored in clear under %q", k)
+			}
+		}
+		if _, ok := raw[string(key)]; ok == hashKeys {
+			t.Errorf("Key should be stored in clear %t, actual %t", !hashKeys, ok)
+		}
+	}
+}
+
+func TestEncryptedPasswords(t *testing.T) {
+	workDir, err := ioutil.TempDir("", "TestEncryptedPasswords")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
+
+	open := func(passwords ...string) (DataStore, error) {
+		inner, err := Open("bolt:crux.bolt", workDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		db, err := InitEncryptedDb(ctx, inner, passwords, true)
+		if err != nil {
+			inner.Close()
+		}
+		return db, err
+	}
+	check := func(db DataStore, expected []string) {
+		keys := iterateKeys(t, db, All)
+		if fmt.Sprint(keys) != fmt.Sprint(expected) {
+			t.Errorf("Store contains %v, expected %v", keys, expected)
+		}
+		for _, key := range expected {
+			if _, err := db.Read(ctx, []byte(key)); err != nil {
+				t.Errorf("Unable to read %s: %v", key, err)
+			}
+		}
+	}
+
+	db, err := open("old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Write(ctx, []byte("key1"), []byte("value1")); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	if _, err = open("mistyped"); err == nil {
+		t.Error("Opening the store with the wrong password should fail")
+	}
+
+	// A new password is added while the old one still unlocks existing records
+	db, err = open("new", "old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Write(ctx, []byte("key2"), []byte("value2")); err != nil {
+		t.Fatal(err)
+	}
+	check(db, []string{"key1", "key2"})
+	rotated, err := db.(*encryptedDb).Rotate(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated != 1 {
+		t.Errorf("Expected 1 record to be rotated, actual: %d", rotated)
+	}
+	if raw := rawRecords(t, db); len(raw) != 3 {
+		t.Errorf("Expected 2 records and the keyring after rotation, actual: %d", len(raw))
+	}
+	db.Close()
+
+	// The old password is no longer needed, or accepted
+	db, err = open("new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(db, []string{"key1", "key2"})
+	db.Close()
+	if _, err = open("old"); err == nil {
+		t.Error("Opening the store with a rotated password should fail")
+	}
+}
+
+func TestEncryptedRejectsPlaintext(t *testing.T) {
+	workDir, err := ioutil.TempDir("", "TestEncryptedRejectsPlaintext")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
+
+	db, err := Open("leveldb:leveldb", workDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Write(ctx, []byte("key"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = InitEncryptedDb(ctx, db, testPasswords, false)
+	if err == nil || !strings.Contains(err.Error(), "unencrypted") {
+		t.Errorf("Encrypting a store with unencrypted records returned %v", err)
+	}
+}
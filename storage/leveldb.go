@@ -2,6 +2,8 @@ package storage
 
 import (
 	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"golang.org/x/net/context"
 )
 
 type levelDb struct {
@@ -17,31 +19,62 @@ func InitLevelDb(dbPath string) (*levelDb, error) {
 	return db, err
 }
 
-func (db *levelDb) Write(key *[]byte, value *[]byte) error {
-	return db.conn.Put(*key, *value, nil)
+func (db *levelDb) Write(ctx context.Context, key, value []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return db.conn.Put(key, value, nil)
 }
 
-func (db *levelDb) Read(key *[]byte) (*[]byte, error) {
-	value, err := db.conn.Get(*key, nil)
+func (db *levelDb) Read(ctx context.Context, key []byte) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	value, err := db.conn.Get(key, nil)
 	if err == nil {
-		return &value, err
+		return value, err
+	} else if err == leveldb.ErrNotFound {
+		return nil, ErrNotFound
 	} else {
 		return nil, err
 	}
 }
 
-func (db *levelDb) ReadAll(f func(key, value *[]byte)) error {
-	iter := db.conn.NewIterator(nil, nil)
-	for iter.Next() {
-		key, value := iter.Key(), iter.Value()
-		f(&key, &value)
+func (db *levelDb) Delete(ctx context.Context, key []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
 	}
-	iter.Release()
-	return iter.Error()
+	return db.conn.Delete(key, nil)
 }
 
-func (db *levelDb) Delete(key *[]byte) error {
-	return db.conn.Delete(*key, nil)
+func (db *levelDb) WriteBatch(ctx context.Context, batch *Batch) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	b := new(leveldb.Batch)
+	for _, op := range batch.ops {
+		if op.delete {
+			b.Delete(op.key)
+		} else {
+			b.Put(op.key, op.value)
+		}
+	}
+	return db.conn.Write(b, nil)
+}
+
+func (db *levelDb) Iterate(ctx context.Context, r Range, f func(key, value []byte) error) error {
+	iter := db.conn.NewIterator(&util.Range{Start: r.Start, Limit: r.Limit}, nil)
+	defer iter.Release()
+
+	for iter.Next() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := f(iter.Key(), iter.Value()); err != nil {
+			return iterateDone(err)
+		}
+	}
+	return iter.Error()
 }
 
 func (db *levelDb) Close() error {
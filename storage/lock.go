@@ -0,0 +1,50 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+	"syscall"
+)
+
+// ErrLocked is returned by LockStore when the store is locked by another process.
+var ErrLocked = errors.New("storage: store is in use by another process, is Crux still running?")
+
+// LockStore takes an exclusive lock on the store described by the storage URL spec, which is held
+// until the returned Closer is closed. Running nodes hold the lock, so that operations which
+// replace the store fail rather than pulling it out from under them, whichever backend is used.
+// The lock is a file alongside the store. PostgreSQL databases are not locked.
+func LockStore(spec, workDir string) (io.Closer, error) {
+	storageType, dbPath := ParseUrl(spec)
+	if storageType == "postgres" || storageType == "postgresql" {
+		return noLock{}, nil
+	}
+	if !path.IsAbs(dbPath) {
+		dbPath = path.Join(workDir, dbPath)
+	}
+	if err := os.MkdirAll(path.Dir(dbPath), 0700); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(dbPath+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	// The lock is released by the operating system if the process exits
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		err = ErrLocked
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+type noLock struct{}
+
+func (noLock) Close() error {
+	return nil
+}
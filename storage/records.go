@@ -0,0 +1,148 @@
+package storage
+
+import (
+	"bytes"
+	"golang.org/x/net/context"
+	"os"
+	"path"
+)
+
+// recordsSuffix names the bbolt file holding the reserved records of a Constellation store. It is
+// kept within the store's directory, or alongside a standalone Berkeley DB database file.
+const recordsSuffix = ".crux-records"
+
+// recordsMovedKey marks that any reserved records written to the store itself, by earlier
+// versions of Crux, have been moved into the records file.
+var recordsMovedKey = append(append([]byte{}, ReservedPrefix...), "recordsmoved"...)
+
+// recordsDb keeps the reserved records of a store which cannot iterate a range of keys without
+// visiting every record, namely Constellation's dir: and bdb: stores, in a bbolt file. Index
+// lookups then only read the records file, while the payloads stay in Constellation's layout.
+//
+// Batches which contain both payloads and reserved records are applied to the store first, and
+// then to the records file, so are not atomic.
+type recordsDb struct {
+	DataStore
+	records *boltDb
+}
+
+// withRecordsFile opens the records file of the store at dbPath, moving into it any reserved
+// records which are in db.
+func withRecordsFile(db DataStore, dbPath string) (DataStore, error) {
+	recordsPath := dbPath + recordsSuffix
+	if info, err := os.Stat(dbPath); err == nil && info.IsDir() {
+		recordsPath = path.Join(dbPath, recordsSuffix)
+	}
+	records, err := InitBoltDb(recordsPath)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	rdb := &recordsDb{DataStore: db, records: records}
+	if err = rdb.moveRecords(context.Background()); err != nil {
+		rdb.Close()
+		return nil, err
+	}
+	return rdb, nil
+}
+
+// moveRecords moves the reserved records in the store into the records file. They are marked as
+// moved only once they have been deleted from the store, so that a move which is interrupted is
+// repeated when the store is next opened.
+func (db *recordsDb) moveRecords(ctx context.Context) error {
+	_, err := db.records.Read(ctx, recordsMovedKey)
+	if err != ErrNotFound {
+		return err
+	}
+	moved, deleted := new(Batch), new(Batch)
+	err = db.DataStore.Iterate(ctx, PrefixRange(ReservedPrefix), func(key, value []byte) error {
+		key = append([]byte{}, key...)
+		moved.Put(key, append([]byte{}, value...))
+		deleted.Delete(key)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err = db.records.WriteBatch(ctx, moved); err != nil {
+		return err
+	}
+	if err = db.DataStore.WriteBatch(ctx, deleted); err != nil {
+		return err
+	}
+	return db.records.Write(ctx, recordsMovedKey, []byte{})
+}
+
+// storeOf returns the store which holds key.
+func (db *recordsDb) storeOf(key []byte) DataStore {
+	if IsReserved(key) {
+		return db.records
+	}
+	return db.DataStore
+}
+
+func (db *recordsDb) Write(ctx context.Context, key, value []byte) error {
+	return db.storeOf(key).Write(ctx, key, value)
+}
+
+func (db *recordsDb) Read(ctx context.Context, key []byte) ([]byte, error) {
+	return db.storeOf(key).Read(ctx, key)
+}
+
+func (db *recordsDb) Delete(ctx context.Context, key []byte) error {
+	return db.storeOf(key).Delete(ctx, key)
+}
+
+// WriteBatch splits batch between the store and the records file. Each key is held by only one
+// of them, so the operations on a key are still applied in order.
+func (db *recordsDb) WriteBatch(ctx context.Context, batch *Batch) error {
+	payloads, records := new(Batch), new(Batch)
+	for _, op := range batch.ops {
+		if IsReserved(op.key) {
+			records.ops = append(records.ops, op)
+		} else {
+			payloads.ops = append(payloads.ops, op)
+		}
+	}
+	if payloads.Len() > 0 {
+		if err := db.DataStore.WriteBatch(ctx, payloads); err != nil {
+			return err
+		}
+	}
+	if records.Len() > 0 {
+		return db.records.WriteBatch(ctx, records)
+	}
+	return nil
+}
+
+// Iterate only visits the store when r contains keys which are not reserved, so that iterating
+// the indexes does not read every payload.
+func (db *recordsDb) Iterate(ctx context.Context, r Range, f func(key, value []byte) error) error {
+	reserved := PrefixRange(ReservedPrefix)
+	if bytes.Compare(r.Start, reserved.Start) < 0 || r.Limit == nil ||
+		bytes.Compare(r.Limit, reserved.Limit) > 0 {
+		stopped := false
+		err := db.DataStore.Iterate(ctx, r, func(key, value []byte) error {
+			err := f(key, value)
+			stopped = err == StopIteration
+			return err
+		})
+		if err != nil || stopped {
+			return err
+		}
+	}
+	return db.records.Iterate(ctx, r, func(key, value []byte) error {
+		if bytes.Equal(key, recordsMovedKey) {
+			return nil
+		}
+		return f(key, value)
+	})
+}
+
+func (db *recordsDb) Close() error {
+	err := db.DataStore.Close()
+	if recordsErr := db.records.Close(); err == nil {
+		err = recordsErr
+	}
+	return err
+}
@@ -0,0 +1,104 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/base32"
+	"errors"
+	"golang.org/x/net/context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+// noIterate is a DataStore which fails to iterate, to check that it is not iterated.
+type noIterate struct {
+	DataStore
+}
+
+func (noIterate) Iterate(ctx context.Context, r Range, f func(key, value []byte) error) error {
+	return errors.New("store iterated")
+}
+
+func TestRecordsFile(t *testing.T) {
+	workDir, err := ioutil.TempDir("", "TestRecordsFile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
+	dbPath := path.Join(workDir, "storage")
+
+	// Records written to the store itself by earlier versions are moved into the records file
+	dir, err := InitDirDb(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := bytes.Repeat([]byte{0xab}, 64)
+	record := append(append([]byte{}, ReservedPrefix...), "record"...)
+	for _, key := range [][]byte{payload, record} {
+		if err = dir.Write(ctx, key, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db, err := Open("dir:storage", workDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+	recordFile := path.Join(dbPath, base32.StdEncoding.EncodeToString(record))
+	if _, err = os.Stat(recordFile); !os.IsNotExist(err) {
+		t.Errorf("Expected the record to be moved out of the store, stat returned %v", err)
+	}
+	if value, err := db.Read(ctx, record); err != nil || !bytes.Equal(value, record) {
+		t.Errorf("Read returned %v, %v, expected %v", value, err, record)
+	}
+
+	payload2 := bytes.Repeat([]byte{0xcd}, 64)
+	record2 := append(append([]byte{}, ReservedPrefix...), "record2"...)
+	batch := new(Batch)
+	batch.Put(payload2, payload2)
+	batch.Put(record2, record2)
+	if err = db.WriteBatch(ctx, batch); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = dir.Read(ctx, record2); err != ErrNotFound {
+		t.Errorf("Expected records to be written to the records file, read returned %v", err)
+	}
+
+	// Reserved ranges are read from the records file alone
+	db.(*recordsDb).DataStore = noIterate{db.(*recordsDb).DataStore}
+	var keys [][]byte
+	err = db.Iterate(ctx, PrefixRange(ReservedPrefix), func(key, value []byte) error {
+		keys = append(keys, append([]byte{}, key...))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || !bytes.Equal(keys[0], record) || !bytes.Equal(keys[1], record2) {
+		t.Errorf("Iterate returned %q, expected %q and %q", keys, record, record2)
+	}
+	db.(*recordsDb).DataStore = db.(*recordsDb).DataStore.(noIterate).DataStore
+
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = Open("dir:storage", workDir); err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	err = db.Iterate(ctx, All, func(key, value []byte) error {
+		count++
+		if !bytes.Equal(key, value) {
+			t.Errorf("Iterate returned %x for %x", value, key)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 4 {
+		t.Errorf("Iterate returned %d records, expected 4", count)
+	}
+}
@@ -0,0 +1,127 @@
+package storage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"testing"
+)
+
+func TestRebind(t *testing.T) {
+	query := "INSERT INTO payloads (digest, payload) VALUES (?, ?)"
+
+	sqliteDb := sqlDb{dialect: sqlite}
+	if rebound := sqliteDb.rebind(query); rebound != query {
+		t.Errorf("SQLite query should be unchanged, got %s", rebound)
+	}
+
+	postgresDb := sqlDb{dialect: postgres}
+	expected := "INSERT INTO payloads (digest, payload) VALUES ($1, $2)"
+	if rebound := postgresDb.rebind(query); rebound != expected {
+		t.Errorf("PostgreSQL query was %s, expected %s", rebound, expected)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestMigrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dbPath := path.Join(dir, "crux.sqlite")
+
+	for i := 0; i < 2; i++ {
+		db, err := InitSqliteDb(dbPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var count, version int
+		err = db.conn.QueryRow(
+			"SELECT COUNT(*), MAX(version) FROM schema_migrations").Scan(&count, &version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != len(migrations) || version != len(migrations) {
+			t.Errorf("Found %d migrations up to version %d, expected %d",
+				count, version, len(migrations))
+		}
+		db.Close()
+	}
+}
+
+func TestConcurrentMigrate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestConcurrentMigrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dbPath := path.Join(dir, "crux.sqlite")
+
+	var wg sync.WaitGroup
+	errs := make([]error, 5)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			db, err := InitSqliteDb(dbPath)
+			if err == nil {
+				db.Close()
+			}
+			errs[i] = err
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Errorf("Concurrent migration failed: %v", err)
+		}
+	}
+}
+
+func TestReservedRecords(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestReservedRecords")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := InitSqliteDb(path.Join(dir, "crux.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	reservedKey := append(append([]byte{}, ReservedPrefix...), "index"...)
+	for _, key := range [][]byte{reservedKey, []byte("digest")} {
+		if err = db.Write(ctx, key, []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var count int
+	if err = db.conn.QueryRow("SELECT COUNT(*) FROM payloads").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("Found %d rows in the payloads table, expected only the payload", count)
+	}
+	var keys [][]byte
+	err = db.Iterate(ctx, All, func(key, value []byte) error {
+		keys = append(keys, append([]byte{}, key...))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]byte{reservedKey, []byte("digest")}
+	if len(keys) != len(expected) {
+		t.Fatalf("Iterate returned %q, expected %q", keys, expected)
+	}
+	for i := range keys {
+		if !bytes.Equal(keys[i], expected[i]) {
+			t.Errorf("Iterate returned %q, expected %q", keys, expected)
+		}
+	}
+}
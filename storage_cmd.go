@@ -0,0 +1,480 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/blk-io/crux/api"
+	"github.com/blk-io/crux/config"
+	"github.com/blk-io/crux/enclave"
+	"github.com/blk-io/crux/storage"
+	"github.com/blk-io/crux/utils"
+	"github.com/kevinburke/nacl"
+	"golang.org/x/net/context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+const storageCommand = "storage"
+
+const storageUsage = `usage: crux storage import --from <storage url> [--storage <storage url>]
+       crux storage migrate --from <storage url> --to <storage url>
+       crux storage reindex [--storage <storage url>]
+       crux storage backup --to <file> [--backupkey <key file>]
+       crux storage restore --from <file> [--backupkey <key file>] [--storage <storage url>]
+       crux storage check --publickeys <files> --privatekeys <files> [--quarantine]
+       crux storage rotate --storagepassword <password file>
+       crux storage collect --retention <rules> [--retentiondryrun]
+       crux storage audit verify [--audithead <seq>:<hash>]
+       crux storage audit export [--to <file>]
+  import   copies all payloads from an existing Constellation store into the configured storage
+  migrate  copies all payloads between two storage backends
+  reindex  rebuilds the recipient, sender and received time indexes of the configured storage
+  backup   writes a snapshot of the storage of the running node, via its IPC socket, to a file
+  restore  replaces the configured storage of a stopped node with a backup
+  check    checks that every payload in the configured storage is intact and can be decrypted
+  rotate   re-encrypts the configured storage with the first password in the password file
+  collect  deletes the payloads in the configured storage which have expired under the retention
+           rules
+  audit    verifies the audit log of the configured storage, or exports it as JSON lines to a
+           file or stdout
+
+Payload digests are verified as they are copied. Payloads which are already present in the
+destination are skipped, so an interrupted import or migration can be resumed by re-running it.
+The indexes of the destination are rebuilt once all payloads have been copied.
+
+Payloads which fail the check are moved aside with --quarantine, where they are kept but are no
+longer retrieved or resent.
+
+If a storage password file is given, the configured storage is encrypted at rest, as are both
+sides of a migration. Its first line is the current password, and any further lines are previous
+passwords, which are required until the storage has been rotated. Unencrypted storage is
+encrypted by importing it into new storage.
+
+Verifying or exporting the audit log prints its head. Record the head off-node, and pass it with
+--audithead to later verifications, which then also detect the whole log being rewritten.
+
+Backups are encrypted if a backup key is given. Every payload in a backup is verified before it
+is restored, and the existing storage is kept alongside the restored storage.`
+
+// openStorage opens the storage at url, which is encrypted if a storage password is configured.
+func openStorage(url, workDir string) (storage.DataStore, error) {
+	db, err := storage.Open(url, workDir)
+	if err != nil || config.GetString(config.StoragePassword) == "" {
+		return db, err
+	}
+	return encryptStorage(db)
+}
+
+// encryptStorage wraps db with the encryption of the configured storage password.
+func encryptStorage(db storage.DataStore) (storage.DataStore, error) {
+	passwords, err := loadStoragePasswords()
+	if err == nil {
+		var edb storage.DataStore
+		edb, err = storage.InitEncryptedDb(
+			context.Background(), db, passwords, config.GetBool(config.HashStorageKeys))
+		if err == nil {
+			return edb, nil
+		}
+	}
+	db.Close()
+	return nil, err
+}
+
+// loadStoragePasswords loads the storage passwords, one per line, the first being current.
+func loadStoragePasswords() ([]string, error) {
+	passwordFile := config.GetString(config.StoragePassword)
+	contents, err := ioutil.ReadFile(passwordFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read storage password: %v", err)
+	}
+	var passwords []string
+	for _, line := range strings.Split(string(contents), "\n") {
+		if password := strings.TrimSpace(line); password != "" {
+			passwords = append(passwords, password)
+		}
+	}
+	if len(passwords) == 0 {
+		return nil, fmt.Errorf("no storage password in %s", passwordFile)
+	}
+	return passwords, nil
+}
+
+// rotateStorageKey re-encrypts the storage at url with the current storage password.
+func rotateStorageKey(url, workDir string) error {
+	if config.GetString(config.StoragePassword) == "" {
+		return fmt.Errorf("--%s must be specified\n%s", config.StoragePassword, storageUsage)
+	}
+	db, err := openStorage(url, workDir)
+	if err != nil {
+		return fmt.Errorf("unable to open %s: %v", url, err)
+	}
+	defer db.Close()
+
+	rotator, ok := db.(interface {
+		Rotate(ctx context.Context) (int, error)
+	})
+	if !ok {
+		return fmt.Errorf("%s is not encrypted", url)
+	}
+	rotated, err := rotator.Rotate(context.Background())
+	if err != nil {
+		return fmt.Errorf("rotation failed, it can be resumed by running it again: %v", err)
+	}
+	fmt.Printf("Re-encrypted %d records in %s, previous passwords are no longer required\n",
+		rotated, url)
+	return nil
+}
+
+// storageUrl returns the URL of the configured storage.
+func storageUrl() string {
+	dbStorage := config.GetString(config.Storage)
+	if config.GetBool(config.BerkeleyDb) {
+		_, dbPath := storage.ParseUrl(dbStorage)
+		return "bdb:" + dbPath
+	}
+	return dbStorage
+}
+
+// runStorageCommand runs the storage subcommand specified by args.
+func runStorageCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf(storageUsage)
+	}
+
+	workDir := config.GetString(config.WorkDir)
+	switch args[0] {
+	case "import":
+		// The payloads being imported are never encrypted by Crux
+		return copyPayloads(config.GetString(config.From), storageUrl(), workDir, storage.Open)
+	case "migrate":
+		to := config.GetString(config.To)
+		if to == "" {
+			return fmt.Errorf("--%s must be specified\n%s", config.To, storageUsage)
+		}
+		return copyPayloads(config.GetString(config.From), to, workDir, openStorage)
+	case "reindex":
+		return reindexPayloads(storageUrl(), workDir)
+	case "backup":
+		return backupPayloads(config.GetString(config.To), workDir)
+	case "restore":
+		return restorePayloads(config.GetString(config.From), storageUrl(), workDir)
+	case "check":
+		return checkPayloads(storageUrl(), workDir, config.GetBool(config.Quarantine))
+	case "rotate":
+		return rotateStorageKey(storageUrl(), workDir)
+	case "collect":
+		return collectPayloads(storageUrl(), workDir, config.GetBool(config.RetentionDryRun))
+	case "audit":
+		if len(args) < 2 {
+			return fmt.Errorf(storageUsage)
+		}
+		return auditPayloads(args[1], storageUrl(), workDir, config.GetString(config.AuditHead),
+			config.GetString(config.To))
+	default:
+		return fmt.Errorf("unknown storage command %s\n%s", args[0], storageUsage)
+	}
+}
+
+// copyPayloads copies all payloads from the storage at from, such as a Constellation
+// bdb:storage or dir:storage directory, to the storage at to. The source is opened with
+// openFrom.
+func copyPayloads(
+	from, to, workDir string, openFrom func(url, workDir string) (storage.DataStore, error)) error {
+
+	if from == "" {
+		return fmt.Errorf("--%s must be specified\n%s", config.From, storageUsage)
+	}
+	if from == to {
+		return fmt.Errorf("cannot copy payloads from %s into itself", from)
+	}
+
+	src, err := openFrom(from, workDir)
+	if err != nil {
+		return fmt.Errorf("unable to open %s: %v", from, err)
+	}
+	defer src.Close()
+
+	dst, err := openStorage(to, workDir)
+	if err != nil {
+		return fmt.Errorf("unable to open %s: %v", to, err)
+	}
+	defer dst.Close()
+
+	stats, err := storage.Copy(context.Background(), src, dst, verifyPayload)
+	fmt.Printf("Read %d payloads from %s: %d copied to %s, %d already present, "+
+		"%d failed verification, %d conflicted with existing payloads\n",
+		stats.Read, from, stats.Copied, to, stats.Skipped, stats.Invalid, stats.Conflicts)
+	if err != nil {
+		return fmt.Errorf("copy failed, it can be resumed by running it again: %v", err)
+	}
+	if stats.Invalid > 0 || stats.Conflicts > 0 {
+		return fmt.Errorf("%d payloads were not copied", stats.Invalid+stats.Conflicts)
+	}
+	return rebuildIndexes(dst, to)
+}
+
+// reindexPayloads rebuilds the payload indexes of the storage at url.
+func reindexPayloads(url, workDir string) error {
+	db, err := openStorage(url, workDir)
+	if err != nil {
+		return fmt.Errorf("unable to open %s: %v", url, err)
+	}
+	defer db.Close()
+	return rebuildIndexes(db, url)
+}
+
+func rebuildIndexes(db storage.DataStore, url string) error {
+	indexed, err := enclave.RebuildIndexes(context.Background(), db)
+	if err != nil {
+		return fmt.Errorf("unable to rebuild indexes of %s: %v", url, err)
+	}
+	fmt.Printf("Indexed %d payloads in %s\n", indexed, url)
+	return nil
+}
+
+// backupPayloads writes a backup of the storage of the node running in workDir to output.
+func backupPayloads(output, workDir string) error {
+	if output == "" {
+		return fmt.Errorf("--%s must be specified\n%s", config.To, storageUsage)
+	}
+	key, err := loadBackupKey()
+	if err != nil {
+		return err
+	}
+
+	ipcPath := path.Join(workDir, config.GetString(config.Socket))
+	// The host is ignored, requests are always sent to the IPC socket
+	resp, err := utils.IpcClient(ipcPath).Get("http://localhost/backup")
+	if err != nil {
+		return fmt.Errorf("unable to connect to Crux at %s, is it running? %v", ipcPath, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var errResp api.ErrorResponse
+		json.NewDecoder(resp.Body).Decode(&errResp)
+		return fmt.Errorf("backup failed with status %d: %s", resp.StatusCode, errResp.Message)
+	}
+
+	// Write to a temporary file, so that an incomplete backup never replaces a previous one
+	tmpPath := output + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+
+	bw, err := storage.NewBackupWriter(f, key)
+	if err == nil {
+		// Reading the backup checks that it is complete
+		_, err = storage.ReadBackup(resp.Body, nil, bw.Write)
+	}
+	if err == nil {
+		err = bw.Close()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("backup failed: %v", err)
+	}
+	if err = os.Rename(tmpPath, output); err != nil {
+		return err
+	}
+	fmt.Printf("Backed up %d records to %s\n", bw.Count(), output)
+	return nil
+}
+
+// restorePayloads replaces the storage at url with the backup in the file input.
+func restorePayloads(input, url, workDir string) error {
+	if input == "" {
+		return fmt.Errorf("--%s must be specified\n%s", config.From, storageUsage)
+	}
+	key, err := loadBackupKey()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(input)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var encrypt func(storage.DataStore) (storage.DataStore, error)
+	if config.GetString(config.StoragePassword) != "" {
+		encrypt = encryptStorage
+	}
+	count, previous, err := storage.Restore(
+		context.Background(), url, workDir, bufio.NewReader(f), key, verifyPayload, encrypt)
+	if err != nil {
+		return fmt.Errorf("restore of %s failed, %s is unchanged: %v", input, url, err)
+	}
+	fmt.Printf("Restored %d records from %s to %s\n", count, input, url)
+	if previous != "" {
+		fmt.Printf("The previous storage has been moved to %s\n", previous)
+	}
+	return nil
+}
+
+// checkPayloads checks the payloads in the storage at url with the configured keys.
+func checkPayloads(url, workDir string, quarantine bool) error {
+	pubKeyFiles, privKeyFiles, err := keyFiles(workDir)
+	if err != nil {
+		return err
+	}
+	db, err := openStorage(url, workDir)
+	if err != nil {
+		return fmt.Errorf("unable to open %s: %v", url, err)
+	}
+	defer db.Close()
+
+	enc := enclave.Init(db, pubKeyFiles, privKeyFiles, api.PartyInfo{}, http.DefaultClient, false)
+	report, err := enc.Check(context.Background(), quarantine)
+	if err != nil {
+		return fmt.Errorf("check of %s failed: %v", url, err)
+	}
+
+	problems := 0
+	for _, problem := range enclave.CheckProblems {
+		for _, digest := range report.Problems[problem] {
+			fmt.Printf("%s: %v\n", base64.StdEncoding.EncodeToString(digest), problem)
+		}
+		problems += len(report.Problems[problem])
+	}
+	fmt.Printf("Checked %d payloads in %s: %d ok, %d with problems\n",
+		report.Checked, url, report.Checked-problems, problems)
+	for _, problem := range enclave.CheckProblems {
+		if n := len(report.Problems[problem]); n > 0 {
+			fmt.Printf("  %d %v\n", n, problem)
+		}
+	}
+	if report.Quarantined > 0 {
+		fmt.Printf("%d payloads have been quarantined\n", report.Quarantined)
+	}
+	if problems > 0 && !quarantine {
+		return fmt.Errorf("%d payloads failed the check", problems)
+	}
+	return nil
+}
+
+// collectPayloads deletes the payloads in the storage at url which have expired under the
+// configured retention rules, or only reports them if dryRun is true.
+func collectPayloads(url, workDir string, dryRun bool) error {
+	rules, err := enclave.ParseRetentionRules(config.GetString(config.Retention))
+	if err != nil {
+		return err
+	}
+	if len(rules) == 0 {
+		return fmt.Errorf("--%s must be specified\n%s", config.Retention, storageUsage)
+	}
+	db, err := openStorage(url, workDir)
+	if err != nil {
+		return fmt.Errorf("unable to open %s: %v", url, err)
+	}
+	defer db.Close()
+
+	report, err := enclave.Collect(context.Background(), db, rules, time.Now(), dryRun)
+	if dryRun {
+		fmt.Printf("%d payloads of %d bytes in %s have expired\n", report.Expired, report.Bytes, url)
+	} else {
+		fmt.Printf("Deleted %d of %d expired payloads, of %d bytes, from %s\n",
+			report.Deleted, report.Expired, report.Bytes, url)
+	}
+	if err != nil {
+		return fmt.Errorf("collection failed, it can be resumed by running it again: %v", err)
+	}
+	return nil
+}
+
+// auditPayloads verifies the audit log of the storage at url, against the recorded head if one is
+// given, or exports it to output, or stdout if no output is given.
+func auditPayloads(command, url, workDir, recordedHead, output string) error {
+	if command != "verify" && command != "export" {
+		return fmt.Errorf("unknown audit command %s\n%s", command, storageUsage)
+	}
+	var recorded *enclave.AuditHead
+	if recordedHead != "" {
+		head, err := enclave.ParseAuditHead(recordedHead)
+		if err != nil {
+			return err
+		}
+		recorded = &head
+	}
+	db, err := openStorage(url, workDir)
+	if err != nil {
+		return fmt.Errorf("unable to open %s: %v", url, err)
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	if command == "verify" {
+		head, err := enclave.VerifyAudit(ctx, db, recorded)
+		if err != nil {
+			return fmt.Errorf("audit log of %s failed verification after %d entries: %v",
+				url, head.Seq, err)
+		}
+		fmt.Printf("Verified %d audit entries in %s, the head of the log is %s\n",
+			head.Seq, url, head)
+		return nil
+	}
+
+	w := os.Stdout
+	if output != "" {
+		w, err = os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer w.Close()
+	}
+	head, err := enclave.ExportAudit(ctx, db, w)
+	if err != nil {
+		return fmt.Errorf("unable to export the audit log after %d entries: %v", head.Seq, err)
+	}
+	// The export itself may be written to stdout
+	fmt.Fprintf(os.Stderr, "Exported %d audit entries from %s, the head of the log is %s\n",
+		head.Seq, url, head)
+	return nil
+}
+
+// loadBackupKey loads the backup key, returning nil if none is configured.
+func loadBackupKey() (nacl.Key, error) {
+	keyFile := config.GetString(config.BackupKey)
+	if keyFile == "" {
+		return nil, nil
+	}
+	encoded, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read backup key: %v", err)
+	}
+	key, err := utils.LoadBase64Key(strings.TrimSpace(string(encoded)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid backup key in %s: %v", keyFile, err)
+	}
+	return key, nil
+}
+
+// verifyPayload checks that key is the digest of the ciphertext of the encoded payload. Records
+// which are not payloads, such as indexes, are not verified.
+func verifyPayload(key, value []byte) error {
+	if storage.IsReserved(key) {
+		return nil
+	}
+	epl, _, err := api.ParsePayloadWithRecipients(value)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(utils.Sha3Hash(epl.CipherText), key) {
+		return fmt.Errorf("digest does not match payload ciphertext")
+	}
+	return nil
+}
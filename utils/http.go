@@ -1,8 +1,23 @@
 package utils
 
-import "net/http"
+import (
+	"net"
+	"net/http"
+)
 
 // HttpClient is an interface for sending synchronous HTTP requests.
 type HttpClient interface {
 	Do(req *http.Request) (*http.Response, error)
 }
+
+// IpcClient returns an HTTP client which sends all requests to the IPC socket at path, whatever
+// the host of their URL.
+func IpcClient(path string) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Dial: func(network, addr string) (net.Conn, error) {
+				return net.Dial("unix", path)
+			},
+		},
+	}
+}